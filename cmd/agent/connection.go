@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// stableAfter is how long a connection must stay up for the reconnect
+// backoff to reset
+const stableAfter = 30 * time.Second
+
+// Connection states reported by the status endpoint
+const (
+	stateConnecting   = "connecting"
+	stateConnected    = "connected"
+	stateDisconnected = "disconnected"
+	stateRejected     = "rejected"
+)
+
+// parseURLs splits a comma-separated list of middleware URLs, keeping the
+// order in which they are tried
+func parseURLs(s string) []string {
+	var urls []string
+	for u := range strings.SplitSeq(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// backoff computes reconnect delays that double up to a cap, with jitter so
+// a fleet of agents doesn't reconnect in lockstep
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// next returns the delay before the next attempt: a random duration between
+// half and all of the current backoff
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+	}
+	d := b.current/2 + rand.N(b.current/2+1)
+	b.current = min(b.current*2, b.max)
+	return d
+}
+
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+// ConnectionStatus is the agent's view of its link to the middleware
+type ConnectionStatus struct {
+	State       string     `json:"state"`
+	URL         string     `json:"url,omitempty"`
+	URLs        []string   `json:"urls"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// Rejection is the middleware's last refusal of the registration
+	Rejection *protocol.RegisterReject `json:"rejection,omitempty"`
+	// Retries counts consecutive failed attempts since the last stable
+	// connection
+	Retries    int        `json:"retries"`
+	NextRetry  *time.Time `json:"next_retry,omitempty"`
+	Reconnects int        `json:"reconnects"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// statusTracker records connection state changes and publishes them to an
+// optional status file
+type statusTracker struct {
+	path string
+
+	mu     sync.Mutex
+	status ConnectionStatus
+}
+
+func newStatusTracker(urls []string, path string) *statusTracker {
+	t := &statusTracker{
+		path:   path,
+		status: ConnectionStatus{State: stateDisconnected, URLs: urls},
+	}
+	t.update(func(*ConnectionStatus) {})
+	return t
+}
+
+func (t *statusTracker) connecting(url string) {
+	t.update(func(st *ConnectionStatus) {
+		st.State = stateConnecting
+		st.URL = url
+		st.NextRetry = nil
+	})
+}
+
+func (t *statusTracker) connected(url string) {
+	now := time.Now()
+	t.update(func(st *ConnectionStatus) {
+		if st.ConnectedAt != nil || st.LastErrorAt != nil {
+			st.Reconnects++
+		}
+		st.State = stateConnected
+		st.URL = url
+		st.ConnectedAt = &now
+		st.Rejection = nil
+	})
+}
+
+func (t *statusTracker) failed(err error, retries int) {
+	now := time.Now()
+	t.update(func(st *ConnectionStatus) {
+		st.State = stateDisconnected
+		st.LastError = err.Error()
+		st.LastErrorAt = &now
+		st.Retries = retries
+	})
+}
+
+func (t *statusTracker) rejected(reject protocol.RegisterReject, retries int) {
+	now := time.Now()
+	t.update(func(st *ConnectionStatus) {
+		st.State = stateRejected
+		st.LastError = reject.Reason
+		st.LastErrorAt = &now
+		st.Rejection = &reject
+		st.Retries = retries
+	})
+}
+
+func (t *statusTracker) waiting(next time.Time) {
+	t.update(func(st *ConnectionStatus) { st.NextRetry = &next })
+}
+
+func (t *statusTracker) Get() ConnectionStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+func (t *statusTracker) update(fn func(*ConnectionStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(&t.status)
+	t.status.UpdatedAt = time.Now()
+	if t.path == "" {
+		return
+	}
+	if err := writeStatusFile(t.path, t.status); err != nil {
+		log.Printf("[Agent] Failed to write status file: %v", err)
+	}
+}
+
+func writeStatusFile(path string, st ConnectionStatus) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// serveStatus exposes the connection status as JSON on addr
+func serveStatus(addr string, t *statusTracker) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(t.Get())
+	})
+	log.Printf("[Agent] Status endpoint on http://%s/status", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("[Agent] Status endpoint stopped: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// savedCredential is the credential file written after enrolling. Agents on
+// the shared secret only keep their assigned ID in it.
+type savedCredential struct {
+	AgentID    string `json:"agent_id"`
+	Credential string `json:"credential"`
+}
+
+// identity is how the agent authenticates: with its own credential once it
+// has enrolled, otherwise with an enrollment token or the legacy shared
+// secret
+type identity struct {
+	path        string
+	enrollToken string
+	secret      string
+	saved       savedCredential
+	// unsaved is set while saved hasn't been written to path
+	unsaved bool
+}
+
+// loadIdentity reads the credential file at path, if the agent has enrolled.
+// Agents with a client certificate need no other credential.
+func loadIdentity(path, enrollToken, secret string, hasCert bool) (*identity, error) {
+	id := &identity{path: path, enrollToken: enrollToken, secret: secret}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &id.saved); err != nil {
+			return nil, fmt.Errorf("invalid credentials file %s: %w", path, err)
+		}
+	}
+
+	if id.saved.Credential == "" && enrollToken == "" && secret == "" && !hasCert {
+		return nil, errors.New("no credential: enroll with -enroll-token, use -cert or set -secret")
+	}
+	// Enrolling uses up the token, so make sure the credential can be kept
+	if id.saved.Credential == "" && enrollToken != "" {
+		if err := checkWritable(path); err != nil {
+			return nil, fmt.Errorf("can't enroll, credentials file isn't writable: %w", err)
+		}
+	}
+	return id, nil
+}
+
+// checkWritable checks that a file can be written next to path
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(path + ".tmp")
+}
+
+// apply sets the registration's authentication fields
+func (id *identity) apply(reg *protocol.AgentRegistration) {
+	switch {
+	case id.saved.Credential != "":
+		reg.Credential = id.saved.Credential
+	case id.enrollToken != "":
+		reg.EnrollmentToken = id.enrollToken
+	default:
+		reg.SecretKey = id.secret
+		reg.AgentID = id.saved.AgentID
+	}
+}
+
+// usesSecret reports whether the agent authenticates with the shared secret
+func (id *identity) usesSecret() bool {
+	return id.saved.Credential == "" && id.enrollToken == "" && id.secret != ""
+}
+
+// store persists the credential issued when enrolling, or the ID assigned
+// to an agent on the shared secret. They are kept in memory if they can't
+// be written, and writing them is retried on every connection until it
+// succeeds.
+func (id *identity) store(ack protocol.RegisterAck) {
+	switch {
+	case ack.Credential != "":
+		id.saved = savedCredential{AgentID: ack.AgentID, Credential: ack.Credential}
+		id.unsaved = true
+	case id.usesSecret() && ack.AgentID != id.saved.AgentID:
+		id.saved.AgentID = ack.AgentID
+		id.unsaved = true
+	}
+	if !id.unsaved {
+		return
+	}
+
+	if err := id.save(); err != nil {
+		log.Printf("[Agent] Failed to save %s, it would be lost on restart: %v", id.path, err)
+		return
+	}
+	id.unsaved = false
+	if ack.Credential != "" {
+		log.Printf("[Agent] Enrolled, credential saved to %s", id.path)
+	}
+}
+
+// save writes the credential file
+func (id *identity) save() error {
+	data, _ := json.MarshalIndent(id.saved, "", "  ")
+	tmp := id.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, id.path)
+}
@@ -1,41 +1,201 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/Patopm/remote-monitor/internal/inventory"
+	"github.com/Patopm/remote-monitor/internal/pki"
 	"github.com/Patopm/remote-monitor/internal/process"
 	"github.com/Patopm/remote-monitor/internal/protocol"
 )
 
+// version is the agent version reported in host facts, set at build time
+// with -ldflags "-X main.version=..."
+var version = "dev"
+
+// factsInterval is how often host facts are re-collected to detect changes
+const factsInterval = 5 * time.Minute
+
 func main() {
-	middlewareURL := flag.String("middleware", "ws://localhost:8080/ws/agent", "Middleware WebSocket URL")
+	middlewareURLs := flag.String("middleware", "ws://localhost:8080/ws/agent", "Middleware WebSocket URLs, comma-separated in failover order")
 	interval := flag.Duration("interval", 2*time.Second, "Telemetry send interval")
-	secretKey := flag.String("secret", "default-agent-secret", "Shared secret for authentication")
+	secretKey := flag.String("secret", "", "Legacy shared secret, used when the agent has no credential")
+	enrollToken := flag.String("enroll-token", "", "Enrollment token exchanged for the agent's credential on first connection")
+	credentialsFile := flag.String("credentials", "credentials.json", "File where the agent's credential is kept")
+	caFile := flag.String("ca", "", "CA bundle used to verify the middleware's certificate for wss:// URLs")
+	certFile := flag.String("cert", "", "Client certificate for mutual TLS; its common name is the agent ID")
+	keyFile := flag.String("key", "", "Private key of the client certificate")
+	commandKey := flag.String("command-key", "", "Middleware public key that commands must be signed with (PEM)")
+	seenCommandsFile := flag.String("seen-commands", "seen-commands.json", "File where executed command IDs are kept until they expire, to reject replays across restarts")
+	servicesFile := flag.String("services", "services.json", "File where supervised service definitions are kept")
+	labelsFlag := flag.String("labels", "", "Agent labels, e.g. env=prod,role=db")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 60*time.Second, "Reconnect if nothing is heard from the middleware for this long")
+	initialBackoff := flag.Duration("backoff", time.Second, "Initial reconnect delay")
+	maxBackoff := flag.Duration("max-backoff", 2*time.Minute, "Maximum reconnect delay")
+	statusFile := flag.String("status-file", "", "File where the connection status is written (disabled if empty)")
+	bufferSize := flag.Int("buffer", 300, "Telemetry samples kept while disconnected, backfilled on reconnect")
+	bufferBytes := flag.Int("buffer-bytes", 16<<20, "Total encoded size of the telemetry samples kept while disconnected")
+	fullEvery := flag.Int("full-every", 30, "Send a full telemetry snapshot every this many samples, deltas in between")
+	encoding := flag.String("encoding", protocol.EncodingJSON, "Telemetry encoding: json or binary")
+	compress := flag.Bool("compress", false, "Negotiate permessage-deflate compression with the middleware")
+	rejectedBackoff := flag.Duration("rejected-backoff", time.Hour, "Reconnect delay once every middleware rejected the credentials; 0 exits instead")
+	statusAddr := flag.String("status-addr", "", "Address for the local status endpoint, e.g. 127.0.0.1:9100 (disabled if empty)")
 	flag.Parse()
 
-	log.Printf("[Agent] Target middleware: %s", *middlewareURL)
+	urls := parseURLs(*middlewareURLs)
+	if len(urls) == 0 {
+		log.Fatalf("[Agent] At least one -middleware URL is required")
+	}
+	if *encoding != protocol.EncodingJSON && *encoding != protocol.EncodingBinary {
+		log.Fatalf("[Agent] Unknown -encoding %q", *encoding)
+	}
+	if *initialBackoff <= 0 || *maxBackoff < *initialBackoff {
+		log.Fatalf("[Agent] -max-backoff must be at least -backoff, which must be positive")
+	}
+
+	labels, err := protocol.ParseLabels(*labelsFlag)
+	if err != nil {
+		log.Fatalf("[Agent] Invalid -labels: %v", err)
+	}
+
+	tlsConfig, err := clientTLSConfig(*caFile, *certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("[Agent] Invalid TLS configuration: %v", err)
+	}
+
+	var commandPublicKey ed25519.PublicKey
+	if *commandKey != "" {
+		commandPublicKey, err = pki.LoadPublicKey(*commandKey)
+		if err != nil {
+			log.Fatalf("[Agent] Invalid command key: %v", err)
+		}
+	} else {
+		log.Printf("[Agent] No -command-key set, commands are executed without verifying their signature")
+	}
+	verifier, err := newCommandVerifier(commandPublicKey, *seenCommandsFile)
+	if err != nil {
+		log.Fatalf("[Agent] Failed to load seen commands: %v", err)
+	}
+
+	ident, err := loadIdentity(*credentialsFile, *enrollToken, *secretKey, *certFile != "")
+	if err != nil {
+		log.Fatalf("[Agent] %v", err)
+	}
+
+	supervisor, err := process.NewSupervisor(*servicesFile)
+	if err != nil {
+		log.Fatalf("[Agent] Failed to load services: %v", err)
+	}
+
+	telemetry := newSampler(supervisor, *bufferSize, *bufferBytes, *fullEvery)
+	go telemetry.run(*interval)
+
+	status := newStatusTracker(urls, *statusFile)
+	if *statusAddr != "" {
+		go serveStatus(*statusAddr, status)
+	}
 
+	log.Printf("[Agent] Target middleware: %s", strings.Join(urls, ", "))
+
+	wire := wireOptions{encoding: *encoding, compress: *compress, tls: tlsConfig}
+	retry := backoff{initial: *initialBackoff, max: *maxBackoff}
+	retries := 0
 	for {
-		err := run(*middlewareURL, *interval, *secretKey)
-		log.Printf("[Agent] Disconnected: %v", err)
-		log.Printf("[Agent] Reconnecting in 5 seconds...")
-		time.Sleep(5 * time.Second)
+		// Try each middleware in order. After a stable connection drops,
+		// start over from the first one, which is the preferred.
+		rejections := 0
+		for _, url := range urls {
+			status.connecting(url)
+			var connectedAt time.Time
+			err := run(url, wire, *heartbeatTimeout, ident, labels, supervisor, verifier, telemetry, func() {
+				connectedAt = time.Now()
+				status.connected(url)
+			})
+			log.Printf("[Agent] Disconnected from %s: %v", url, err)
+
+			// Another middleware may still accept the agent
+			var rejected *rejectedError
+			if errors.As(err, &rejected) && rejected.Permanent {
+				retries++
+				rejections++
+				status.rejected(rejected.RegisterReject, retries)
+				continue
+			}
+
+			stable := !connectedAt.IsZero() && time.Since(connectedAt) >= stableAfter
+			if stable {
+				retry.reset()
+				retries = 0
+			}
+			retries++
+			status.failed(err, retries)
+			if stable {
+				break
+			}
+		}
+
+		// Every middleware refused the agent's credentials
+		if rejections == len(urls) {
+			if *rejectedBackoff == 0 {
+				log.Fatalf("[Agent] Permanently rejected by every middleware, exiting")
+			}
+			status.waiting(time.Now().Add(*rejectedBackoff))
+			log.Printf("[Agent] Permanently rejected, next attempt in %s", *rejectedBackoff)
+			time.Sleep(*rejectedBackoff)
+			retry.reset()
+			continue
+		}
+
+		delay := retry.next()
+		status.waiting(time.Now().Add(delay))
+		log.Printf("[Agent] Reconnecting in %s (attempt %d)...", delay.Round(time.Millisecond), retries+1)
+		time.Sleep(delay)
 	}
 }
 
-func run(url string, interval time.Duration, secret string) error {
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+// wireOptions selects how the connection is secured and how messages are
+// encoded on it
+type wireOptions struct {
+	encoding string
+	compress bool
+	tls      *tls.Config
+}
+
+func run(
+	url string,
+	wire wireOptions,
+	heartbeatTimeout time.Duration,
+	ident *identity,
+	labels map[string]string,
+	supervisor *process.Supervisor,
+	verifier *commandVerifier,
+	telemetry *sampler,
+	onConnected func(),
+) error {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = wire.compress
+	dialer.TLSClientConfig = wire.tls
+	conn, resp, err := dialer.Dial(url, nil)
 	if err != nil {
 		return err
 	}
+	if wire.compress && !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		log.Printf("[Agent] Middleware declined compression")
+	}
 	defer func() {
 		err := conn.Close()
 		if err != nil {
@@ -45,6 +205,14 @@ func run(url string, interval time.Duration, secret string) error {
 
 	var writeMu sync.Mutex
 
+	// The middleware pings periodically; any frame from it pushes back the
+	// read deadline so a half-open connection is detected and dropped
+	_ = conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
+	conn.SetPingHandler(func(appData string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(10*time.Second))
+	})
+
 	// Helper to safely write JSON
 	safeWrite := func(v any) error {
 		writeMu.Lock()
@@ -54,11 +222,22 @@ func run(url string, interval time.Duration, secret string) error {
 
 	// --- Registration ---
 	hostname, _ := os.Hostname()
+	facts := inventory.Collect(version)
 	reg := protocol.AgentRegistration{
-		Hostname:  hostname,
-		OS:        runtime.GOOS,
-		SecretKey: secret,
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Labels:   labels,
+		Facts:    &facts,
+		Encoding: wire.encoding,
+
+		ProtocolVersion: protocol.ProtocolVersion,
+		Capabilities: &protocol.Capabilities{
+			Actions:   supportedActions,
+			Encodings: []string{protocol.EncodingJSON, protocol.EncodingBinary},
+			Telemetry: []string{protocol.FeatureDelta, protocol.FeatureBackfill},
+		},
 	}
+	ident.apply(&reg)
 	regData, _ := json.Marshal(reg)
 	if err := safeWrite(protocol.WSMessage{
 		Type: "register",
@@ -66,35 +245,58 @@ func run(url string, interval time.Duration, secret string) error {
 	}); err != nil {
 		return err
 	}
-	log.Printf("[Agent] Registered as '%s' (%s)", hostname, runtime.GOOS)
 
-	// --- Telemetry goroutine ---
+	ack, err := awaitAck(conn)
+	if err != nil {
+		return err
+	}
+	ident.store(ack)
+	log.Printf(
+		"[Agent] Registered as %s (protocol v%d, %s encoding, telemetry features %v)",
+		ack.AgentID, ack.ProtocolVersion, ack.Encoding, ack.Telemetry,
+	)
+	onConnected()
+
+	// --- Telemetry ---
+	sendMessage := func(msgType string, v any) error {
+		if ack.Encoding == protocol.EncodingBinary && protocol.IsBinaryType(msgType) {
+			frame, err := protocol.EncodeBinary(msgType, v)
+			if err != nil {
+				return err
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			return conn.WriteMessage(websocket.BinaryMessage, frame)
+		}
+		data, _ := json.Marshal(v)
+		return safeWrite(protocol.WSMessage{Type: msgType, Data: data})
+	}
+	telemetry.attach(sendMessage, ack.Telemetry)
+	defer telemetry.detach()
+
 	stop := make(chan struct{})
 	defer close(stop)
 
 	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
+		factsTicker := time.NewTicker(factsInterval)
+		defer factsTicker.Stop()
 
 		for {
 			select {
 			case <-stop:
 				return
-			case <-ticker.C:
-				procs, err := process.ListProcesses()
-				if err != nil {
-					log.Printf("[Agent] Error reading processes: %v", err)
+			case <-factsTicker.C:
+				current := inventory.Collect(version)
+				if reflect.DeepEqual(current, facts) {
 					continue
 				}
-
-				telemetry := protocol.AgentTelemetry{Processes: procs}
-				data, _ := json.Marshal(telemetry)
-				msg := protocol.WSMessage{Type: "telemetry", Data: data}
-
-				if err := safeWrite(msg); err != nil {
-					log.Printf("[Agent] Error sending telemetry: %v", err)
+				facts = current
+				data, _ := json.Marshal(facts)
+				if err := safeWrite(protocol.WSMessage{Type: "facts", Data: data}); err != nil {
+					log.Printf("[Agent] Error sending facts: %v", err)
 					return
 				}
+				log.Printf("[Agent] Host facts changed, sent update")
 			}
 		}
 	}()
@@ -105,8 +307,13 @@ func run(url string, interval time.Duration, secret string) error {
 		if err := conn.ReadJSON(&msg); err != nil {
 			return err
 		}
+		_ = conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
 
 		switch msg.Type {
+		case "resync":
+			log.Printf("[Agent] Middleware requested a full telemetry snapshot")
+			telemetry.resync()
+
 		case "command":
 			var cmd protocol.AgentCommand
 			if err := json.Unmarshal(msg.Data, &cmd); err != nil {
@@ -118,7 +325,16 @@ func run(url string, interval time.Duration, secret string) error {
 				"[Agent] Received command: %s (target: %s)",
 				cmd.Action, cmd.Target,
 			)
-			resp := executeCommand(cmd)
+			var resp protocol.AgentCommandResponse
+			if err := verifier.verify(cmd, ack.AgentID, time.Now()); err != nil {
+				log.Printf("[Agent] Rejected command %s: %v", cmd.CommandID, err)
+				resp = protocol.AgentCommandResponse{
+					CommandID: cmd.CommandID,
+					Message:   "Rejected: " + err.Error(),
+				}
+			} else {
+				resp = executeCommand(cmd, supervisor)
+			}
 
 			data, _ := json.Marshal(resp)
 			respMsg := protocol.WSMessage{
@@ -135,13 +351,85 @@ func run(url string, interval time.Duration, secret string) error {
 	}
 }
 
-func executeCommand(cmd protocol.AgentCommand) protocol.AgentCommandResponse {
+// clientTLSConfig builds the TLS configuration for wss:// URLs from an
+// optional CA bundle and client certificate
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := pki.CertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// rejectedError is returned when the middleware refuses the registration
+type rejectedError struct {
+	protocol.RegisterReject
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("registration rejected (%s): %s", e.Code, e.Reason)
+}
+
+// awaitAck waits for the middleware to acknowledge the registration. A
+// rejection is returned as a *rejectedError; middlewares that only close
+// the connection have their close reason returned instead.
+func awaitAck(conn *websocket.Conn) (protocol.RegisterAck, error) {
+	var ack protocol.RegisterAck
+	var msg protocol.WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Text != "" {
+			return ack, fmt.Errorf("registration rejected: %s", closeErr.Text)
+		}
+		return ack, err
+	}
+	switch msg.Type {
+	case "register_ack":
+	case "register_reject":
+		var reject protocol.RegisterReject
+		if err := json.Unmarshal(msg.Data, &reject); err != nil {
+			return ack, fmt.Errorf("invalid register_reject: %w", err)
+		}
+		return ack, &rejectedError{reject}
+	default:
+		return ack, fmt.Errorf("expected register_ack, got %q", msg.Type)
+	}
+	if err := json.Unmarshal(msg.Data, &ack); err != nil {
+		return ack, fmt.Errorf("invalid register_ack: %w", err)
+	}
+	return ack, nil
+}
+
+// supportedActions are the command actions executeCommand handles
+var supportedActions = []string{
+	protocol.ActionStop,
+	protocol.ActionSignal,
+	protocol.ActionStart,
+	protocol.ActionServicePut,
+	protocol.ActionServiceDelete,
+}
+
+func executeCommand(cmd protocol.AgentCommand, supervisor *process.Supervisor) protocol.AgentCommandResponse {
 	resp := protocol.AgentCommandResponse{
 		CommandID: cmd.CommandID,
 	}
 
 	switch cmd.Action {
-	case "STOP":
+	case protocol.ActionStop:
 		if err := process.StopProcess(cmd.Target); err != nil {
 			resp.Success = false
 			resp.Message = err.Error()
@@ -149,6 +437,42 @@ func executeCommand(cmd protocol.AgentCommand) protocol.AgentCommandResponse {
 			resp.Success = true
 			resp.Message = "Process stopped successfully"
 		}
+	case protocol.ActionSignal:
+		if err := process.SignalProcess(cmd.Target, cmd.Signal); err != nil {
+			resp.Success = false
+			resp.Message = err.Error()
+		} else {
+			resp.Success = true
+			resp.Message = "Signal " + cmd.Signal + " sent successfully"
+		}
+	case protocol.ActionStart:
+		pid, err := process.StartProcess(cmd.Target, cmd.Args...)
+		if err != nil {
+			resp.Success = false
+			resp.Message = err.Error()
+		} else {
+			resp.Success = true
+			resp.Message = fmt.Sprintf("Process started with PID %d", pid)
+		}
+	case protocol.ActionServicePut:
+		if cmd.Service == nil {
+			resp.Success = false
+			resp.Message = "Missing service definition"
+		} else if err := supervisor.Put(*cmd.Service); err != nil {
+			resp.Success = false
+			resp.Message = err.Error()
+		} else {
+			resp.Success = true
+			resp.Message = "Service " + cmd.Service.Name + " supervised"
+		}
+	case protocol.ActionServiceDelete:
+		if err := supervisor.Delete(cmd.Target); err != nil {
+			resp.Success = false
+			resp.Message = err.Error()
+		} else {
+			resp.Success = true
+			resp.Message = "Service " + cmd.Target + " removed"
+		}
 	default:
 		resp.Success = false
 		resp.Message = "Unknown action: " + cmd.Action
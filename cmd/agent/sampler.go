@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/process"
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// backfillBatchBytes bounds the encoded size of the buffered samples sent in
+// each backfill message; a larger sample is sent on its own
+const backfillBatchBytes = 1 << 20
+
+// sampler takes telemetry samples on a fixed interval whether or not the
+// agent is connected. Samples taken while disconnected are buffered, up to
+// a number of samples and a total encoded size, and backfilled once a
+// connection is attached.
+//
+// While connected, most samples are sent as deltas against the previous one,
+// with a full snapshot every fullEvery samples, after attaching and whenever
+// the middleware asks for a resync.
+//
+// Messages are prepared under the lock and sent outside it, so a slow
+// connection never blocks resync requests from the read loop.
+type sampler struct {
+	supervisor *process.Supervisor
+	limit      int
+	limitBytes int
+	fullEvery  int
+
+	mu          sync.Mutex
+	send        sendFunc         // nil while disconnected or backfilling
+	conn        uint64           // incremented by attach and detach
+	buffer      []bufferedSample // oldest first
+	bufferBytes int
+	dropped     int
+
+	// Telemetry features negotiated with the middleware
+	deltas   bool
+	backfill bool
+
+	// Delta baseline: the last sample sent and its sequence number
+	seq       uint64
+	base      []protocol.ProcessInfo
+	sinceFull int
+	needFull  bool
+}
+
+// bufferedSample is a sample taken while disconnected, with its size once
+// encoded as JSON, the largest of the encodings
+type bufferedSample struct {
+	telemetry protocol.AgentTelemetry
+	size      int
+}
+
+// sendFunc sends a message of the given type to the middleware
+type sendFunc func(msgType string, v any) error
+
+func newSampler(supervisor *process.Supervisor, limit, limitBytes, fullEvery int) *sampler {
+	return &sampler{supervisor: supervisor, limit: limit, limitBytes: limitBytes, fullEvery: fullEvery}
+}
+
+// run samples every interval until the process exits
+func (s *sampler) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sample()
+	}
+}
+
+func (s *sampler) sample() {
+	procs, err := process.ListProcesses()
+	if err != nil {
+		log.Printf("[Agent] Error reading processes: %v", err)
+		return
+	}
+	telemetry := protocol.AgentTelemetry{
+		Timestamp: time.Now().UTC(),
+		Processes: procs,
+		Services:  s.supervisor.Status(),
+	}
+
+	s.mu.Lock()
+	if send, conn := s.send, s.conn; send != nil {
+		msgType, v := s.next(telemetry)
+		s.mu.Unlock()
+		err := send(msgType, v)
+		if err == nil {
+			return
+		}
+		log.Printf("[Agent] Error sending telemetry, buffering: %v", err)
+		s.mu.Lock()
+		if s.conn == conn {
+			s.send = nil
+		}
+	}
+	defer s.mu.Unlock()
+
+	if s.limit <= 0 || s.limitBytes <= 0 {
+		return
+	}
+	data, err := json.Marshal(telemetry)
+	if err != nil {
+		log.Printf("[Agent] Error encoding telemetry: %v", err)
+		return
+	}
+	if len(data) > s.limitBytes {
+		s.dropped++
+		return
+	}
+	s.fit(1, len(data))
+	s.buffer = append(s.buffer, bufferedSample{telemetry: telemetry, size: len(data)})
+	s.bufferBytes += len(data)
+}
+
+// fit drops the oldest buffered samples until n more samples of size bytes
+// in total fit within the limits. Callers must hold the lock.
+func (s *sampler) fit(n, size int) {
+	for len(s.buffer) > 0 && (len(s.buffer)+n > s.limit || s.bufferBytes+size > s.limitBytes) {
+		s.bufferBytes -= s.buffer[0].size
+		s.buffer = append(s.buffer[:0], s.buffer[1:]...)
+		s.dropped++
+	}
+}
+
+// next turns a live sample into a full snapshot or a delta against the
+// previous one. The new baseline is what the middleware holds after applying
+// it, so that changes too small to be sent still add up against it.
+// Callers must hold the lock.
+func (s *sampler) next(telemetry protocol.AgentTelemetry) (string, any) {
+	s.seq++
+
+	if !s.deltas || s.needFull || s.sinceFull+1 >= s.fullEvery {
+		s.needFull = false
+		s.sinceFull = 0
+		s.base = telemetry.Processes
+		telemetry.Seq = s.seq
+		return "telemetry", telemetry
+	}
+
+	s.sinceFull++
+	delta := protocol.TelemetryDelta{
+		Seq:       s.seq,
+		Timestamp: telemetry.Timestamp,
+		Services:  telemetry.Services,
+	}
+	delta.Added, delta.Changed, delta.Removed = protocol.DiffProcesses(s.base, telemetry.Processes)
+	s.base = protocol.ApplyDelta(s.base, delta)
+	return "telemetry_delta", delta
+}
+
+// resync makes the next live sample a full snapshot
+func (s *sampler) resync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.needFull = true
+}
+
+// attach backfills the buffered samples through send in the background,
+// then delivers new samples through it until detach is called. features are
+// the telemetry features negotiated for the connection.
+func (s *sampler) attach(send sendFunc, features []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn++
+	s.deltas = slices.Contains(features, protocol.FeatureDelta)
+	s.backfill = slices.Contains(features, protocol.FeatureBackfill)
+	if !s.backfill && len(s.buffer) > 0 {
+		log.Printf("[Agent] Middleware doesn't accept backfill, discarding %d buffered samples", len(s.buffer))
+		s.buffer = nil
+		s.bufferBytes = 0
+		s.dropped = 0
+	}
+	if n := len(s.buffer); n > 0 {
+		log.Printf("[Agent] Backfilling %d buffered samples, %d bytes (%d dropped)", n, s.bufferBytes, s.dropped)
+	}
+	go s.drain(send, s.conn)
+}
+
+// drain sends the buffered samples in batches, each taken out of the buffer
+// under the lock and sent outside it. Samples taken meanwhile are buffered
+// and sent in later batches. Once the buffer is empty, live samples go
+// through send, unless the connection was detached.
+func (s *sampler) drain(send sendFunc, conn uint64) {
+	for {
+		s.mu.Lock()
+		if s.conn != conn {
+			s.mu.Unlock()
+			return
+		}
+		if len(s.buffer) == 0 {
+			s.buffer = nil
+			s.send = send
+			s.needFull = true
+			s.mu.Unlock()
+			return
+		}
+
+		batch := protocol.TelemetryBatch{Dropped: s.dropped}
+		size := 0
+		for _, b := range s.buffer {
+			if len(batch.Samples) > 0 && size+b.size > backfillBatchBytes {
+				break
+			}
+			batch.Samples = append(batch.Samples, b.telemetry)
+			size += b.size
+		}
+		taken := slices.Clone(s.buffer[:len(batch.Samples)])
+		s.buffer = s.buffer[len(taken):]
+		s.bufferBytes -= size
+		s.dropped = 0
+		s.mu.Unlock()
+
+		if err := send("telemetry_batch", batch); err != nil {
+			log.Printf("[Agent] Error backfilling telemetry: %v", err)
+			// Put the batch back for the next connection, in front of the
+			// samples taken since
+			s.mu.Lock()
+			s.buffer = append(taken, s.buffer...)
+			s.bufferBytes += size
+			s.dropped += batch.Dropped
+			s.fit(0, 0)
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// detach stops delivering samples, including a backfill in progress; they
+// are buffered until the next attach
+func (s *sampler) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn++
+	s.send = nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+const (
+	// maxClockSkew is how far the agent's clock may drift from the
+	// middleware's before signed commands are rejected
+	maxClockSkew = time.Minute
+	// maxCommandTTL bounds how far in the future a command may expire, which
+	// in turn bounds how long command IDs are remembered
+	maxCommandTTL = 10 * time.Minute
+)
+
+// commandVerifier checks that commands were signed by the middleware for
+// this agent, haven't expired and aren't replays of an earlier command.
+// It is only used from the connection's read loop.
+type commandVerifier struct {
+	key ed25519.PublicKey // nil accepts unsigned commands
+	// seen maps the IDs of accepted commands to when they can be forgotten.
+	// It is saved to path so that a restart doesn't allow replays.
+	seen map[string]time.Time
+	path string // empty keeps seen in memory only
+}
+
+// newCommandVerifier loads the command IDs recorded in path that haven't
+// expired yet
+func newCommandVerifier(key ed25519.PublicKey, path string) (*commandVerifier, error) {
+	v := &commandVerifier{key: key, seen: make(map[string]time.Time), path: path}
+	if key == nil || path == "" {
+		return v, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &v.seen); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	v.prune(time.Now())
+	return v, nil
+}
+
+// verify checks a command addressed to agentID and records its ID
+func (v *commandVerifier) verify(cmd protocol.AgentCommand, agentID string, now time.Time) error {
+	if v.key == nil {
+		return nil
+	}
+	if err := protocol.VerifyCommand(v.key, cmd); err != nil {
+		return err
+	}
+	if cmd.AgentID != agentID {
+		return fmt.Errorf("command is addressed to agent %q", cmd.AgentID)
+	}
+	if cmd.CommandID == "" {
+		return errors.New("command has no ID")
+	}
+	switch {
+	case now.After(cmd.ExpiresAt.Add(maxClockSkew)):
+		return fmt.Errorf("command expired at %s", cmd.ExpiresAt.Format(time.RFC3339))
+	case cmd.ExpiresAt.After(now.Add(maxCommandTTL + maxClockSkew)):
+		return fmt.Errorf("command expiry %s is too far ahead", cmd.ExpiresAt.Format(time.RFC3339))
+	}
+
+	v.prune(now)
+	if _, ok := v.seen[cmd.CommandID]; ok {
+		return fmt.Errorf("command %s was already executed", cmd.CommandID)
+	}
+	// Past this point the expiry check rejects the command anyway
+	v.seen[cmd.CommandID] = cmd.ExpiresAt.Add(maxClockSkew)
+	// A command that can't be recorded could be replayed after a restart
+	if err := v.save(); err != nil {
+		delete(v.seen, cmd.CommandID)
+		return fmt.Errorf("recording command ID: %w", err)
+	}
+	return nil
+}
+
+// prune forgets the commands whose expiry has passed
+func (v *commandVerifier) prune(now time.Time) {
+	for id, forget := range v.seen {
+		if now.After(forget) {
+			delete(v.seen, id)
+		}
+	}
+}
+
+// save writes the seen command IDs to path
+func (v *commandVerifier) save() error {
+	if v.path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(v.seen, "", "  ")
+	tmp := v.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// testNow is the current time, since seen commands are pruned against the
+// clock when loaded
+var testNow = time.Now().UTC()
+
+func newTestKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+// signedCommand returns a command for agent "a1" expiring in two minutes,
+// changed by edit before it is signed
+func signedCommand(t *testing.T, key ed25519.PrivateKey, edit func(*protocol.AgentCommand)) protocol.AgentCommand {
+	t.Helper()
+	cmd := protocol.AgentCommand{
+		CommandID: "c1",
+		Action:    protocol.ActionServicePut,
+		Target:    "web",
+		Args:      []string{"-port", "80"},
+		Service:   &protocol.ServiceSpec{Name: "web", Command: "/usr/bin/web", Env: []string{"TOKEN=x"}},
+		AgentID:   "a1",
+		ExpiresAt: testNow.Add(2 * time.Minute),
+	}
+	if edit != nil {
+		edit(&cmd)
+	}
+	if err := protocol.SignCommand(key, &cmd); err != nil {
+		t.Fatalf("SignCommand: %v", err)
+	}
+	return cmd
+}
+
+func TestVerifyCommand(t *testing.T) {
+	pub, priv := newTestKey(t)
+	_, otherKey := newTestKey(t)
+
+	tests := []struct {
+		name    string
+		cmd     func(t *testing.T) protocol.AgentCommand
+		now     time.Time
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			cmd:  func(t *testing.T) protocol.AgentCommand { return signedCommand(t, priv, nil) },
+		},
+		{
+			name: "valid after a JSON round trip",
+			cmd: func(t *testing.T) protocol.AgentCommand {
+				data, _ := json.Marshal(signedCommand(t, priv, nil))
+				var cmd protocol.AgentCommand
+				if err := json.Unmarshal(data, &cmd); err != nil {
+					t.Fatal(err)
+				}
+				return cmd
+			},
+		},
+		{
+			name: "expired within the clock skew",
+			cmd:  func(t *testing.T) protocol.AgentCommand { return signedCommand(t, priv, nil) },
+			now:  testNow.Add(2*time.Minute + maxClockSkew),
+		},
+		{
+			name: "unsigned",
+			cmd: func(t *testing.T) protocol.AgentCommand {
+				cmd := signedCommand(t, priv, nil)
+				cmd.Signature = nil
+				return cmd
+			},
+			wantErr: true,
+		},
+		{
+			name:    "signed with another key",
+			cmd:     func(t *testing.T) protocol.AgentCommand { return signedCommand(t, otherKey, nil) },
+			wantErr: true,
+		},
+		{
+			name: "truncated signature",
+			cmd: func(t *testing.T) protocol.AgentCommand {
+				cmd := signedCommand(t, priv, nil)
+				cmd.Signature = cmd.Signature[:len(cmd.Signature)-1]
+				return cmd
+			},
+			wantErr: true,
+		},
+		{
+			name: "addressed to another agent",
+			cmd: func(t *testing.T) protocol.AgentCommand {
+				return signedCommand(t, priv, func(c *protocol.AgentCommand) { c.AgentID = "a2" })
+			},
+			wantErr: true,
+		},
+		{
+			name: "re-addressed to this agent",
+			cmd: func(t *testing.T) protocol.AgentCommand {
+				cmd := signedCommand(t, priv, func(c *protocol.AgentCommand) { c.AgentID = "a2" })
+				cmd.AgentID = "a1"
+				return cmd
+			},
+			wantErr: true,
+		},
+		{
+			name: "without ID",
+			cmd: func(t *testing.T) protocol.AgentCommand {
+				return signedCommand(t, priv, func(c *protocol.AgentCommand) { c.CommandID = "" })
+			},
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			cmd:     func(t *testing.T) protocol.AgentCommand { return signedCommand(t, priv, nil) },
+			now:     testNow.Add(2*time.Minute + maxClockSkew + time.Second),
+			wantErr: true,
+		},
+		{
+			name: "expiring too far ahead",
+			cmd: func(t *testing.T) protocol.AgentCommand {
+				return signedCommand(t, priv, func(c *protocol.AgentCommand) {
+					c.ExpiresAt = testNow.Add(maxCommandTTL + maxClockSkew + time.Second)
+				})
+			},
+			wantErr: true,
+		},
+	}
+
+	// Every signed field is covered by the signature
+	tampers := map[string]func(*protocol.AgentCommand){
+		"action":          func(c *protocol.AgentCommand) { c.Action = protocol.ActionStop },
+		"target":          func(c *protocol.AgentCommand) { c.Target = "db" },
+		"signal":          func(c *protocol.AgentCommand) { c.Signal = "KILL" },
+		"args":            func(c *protocol.AgentCommand) { c.Args = append(c.Args, "-debug") },
+		"args split":      func(c *protocol.AgentCommand) { c.Args = []string{"-port 80"} },
+		"target and args": func(c *protocol.AgentCommand) { c.Target, c.Args = "web-port", []string{"80"} },
+		"service":         func(c *protocol.AgentCommand) { c.Service.Env = []string{"TOKEN=y"} },
+		"no service":      func(c *protocol.AgentCommand) { c.Service = nil },
+		"command ID":      func(c *protocol.AgentCommand) { c.CommandID = "c2" },
+		"expiry":          func(c *protocol.AgentCommand) { c.ExpiresAt = c.ExpiresAt.Add(time.Nanosecond) },
+	}
+	for field, tamper := range tampers {
+		tests = append(tests, struct {
+			name    string
+			cmd     func(t *testing.T) protocol.AgentCommand
+			now     time.Time
+			wantErr bool
+		}{
+			name: "tampered " + field,
+			cmd: func(t *testing.T) protocol.AgentCommand {
+				cmd := signedCommand(t, priv, nil)
+				tamper(&cmd)
+				return cmd
+			},
+			wantErr: true,
+		})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newCommandVerifier(pub, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := tt.now
+			if now.IsZero() {
+				now = testNow
+			}
+			err = v.verify(tt.cmd(t), "a1", now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutKeyAcceptsAnything(t *testing.T) {
+	v, err := newCommandVerifier(nil, filepath.Join(t.TempDir(), "seen.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := protocol.AgentCommand{Action: protocol.ActionStop, Target: "1234"}
+	for range 2 {
+		if err := v.verify(cmd, "a1", testNow); err != nil {
+			t.Errorf("unsigned command rejected without a key: %v", err)
+		}
+	}
+}
+
+func TestVerifyRejectsReplays(t *testing.T) {
+	pub, priv := newTestKey(t)
+	path := filepath.Join(t.TempDir(), "seen.json")
+	cmd := signedCommand(t, priv, nil)
+
+	v, err := newCommandVerifier(pub, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(cmd, "a1", testNow); err != nil {
+		t.Fatalf("first delivery rejected: %v", err)
+	}
+	if err := v.verify(cmd, "a1", testNow.Add(time.Second)); err == nil {
+		t.Error("replay accepted")
+	}
+	other := signedCommand(t, priv, func(c *protocol.AgentCommand) { c.CommandID = "c2" })
+	if err := v.verify(other, "a1", testNow); err != nil {
+		t.Errorf("another command rejected: %v", err)
+	}
+
+	// Seen IDs survive a restart
+	restarted, err := newCommandVerifier(pub, path)
+	if err != nil {
+		t.Fatalf("loading seen commands: %v", err)
+	}
+	if err := restarted.verify(cmd, "a1", testNow.Add(time.Second)); err == nil {
+		t.Error("replay accepted after a restart")
+	}
+}
+
+func TestVerifyForgetsExpiredCommands(t *testing.T) {
+	pub, priv := newTestKey(t)
+	path := filepath.Join(t.TempDir(), "seen.json")
+	v, err := newCommandVerifier(pub, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := signedCommand(t, priv, func(c *protocol.AgentCommand) {
+		c.ExpiresAt = time.Now().Add(-maxClockSkew - time.Second)
+	})
+	if err := v.verify(old, "a1", old.ExpiresAt); err != nil {
+		t.Fatal(err)
+	}
+	current := signedCommand(t, priv, func(c *protocol.AgentCommand) {
+		c.CommandID = "c2"
+		c.ExpiresAt = time.Now().Add(time.Minute)
+	})
+	if err := v.verify(current, "a1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.seen[old.CommandID]; ok {
+		t.Error("expired command still remembered")
+	}
+
+	restarted, err := newCommandVerifier(pub, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.seen[current.CommandID]; !ok || len(restarted.seen) != 1 {
+		t.Errorf("got seen commands %v after a restart, want only %s", restarted.seen, current.CommandID)
+	}
+}
+
+func TestVerifyRejectsUnrecordedCommands(t *testing.T) {
+	pub, priv := newTestKey(t)
+	v, err := newCommandVerifier(pub, filepath.Join(t.TempDir(), "missing", "seen.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := signedCommand(t, priv, nil)
+	if err := v.verify(cmd, "a1", testNow); err == nil {
+		t.Fatal("command accepted although its ID couldn't be saved")
+	}
+	if _, ok := v.seen[cmd.CommandID]; ok {
+		t.Error("rejected command was remembered")
+	}
+}
+
+func TestVerifyCorruptSeenFile(t *testing.T) {
+	pub, _ := newTestKey(t)
+	path := filepath.Join(t.TempDir(), "seen.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newCommandVerifier(pub, path); err == nil {
+		t.Error("corrupt seen commands file loaded without error")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/pki"
+)
+
+const caUsage = `Usage: middleware ca <command> [flags]
+
+Commands:
+  init     Create a new certificate authority
+  server   Issue the middleware's TLS certificate
+  agent    Issue a client certificate for an agent
+
+Run "middleware ca <command> -h" for the flags of each command.
+`
+
+// runCA implements the "ca" subcommand, a minimal certificate authority for
+// mutual TLS with agents
+func runCA(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, caUsage)
+		return fmt.Errorf("missing ca command")
+	}
+
+	fs := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", "pki", "Directory holding the CA and issued certificates")
+
+	switch args[0] {
+	case "init":
+		name := fs.String("name", "remote-monitor CA", "Common name of the CA")
+		validity := fs.Duration("validity", 10*365*24*time.Hour, "CA certificate lifetime")
+		_ = fs.Parse(args[1:])
+
+		if err := pki.Init(*dir, *name, *validity); err != nil {
+			return err
+		}
+		fmt.Printf("CA created in %s\n", *dir)
+
+	case "server":
+		hosts := fs.String("hosts", "localhost,127.0.0.1", "Comma-separated host names and IPs the certificate is valid for")
+		validity := fs.Duration("validity", 825*24*time.Hour, "Certificate lifetime")
+		_ = fs.Parse(args[1:])
+
+		ca, err := pki.Load(*dir)
+		if err != nil {
+			return fmt.Errorf("loading CA: %w", err)
+		}
+		if err := ca.IssueServer(*dir, "server", strings.Split(*hosts, ","), *validity); err != nil {
+			return err
+		}
+		fmt.Printf("Server certificate written to %s\n", filepath.Join(*dir, "server.crt"))
+
+	case "agent":
+		id := fs.String("id", "", "Agent ID, used as the certificate's common name")
+		validity := fs.Duration("validity", 365*24*time.Hour, "Certificate lifetime")
+		replace := fs.Bool("replace", false, "Replace the agent's existing certificate")
+		_ = fs.Parse(args[1:])
+
+		if *id == "" || filepath.Base(*id) != *id || strings.HasPrefix(*id, ".") {
+			return fmt.Errorf("invalid agent ID %q", *id)
+		}
+		ca, err := pki.Load(*dir)
+		if err != nil {
+			return fmt.Errorf("loading CA: %w", err)
+		}
+		if err := ca.IssueAgent(*dir, *id, *validity, *replace); err != nil {
+			return err
+		}
+		fmt.Printf("Agent certificate written to %s\n", pki.AgentCertPath(*dir, *id))
+
+	default:
+		fmt.Fprint(os.Stderr, caUsage)
+		return fmt.Errorf("unknown ca command %q", args[0])
+	}
+	return nil
+}
@@ -1,26 +1,194 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	mw "github.com/Patopm/remote-monitor/internal/middleware"
+	"github.com/Patopm/remote-monitor/internal/pki"
+	"github.com/Patopm/remote-monitor/internal/protocol"
 )
 
 func main() {
-	hub := mw.NewHub()
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "ca":
+			run = runCA
+		case "user":
+			run = runUser
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatalf("[Middleware] %v", err)
+			}
+			return
+		}
+	}
+
+	addr := flag.String("addr", ":8080", "Address to listen on")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate; serves HTTPS and wss:// when set with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key")
+	clientCA := flag.String("client-ca", "", "CA bundle used to verify agent client certificates")
+	requireAgentCert := flag.Bool("require-agent-cert", false, "Reject agents that don't present a valid client certificate")
+	dataDir := flag.String("data", "data", "Directory for persistent state (empty keeps it in memory and requires ADMIN_PASSWORD)")
+	adminUser := flag.String("admin-user", "admin", "Admin created with the password in ADMIN_PASSWORD when there are no users yet")
+	heartbeat := flag.Duration("heartbeat", 10*time.Second, "Interval between pings to agents")
+	staleAfter := flag.Duration("stale-after", 30*time.Second, "Silence after which an agent is marked stale")
+	disconnectAfter := flag.Duration("disconnect-after", 60*time.Second, "Silence after which an agent is disconnected")
+	jwtKeysFile := flag.String("jwt-keys-file", "", "File of kid=secret JWT keys, one per line, the first one signing (overrides JWT_KEYS)")
+	accessTTL := flag.Duration("access-ttl", 15*time.Minute, "Lifetime of access tokens")
+	refreshTTL := flag.Duration("refresh-ttl", 7*24*time.Hour, "Lifetime of login sessions, extended on each refresh")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL; enables SSO login at /api/oidc/login")
+	oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID (the secret is read from OIDC_CLIENT_SECRET)")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "", "OIDC callback URL registered with the provider, ending in /api/oidc/callback")
+	oidcScopes := flag.String("oidc-scopes", "profile,email,groups", "Comma-separated OIDC scopes requested besides openid")
+	oidcUsernameClaim := flag.String("oidc-username-claim", "preferred_username", "ID token claim used as the username")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", "groups", "ID token claim listing the user's groups")
+	oidcRoles := flag.String("oidc-roles", "", "Comma-separated group=role mappings, e.g. sre=operator,platform=admin")
+	oidcDefaultRole := flag.String("oidc-default-role", "", "Role for OIDC users matching no mapping; empty refuses them")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated proxy IPs or CIDRs whose X-Forwarded-For is trusted for client addresses, e.g. 127.0.0.1,::1 behind Caddy")
+	loginUserFailures := flag.Int("login-user-failures", 5, "Failed logins allowed per username before lockouts start")
+	loginIPFailures := flag.Int("login-ip-failures", 20, "Failed logins allowed per client address before lockouts start")
+	loginMaxDelay := flag.Duration("login-max-lockout", 15*time.Minute, "Longest lockout; lockouts double from 1s with each further failure")
+	apiRate := flag.Float64("api-rate", 20, "Requests per second allowed per user or API key (negative disables)")
+	apiBurst := flag.Int("api-burst", 60, "Burst of requests allowed per user or API key")
+	ipRate := flag.Float64("ip-rate", 50, "Requests per second allowed per client address on API routes, before authentication (negative disables)")
+	ipBurst := flag.Int("ip-burst", 150, "Burst of requests allowed per client address")
+	agentRate := flag.Float64("agent-rate", 50, "Messages per second read from each agent before it is slowed down (negative disables)")
+	agentBurst := flag.Int("agent-burst", 500, "Burst of messages allowed per agent")
+	flag.Parse()
+
+	// The shared agent secret is only accepted when explicitly configured;
+	// otherwise agents enroll with tokens minted via the API
+	agentSecret := os.Getenv("AGENT_SECRET_KEY")
+	if agentSecret != "" {
+		log.Printf("[Middleware] Shared agent secret enabled, prefer enrollment tokens")
+	}
+
+	// JWT keys are "kid=secret" pairs; list a new key first and keep the old
+	// one after it until its tokens have expired to rotate keys
+	jwtKeySpec := os.Getenv("JWT_KEYS")
+	if *jwtKeysFile != "" {
+		data, err := os.ReadFile(*jwtKeysFile)
+		if err != nil {
+			log.Fatalf("[Middleware] Failed to read JWT keys: %v", err)
+		}
+		jwtKeySpec = string(data)
+	}
+	jwtKeys, err := mw.ParseJWTKeys(jwtKeySpec)
+	if err != nil {
+		log.Fatalf("[Middleware] Invalid JWT keys: %v", err)
+	}
+
+	// The user command can't reach an in-memory store, so its first admin
+	// has to come from the environment
+	var bootstrapAdmin *protocol.UserRequest
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		bootstrapAdmin = &protocol.UserRequest{Username: *adminUser, Password: password}
+	} else if *dataDir == "" {
+		log.Fatalf("[Middleware] -data \"\" keeps users in memory, set ADMIN_PASSWORD to create an admin")
+	}
+
+	proxies, err := mw.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatalf("[Middleware] Invalid -trusted-proxies: %v", err)
+	}
+
+	var oidc *mw.OIDCConfig
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" || *oidcRedirectURL == "" {
+			log.Fatalf("[Middleware] -oidc-issuer requires -oidc-client-id and -oidc-redirect-url")
+		}
+		mappings, err := mw.ParseRoleMappings(*oidcRoles)
+		if err != nil {
+			log.Fatalf("[Middleware] Invalid -oidc-roles: %v", err)
+		}
+		if _, ok := protocol.RolePermissions[*oidcDefaultRole]; *oidcDefaultRole != "" && !ok {
+			log.Fatalf("[Middleware] Unknown -oidc-default-role %q", *oidcDefaultRole)
+		}
+		oidc = &mw.OIDCConfig{
+			Issuer:        *oidcIssuer,
+			ClientID:      *oidcClientID,
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   *oidcRedirectURL,
+			Scopes:        strings.FieldsFunc(*oidcScopes, func(r rune) bool { return r == ',' || r == ' ' }),
+			UsernameClaim: *oidcUsernameClaim,
+			GroupsClaim:   *oidcGroupsClaim,
+			RoleMappings:  mappings,
+			DefaultRole:   *oidcDefaultRole,
+		}
+	}
+
+	hub, err := mw.NewHub(mw.HubConfig{
+		DataDir:           *dataDir,
+		HeartbeatInterval: *heartbeat,
+		StaleAfter:        *staleAfter,
+		DisconnectAfter:   *disconnectAfter,
+		AgentSecret:       agentSecret,
+		RequireAgentCert:  *requireAgentCert,
+		JWTKeys:           jwtKeys,
+		AccessTokenTTL:    *accessTTL,
+		RefreshTokenTTL:   *refreshTTL,
+		OIDC:              oidc,
+		BootstrapAdmin:    bootstrapAdmin,
+		TrustedProxies:    proxies,
+		RateLimits: mw.RateLimits{
+			LoginUserFailures: *loginUserFailures,
+			LoginIPFailures:   *loginIPFailures,
+			LoginMaxDelay:     *loginMaxDelay,
+			APIRate:           *apiRate,
+			APIBurst:          *apiBurst,
+			IPRate:            *ipRate,
+			IPBurst:           *ipBurst,
+			AgentRate:         *agentRate,
+			AgentBurst:        *agentBurst,
+		},
+	})
+	if err != nil {
+		log.Fatalf("[Middleware] Failed to initialize hub: %v", err)
+	}
 
 	mux := http.NewServeMux()
 	mw.RegisterRoutes(mux, hub)
 
 	handler := mw.CORSMiddleware(mux)
 
-	addr := ":8080"
-	log.Printf("[Middleware] Listening on %s", addr)
-	log.Printf("[Middleware] WebSocket endpoint: ws://localhost%s/ws/agent", addr)
-	log.Printf("[Middleware] REST API:           http://localhost%s/api/", addr)
+	server := &http.Server{Addr: *addr, Handler: handler}
+	scheme, wsScheme := "http", "ws"
+	if *tlsCert != "" || *tlsKey != "" {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		scheme, wsScheme = "https", "wss"
+	}
+	if *clientCA != "" {
+		if server.TLSConfig == nil {
+			log.Fatalf("[Middleware] -client-ca requires -tls-cert and -tls-key")
+		}
+		pool, err := pki.CertPool(*clientCA)
+		if err != nil {
+			log.Fatalf("[Middleware] Failed to load client CA: %v", err)
+		}
+		// Only agents authenticate with certificates; API clients don't
+		// need one
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	} else if *requireAgentCert {
+		log.Fatalf("[Middleware] -require-agent-cert requires -client-ca")
+	}
+
+	log.Printf("[Middleware] Listening on %s", *addr)
+	log.Printf("[Middleware] WebSocket endpoint: %s://localhost%s/ws/agent", wsScheme, *addr)
+	log.Printf("[Middleware] REST API:           %s://localhost%s/api/", scheme, *addr)
 
-	if err := http.ListenAndServe(addr, handler); err != nil {
-		log.Fatalf("[Middleware] Server failed: %v", err)
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = server.ListenAndServe()
 	}
+	log.Fatalf("[Middleware] Server failed: %v", err)
 }
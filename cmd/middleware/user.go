@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+
+	mw "github.com/Patopm/remote-monitor/internal/middleware"
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+const userUsage = `Usage: middleware user <command> [flags]
+
+Commands:
+  add      Create a user; use -role admin to bootstrap the first admin
+  passwd   Reset a user's password and re-enable the account
+  list     List users
+
+Passwords are prompted for, or read from the first line of stdin when it
+isn't a terminal. Stop the middleware before changing users with these
+commands, or it will overwrite the changes.
+
+Run "middleware user <command> -h" for the flags of each command.
+`
+
+// runUser implements the "user" subcommand, which manages the user store
+// directly for bootstrapping and recovery
+func runUser(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, userUsage)
+		return errors.New("missing user command")
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	dataDir := fs.String("data", "data", "Middleware data directory")
+
+	switch args[0] {
+	case "add":
+		username := fs.String("username", "", "Name of the user")
+		role := fs.String("role", protocol.RoleViewer, "Role of the user: viewer, operator or admin")
+		scope := fs.String("scope", "", "Label selector limiting the agents an operator can operate")
+		_ = fs.Parse(args[1:])
+
+		users, err := openUsers(*dataDir)
+		if err != nil {
+			return err
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if _, err := users.Create(protocol.UserRequest{
+			Username: *username,
+			Password: password,
+			Role:     *role,
+			Scope:    *scope,
+		}, ""); err != nil {
+			return err
+		}
+		fmt.Printf("User %s created\n", *username)
+
+	case "passwd":
+		username := fs.String("username", "", "Name of the user")
+		_ = fs.Parse(args[1:])
+
+		users, err := openUsers(*dataDir)
+		if err != nil {
+			return err
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		enabled := false
+		if _, err := users.Update(*username, protocol.UserUpdate{
+			Password: &password,
+			Disabled: &enabled,
+		}); err != nil {
+			return err
+		}
+		fmt.Printf("Password of %s reset\n", *username)
+
+	case "list":
+		_ = fs.Parse(args[1:])
+
+		users, err := openUsers(*dataDir)
+		if err != nil {
+			return err
+		}
+		for _, u := range users.List() {
+			status := "enabled"
+			if u.Disabled {
+				status = "disabled"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", u.Username, u.Role, status, u.Scope)
+		}
+
+	default:
+		fmt.Fprint(os.Stderr, userUsage)
+		return fmt.Errorf("unknown user command %q", args[0])
+	}
+	return nil
+}
+
+func openUsers(dataDir string) (*mw.UserStore, error) {
+	if dataDir == "" {
+		return nil, errors.New("-data is required")
+	}
+	return mw.NewUserStore(filepath.Join(dataDir, mw.UsersFile))
+}
+
+// readPassword prompts for a password twice on a terminal, or reads it from
+// the first line of stdin otherwise
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("reading password from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", errors.New("passwords don't match")
+	}
+	return string(first), nil
+}
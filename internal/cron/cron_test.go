@@ -0,0 +1,102 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestNext(t *testing.T) {
+	// 2026-03-01 is a Sunday
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", date(2026, 3, 2, 10, 7).Add(30 * time.Second), date(2026, 3, 2, 10, 8)},
+		{"strictly after", "7 10 * * *", date(2026, 3, 2, 10, 7), date(2026, 3, 3, 10, 7)},
+		{"step", "*/15 * * * *", date(2026, 3, 2, 10, 7), date(2026, 3, 2, 10, 15)},
+		{"range step", "0-30/10 * * * *", date(2026, 3, 2, 10, 31), date(2026, 3, 2, 11, 0)},
+		{"value step", "50/5 * * * *", date(2026, 3, 2, 10, 56), date(2026, 3, 2, 11, 50)},
+		{"list", "5,35 * * * *", date(2026, 3, 2, 10, 5), date(2026, 3, 2, 10, 35)},
+		{"hour range step", "0 9-17/4 * * *", date(2026, 3, 2, 17, 30), date(2026, 3, 3, 9, 0)},
+		{"weekday range", "30 2 * * mon-fri", date(2026, 3, 6, 3, 0), date(2026, 3, 9, 2, 30)},
+		{"list and range", "0 0 * * 1,3-4", date(2026, 3, 5, 0, 0), date(2026, 3, 9, 0, 0)},
+		{"day of month only", "0 0 13 * *", date(2026, 3, 1, 0, 0), date(2026, 3, 13, 0, 0)},
+		{"day of week only", "0 0 * * 0", date(2026, 3, 1, 0, 0), date(2026, 3, 8, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", date(2026, 3, 1, 0, 0), date(2026, 3, 8, 0, 0)},
+		{"range to 7", "0 0 * * 5-7", date(2026, 3, 7, 0, 0), date(2026, 3, 8, 0, 0)},
+		{"day of month or week, week first", "0 0 13 * fri", date(2026, 3, 1, 0, 0), date(2026, 3, 6, 0, 0)},
+		{"day of month or week, month first", "0 0 13 * fri", date(2026, 3, 7, 0, 0), date(2026, 3, 13, 0, 0)},
+		{"stepped day of month ands with week", "0 0 */2 * mon", date(2026, 3, 1, 0, 0), date(2026, 3, 9, 0, 0)},
+		{"month names", "0 12 1 jan-mar *", date(2026, 4, 1, 0, 0), date(2027, 1, 1, 12, 0)},
+		{"skips short months", "0 0 31 * *", date(2026, 4, 1, 0, 0), date(2026, 5, 31, 0, 0)},
+		{"feb 29", "0 0 29 2 *", date(2026, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		{"feb 29 or a monday in feb", "0 0 29 feb mon", date(2026, 3, 1, 0, 0), date(2027, 2, 1, 0, 0)},
+		{"year end", "@monthly", date(2026, 12, 15, 8, 0), date(2027, 1, 1, 0, 0)},
+		{"yearly", "@yearly", date(2026, 1, 1, 0, 0), date(2027, 1, 1, 0, 0)},
+		{"weekly", "@weekly", date(2026, 3, 2, 0, 0), date(2026, 3, 8, 0, 0)},
+		{"hourly", "@HOURLY", date(2026, 3, 2, 10, 0), date(2026, 3, 2, 11, 0)},
+		{"never on feb 30", "0 0 30 2 *", date(2026, 3, 1, 0, 0), time.Time{}},
+		{"never on apr 31", "0 0 31 apr *", date(2026, 3, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.expr, err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextKeepsLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+5:30", 5*3600+1800)
+	s, err := Parse("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.Next(time.Date(2026, 3, 2, 10, 0, 0, 0, loc))
+	if want := time.Date(2026, 3, 3, 9, 0, 0, 0, loc); !got.Equal(want) || got.Location() != loc {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@reboot",
+		"60 * * * *",
+		"-1 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-3 * * * *",
+		"1-60 * * * *",
+		"*/0 * * * *",
+		"*/-1 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"1- * * * *",
+		"foo * * * *",
+		"* * * foo *",
+		"mon * * * *",
+		"* * * * jan",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
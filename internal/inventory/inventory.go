@@ -0,0 +1,84 @@
+// Package inventory collects hardware and software facts about the host
+package inventory
+
+import (
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// Collect gathers the host facts. It is best effort: facts that can't be
+// read on this platform are left empty.
+func Collect(agentVersion string) protocol.HostFacts {
+	facts := protocol.HostFacts{
+		AgentVersion: agentVersion,
+		Arch:         runtime.GOARCH,
+		CPUCount:     runtime.NumCPU(),
+		AgentPID:     int32(os.Getpid()),
+	}
+
+	if info, err := host.Info(); err == nil {
+		facts.HostID = info.HostID
+		facts.Kernel = info.KernelVersion
+		facts.Platform = info.Platform
+		facts.PlatformFamily = info.PlatformFamily
+		facts.PlatformVersion = info.PlatformVersion
+		facts.BootTime = time.Unix(int64(info.BootTime), 0).UTC()
+		if info.KernelArch != "" {
+			facts.Arch = info.KernelArch
+		}
+		if info.VirtualizationSystem != "" {
+			facts.Virtualization = info.VirtualizationSystem + "/" + info.VirtualizationRole
+		}
+	}
+
+	if cpus, err := cpu.Info(); err == nil && len(cpus) > 0 {
+		facts.CPUModel = strings.TrimSpace(cpus[0].ModelName)
+	}
+
+	if vm, err := mem.VirtualMemory(); err == nil {
+		facts.MemoryTotal = vm.Total
+	}
+
+	if parts, err := disk.Partitions(false); err == nil {
+		for _, p := range parts {
+			d := protocol.DiskFact{
+				Device:     p.Device,
+				Mountpoint: p.Mountpoint,
+				FSType:     p.Fstype,
+			}
+			if usage, err := disk.Usage(p.Mountpoint); err == nil {
+				d.Total = usage.Total
+			}
+			facts.Disks = append(facts.Disks, d)
+		}
+		slices.SortFunc(facts.Disks, func(a, b protocol.DiskFact) int {
+			return strings.Compare(a.Mountpoint, b.Mountpoint)
+		})
+	}
+
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			f := protocol.InterfaceFact{Name: iface.Name, MAC: iface.HardwareAddr}
+			for _, addr := range iface.Addrs {
+				f.Addrs = append(f.Addrs, addr.Addr)
+			}
+			facts.Interfaces = append(facts.Interfaces, f)
+		}
+		slices.SortFunc(facts.Interfaces, func(a, b protocol.InterfaceFact) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+	}
+
+	return facts
+}
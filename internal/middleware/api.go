@@ -1,16 +1,26 @@
 package middleware
 
 import (
+	"crypto/ed25519"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/Patopm/remote-monitor/internal/pki"
 	"github.com/Patopm/remote-monitor/internal/protocol"
 )
 
 var upgrader = websocket.Upgrader{
+	// Negotiate permessage-deflate with agents that offer it
+	EnableCompression: true,
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins (fine for development)
 	},
@@ -18,8 +28,13 @@ var upgrader = websocket.Upgrader{
 
 // RegisterRoutes sets up all HTTP and WebSocket routes
 func RegisterRoutes(mux *http.ServeMux, hub *Hub) {
-	// Public routes
-	mux.HandleFunc("POST /api/login", loginHandler())
+	// Public routes, rate limited per client address
+	mux.HandleFunc("POST /api/login", RateLimitMiddleware(hub, loginHandler(hub)))
+	mux.HandleFunc("POST /api/refresh", RateLimitMiddleware(hub, refreshHandler(hub)))
+	if hub.oidc != nil {
+		mux.HandleFunc("GET /api/oidc/login", RateLimitMiddleware(hub, oidcLoginHandler(hub)))
+		mux.HandleFunc("GET /api/oidc/callback", RateLimitMiddleware(hub, oidcCallbackHandler(hub)))
+	}
 	mux.HandleFunc("GET /api/health", func(w http.ResponseWriter, _ *http.Request) {
 		writeJSON(w, http.StatusOK, protocol.APIResponse{Success: true, Message: "ok"})
 	})
@@ -27,13 +42,54 @@ func RegisterRoutes(mux *http.ServeMux, hub *Hub) {
 	// WebSocket for agents
 	mux.HandleFunc("/ws/agent", wsAgentHandler(hub))
 
-	// Protected REST API routes (Wrapped with AuthMiddleware)
-	mux.HandleFunc("GET /api/agents", AuthMiddleware(listAgentsHandler(hub)))
-	mux.HandleFunc("GET /api/agents/{id}/processes", AuthMiddleware(getProcessesHandler(hub)))
-	mux.HandleFunc("POST /api/agents/{id}/kill", AuthMiddleware(killProcessHandler(hub)))
+	// Protected REST API routes (Wrapped with AuthMiddleware), each requiring
+	// a permission granted by the user's role
+	mux.HandleFunc("GET /api/agents", AuthMiddleware(hub, protocol.PermRead, listAgentsHandler(hub)))
+	mux.HandleFunc("PUT /api/agents/{id}/labels", AuthMiddleware(hub, protocol.PermManageAgents, setLabelsHandler(hub)))
+	mux.HandleFunc("GET /api/agents/{id}/facts", AuthMiddleware(hub, protocol.PermRead, getFactsHandler(hub)))
+	mux.HandleFunc("GET /api/agents/{id}/processes", AuthMiddleware(hub, protocol.PermRead, getProcessesHandler(hub)))
+	mux.HandleFunc("GET /api/agents/{id}/telemetry", AuthMiddleware(hub, protocol.PermRead, telemetryHistoryHandler(hub)))
+	mux.HandleFunc("POST /api/agents/{id}/kill", AuthMiddleware(hub, protocol.PermOperate, killProcessHandler(hub)))
+	mux.HandleFunc("GET /api/agents/{id}/services", AuthMiddleware(hub, protocol.PermRead, listServicesHandler(hub)))
+	mux.HandleFunc("POST /api/agents/{id}/services", AuthMiddleware(hub, protocol.PermOperate, putServiceHandler(hub)))
+	mux.HandleFunc("DELETE /api/agents/{id}/services/{name}", AuthMiddleware(hub, protocol.PermOperate, deleteServiceHandler(hub)))
+	mux.HandleFunc("POST /api/commands", AuthMiddleware(hub, protocol.PermOperate, bulkCommandHandler(hub)))
+	mux.HandleFunc("GET /api/commands", AuthMiddleware(hub, protocol.PermRead, listJobsHandler(hub)))
+	mux.HandleFunc("GET /api/commands/{id}", AuthMiddleware(hub, protocol.PermRead, getJobHandler(hub)))
+	mux.HandleFunc("GET /api/schedules", AuthMiddleware(hub, protocol.PermRead, listSchedulesHandler(hub)))
+	mux.HandleFunc("POST /api/schedules", AuthMiddleware(hub, protocol.PermOperate, createScheduleHandler(hub)))
+	mux.HandleFunc("GET /api/schedules/{id}", AuthMiddleware(hub, protocol.PermRead, getScheduleHandler(hub)))
+	mux.HandleFunc("PUT /api/schedules/{id}", AuthMiddleware(hub, protocol.PermOperate, updateScheduleHandler(hub)))
+	mux.HandleFunc("DELETE /api/schedules/{id}", AuthMiddleware(hub, protocol.PermOperate, deleteScheduleHandler(hub)))
+	mux.HandleFunc("GET /api/schedules/{id}/runs", AuthMiddleware(hub, protocol.PermRead, scheduleRunsHandler(hub)))
+	mux.HandleFunc("GET /api/desired-states", AuthMiddleware(hub, protocol.PermRead, listDesiredStatesHandler(hub)))
+	mux.HandleFunc("POST /api/desired-states", AuthMiddleware(hub, protocol.PermOperate, createDesiredStateHandler(hub)))
+	mux.HandleFunc("GET /api/desired-states/{id}", AuthMiddleware(hub, protocol.PermRead, getDesiredStateHandler(hub)))
+	mux.HandleFunc("PUT /api/desired-states/{id}", AuthMiddleware(hub, protocol.PermOperate, updateDesiredStateHandler(hub)))
+	mux.HandleFunc("DELETE /api/desired-states/{id}", AuthMiddleware(hub, protocol.PermOperate, deleteDesiredStateHandler(hub)))
+	mux.HandleFunc("GET /api/drift", AuthMiddleware(hub, protocol.PermRead, driftHandler(hub)))
+	mux.HandleFunc("GET /api/enrollment-tokens", AuthMiddleware(hub, protocol.PermManageAgents, listEnrollmentTokensHandler(hub)))
+	mux.HandleFunc("POST /api/enrollment-tokens", AuthMiddleware(hub, protocol.PermManageAgents, createEnrollmentTokenHandler(hub)))
+	mux.HandleFunc("DELETE /api/enrollment-tokens/{id}", AuthMiddleware(hub, protocol.PermManageAgents, deleteEnrollmentTokenHandler(hub)))
+	mux.HandleFunc("GET /api/credentials", AuthMiddleware(hub, protocol.PermManageAgents, listCredentialsHandler(hub)))
+	mux.HandleFunc("DELETE /api/credentials/{id}", AuthMiddleware(hub, protocol.PermManageAgents, revokeCredentialHandler(hub)))
+	mux.HandleFunc("GET /api/command-key", AuthMiddleware(hub, protocol.PermRead, commandKeyHandler(hub)))
+	mux.HandleFunc("POST /api/logout", AuthMiddleware(hub, "", logoutHandler(hub)))
+	mux.HandleFunc("GET /api/account", AuthMiddleware(hub, "", accountHandler(hub)))
+	mux.HandleFunc("PUT /api/account/password", AuthMiddleware(hub, "", changePasswordHandler(hub)))
+	mux.HandleFunc("GET /api/users", AuthMiddleware(hub, protocol.PermManageUsers, listUsersHandler(hub)))
+	mux.HandleFunc("POST /api/users", AuthMiddleware(hub, protocol.PermManageUsers, createUserHandler(hub)))
+	mux.HandleFunc("GET /api/users/{username}", AuthMiddleware(hub, protocol.PermManageUsers, getUserHandler(hub)))
+	mux.HandleFunc("PUT /api/users/{username}", AuthMiddleware(hub, protocol.PermManageUsers, updateUserHandler(hub)))
+	mux.HandleFunc("DELETE /api/users/{username}", AuthMiddleware(hub, protocol.PermManageUsers, deleteUserHandler(hub)))
+	mux.HandleFunc("GET /api/keys", AuthMiddleware(hub, protocol.PermManageUsers, listAPIKeysHandler(hub)))
+	mux.HandleFunc("POST /api/keys", AuthMiddleware(hub, protocol.PermManageUsers, createAPIKeyHandler(hub)))
+	mux.HandleFunc("DELETE /api/keys/{id}", AuthMiddleware(hub, protocol.PermManageUsers, deleteAPIKeyHandler(hub)))
+	mux.HandleFunc("GET /api/audit", AuthMiddleware(hub, protocol.PermReadAudit, auditHandler(hub)))
+	mux.HandleFunc("GET /api/audit/verify", AuthMiddleware(hub, protocol.PermReadAudit, verifyAuditHandler(hub)))
 }
 
-func loginHandler() http.HandlerFunc {
+func loginHandler(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req protocol.LoginRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -41,38 +97,236 @@ func loginHandler() http.HandlerFunc {
 			return
 		}
 
-		if req.Username == "admin" && req.Password == "redhat2026" {
-			token, err := GenerateJWT(req.Username)
-			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, protocol.APIResponse{Success: false, Message: "Token error"})
-				return
-			}
-			writeJSON(w, http.StatusOK, protocol.APIResponse{
-				Success: true,
-				Data:    protocol.LoginResponse{Token: token},
+		ip := hub.clientIP(r)
+		if wait := hub.logins.Locked(ip, req.Username); wait > 0 {
+			hub.auditAuth(r, protocol.AuditLogin, req.Username, errLoginLocked)
+			writeTooManyRequests(w, wait, "Too many failed logins, try again later")
+			return
+		}
+
+		user, err := hub.users.Authenticate(req.Username, req.Password)
+		hub.auditAuth(r, protocol.AuditLogin, req.Username, err)
+		if err != nil {
+			hub.logins.Fail(ip, req.Username)
+			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{Success: false, Message: "Invalid credentials"})
+			return
+		}
+		hub.logins.Succeed(req.Username)
+		sess, refresh := hub.sessions.Create(user.Username, hub.cfg.RefreshTokenTTL)
+		tokens, err := hub.issueTokens(user, sess, refresh)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, protocol.APIResponse{Success: false, Message: "Token error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    tokens,
+		})
+	}
+}
+
+// refreshHandler exchanges a refresh token for a new access token and a new
+// refresh token. The user's current role is used, so role changes apply.
+func refreshHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{Success: false, Message: "Bad request"})
+			return
+		}
+
+		sess, refresh, err := hub.sessions.Refresh(req.RefreshToken, hub.cfg.RefreshTokenTTL)
+		if err != nil {
+			hub.auditAuth(r, protocol.AuditRefresh, sess.Username, err)
+			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		user, ok := hub.users.Get(sess.Username)
+		if !ok || user.Disabled || sess.CreatedAt.Before(user.PasswordChangedAt) {
+			hub.sessions.Revoke(sess.ID)
+			hub.auditAuth(r, protocol.AuditRefresh, sess.Username, errors.New("user disabled, deleted or password changed"))
+			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{Success: false, Message: errInvalidRefresh.Error()})
+			return
+		}
+
+		tokens, err := hub.issueTokens(user, sess, refresh)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, protocol.APIResponse{Success: false, Message: "Token error"})
+			return
+		}
+		hub.auditAuth(r, protocol.AuditRefresh, user.Username, nil)
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    tokens,
+		})
+	}
+}
+
+// oidcLoginHandler sends the user to the OIDC provider to log in. Once
+// logged in, the user is sent back to ?redirect, a path on this site, with
+// the tokens in the URL fragment; without it the callback responds with the
+// tokens as JSON.
+func oidcLoginHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		redirect := r.URL.Query().Get("redirect")
+		if redirect != "" && !safeRedirect(redirect) {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{Success: false, Message: "redirect must be a path on this site"})
+			return
+		}
+		authURL, state, err := hub.oidc.authCodeURL(r.Context(), redirect)
+		if err != nil {
+			log.Printf("[Auth] OIDC login failed: %v", err)
+			writeJSON(w, http.StatusServiceUnavailable, protocol.APIResponse{Success: false, Message: "Identity provider unavailable"})
+			return
+		}
+		// Only the browser that started the login can complete it, so a
+		// login can't be forced onto another user's browser
+		http.SetCookie(w, hub.oidc.stateCookie(state, int(oidcLoginTTL.Seconds())))
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// oidcCallbackHandler completes an OIDC login: it checks the state against
+// the cookie set when the login started, verifies the ID token, maps the
+// user's groups to a role and starts a session
+func oidcCallbackHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			hub.auditAuth(r, protocol.AuditOIDCLogin, "", errors.New("provider returned "+e))
+			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{
+				Success: false,
+				Message: strings.TrimSpace("Login failed: " + e + " " + q.Get("error_description")),
 			})
 			return
 		}
 
-		writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{Success: false, Message: "Invalid credentials"})
+		state := q.Get("state")
+		http.SetCookie(w, hub.oidc.stateCookie("", -1))
+		if c, err := r.Cookie(oidcStateCookie); err != nil || state == "" ||
+			subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+			err := errors.New("state doesn't match the login started by this browser")
+			log.Printf("[Auth] OIDC login failed: %v", err)
+			hub.auditAuth(r, protocol.AuditOIDCLogin, "", err)
+			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{Success: false, Message: "Login failed, start again"})
+			return
+		}
+
+		identity, err := hub.oidc.exchange(r.Context(), state, q.Get("code"))
+		if err != nil {
+			log.Printf("[Auth] OIDC login failed: %v", err)
+			hub.auditAuth(r, protocol.AuditOIDCLogin, "", err)
+			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{Success: false, Message: "Login failed"})
+			return
+		}
+		role, err := hub.oidc.mapRole(identity.Groups)
+		if err != nil {
+			log.Printf("[Auth] OIDC login of %s refused, groups %v: %v", identity.Username, identity.Groups, err)
+			hub.auditAuth(r, protocol.AuditOIDCLogin, identity.Username, err)
+			writeJSON(w, http.StatusForbidden, protocol.APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		user, err := hub.users.LoginExternal(OIDCProvider, identity.Issuer, identity.Subject, identity.Username, role)
+		if err != nil {
+			log.Printf("[Auth] OIDC login of %s refused: %v", identity.Username, err)
+			hub.auditAuth(r, protocol.AuditOIDCLogin, identity.Username, err)
+			writeJSON(w, http.StatusForbidden, protocol.APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+
+		sess, refresh := hub.sessions.Create(user.Username, hub.cfg.RefreshTokenTTL)
+		tokens, err := hub.issueTokens(user, sess, refresh)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, protocol.APIResponse{Success: false, Message: "Token error"})
+			return
+		}
+		log.Printf("[Auth] %s logged in through OIDC as %s", user.Username, user.Role)
+		hub.auditAuth(r, protocol.AuditOIDCLogin, user.Username, nil)
+
+		if identity.Redirect == "" {
+			writeJSON(w, http.StatusOK, protocol.APIResponse{Success: true, Data: tokens})
+			return
+		}
+		// The fragment isn't sent to servers or in Referer headers
+		fragment := url.Values{
+			"token":              {tokens.Token},
+			"expires_at":         {tokens.ExpiresAt.Format(time.RFC3339)},
+			"refresh_token":      {tokens.RefreshToken},
+			"refresh_expires_at": {tokens.RefreshExpiresAt.Format(time.RFC3339)},
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, identity.Redirect+"#"+fragment.Encode(), http.StatusFound)
+	}
+}
+
+// logoutHandler revokes the session of the request's token, or every
+// session of the user with ?all=true
+func logoutHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := PrincipalFromContext(r.Context())
+		if principal.APIKeyID != "" {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "API keys have no session, delete the key instead",
+			})
+			return
+		}
+		target := "session " + principal.SessionID
+		if all, _ := strconv.ParseBool(r.URL.Query().Get("all")); all {
+			hub.sessions.RevokeUser(principal.Username)
+			target = "all sessions"
+		} else {
+			hub.sessions.Revoke(principal.SessionID)
+		}
+		hub.auditRequest(r, protocol.AuditLogout, target, nil)
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Message: "Logged out",
+		})
 	}
 }
 
 func wsAgentHandler(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+		transport := AgentTransport{SourceIP: hub.clientIP(r)}
+		// The TLS layer has already verified the certificate against the
+		// client CA; its common name is the agent ID
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			transport.CertIdentity = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+		if hub.cfg.RequireAgentCert && transport.CertIdentity == "" {
+			hub.auditAuth(r, protocol.AuditAgentAuth, "", errors.New("client certificate required"))
+			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{
+				Success: false,
+				Message: "Client certificate required",
+			})
+			return
+		}
+
+		recorder := &upgradeRecorder{ResponseWriter: w}
+		conn, err := upgrader.Upgrade(recorder, r, nil)
 		if err != nil {
 			log.Printf("[API] WebSocket upgrade failed: %v", err)
 			return
 		}
+		transport.Compressed = recorder.deflateNegotiated()
 		// This blocks until the agent disconnects
-		hub.HandleAgentConnection(conn)
+		hub.HandleAgentConnection(conn, transport)
 	}
 }
 
 func listAgentsHandler(hub *Hub) http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
-		agents := hub.ListAgents()
+	return func(w http.ResponseWriter, r *http.Request) {
+		sel, err := ParseSelector(r.URL.Query().Get("selector"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		agents := hub.ListAgents(sel)
 		writeJSON(w, http.StatusOK, protocol.APIResponse{
 			Success: true,
 			Data:    agents,
@@ -80,6 +334,66 @@ func listAgentsHandler(hub *Hub) http.HandlerFunc {
 	}
 }
 
+func setLabelsHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agentID := r.PathValue("id")
+
+		var req protocol.LabelsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		info, err := hub.SetLabels(agentID, req.Labels)
+		if err != nil {
+			status := http.StatusBadRequest
+			if _, known := hub.registry.Get(agentID); !known {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    info,
+		})
+	}
+}
+
+func getFactsHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agentID := r.PathValue("id")
+
+		facts, ok := hub.GetFacts(agentID)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Agent not found: " + agentID,
+			})
+			return
+		}
+		if facts == nil {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "No facts reported by agent " + agentID,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    facts,
+		})
+	}
+}
+
 func getProcessesHandler(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		agentID := r.PathValue("id")
@@ -100,9 +414,45 @@ func getProcessesHandler(hub *Hub) http.HandlerFunc {
 	}
 }
 
+func telemetryHistoryHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agentID := r.PathValue("id")
+
+		var since time.Time
+		if s := r.URL.Query().Get("since"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+					Success: false,
+					Message: "Invalid since, expected RFC 3339: " + s,
+				})
+				return
+			}
+			since = t
+		}
+
+		samples, ok := hub.GetTelemetryHistory(agentID, since)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Agent not found: " + agentID,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    samples,
+		})
+	}
+}
+
 func killProcessHandler(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		agentID := r.PathValue("id")
+		if !requireAgentScope(w, r, hub, agentID) {
+			return
+		}
 
 		var req protocol.KillRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -113,52 +463,974 @@ func killProcessHandler(hub *Hub) http.HandlerFunc {
 			return
 		}
 
-		resp, err := hub.SendCommand(agentID, "STOP", req.PID)
-		if err != nil {
-			writeJSON(
-				w,
-				http.StatusInternalServerError,
-				protocol.APIResponse{
-					Success: false,
-					Message: err.Error(),
-				},
-			)
+		cmd := protocol.AgentCommand{
+			Action: protocol.ActionStop,
+			Target: req.PID,
+		}
+		requester := hub.requester(r)
+
+		// A PID can't be trusted to name the same process once an offline
+		// agent is back, so kills are never queued
+		var job protocol.CommandJob
+		if isAsync(r) {
+			job = hub.SubmitCommand(agentID, cmd, requester, 0)
+		} else {
+			job = hub.RunCommand(agentID, cmd, requester, 0)
+		}
+
+		writeJobResult(w, job)
+	}
+}
+
+func listServicesHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agentID := r.PathValue("id")
+
+		services, ok := hub.GetServices(agentID)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Agent not found: " + agentID,
+			})
 			return
 		}
 
 		writeJSON(w, http.StatusOK, protocol.APIResponse{
-			Success: resp.Success,
-			Message: resp.Message,
+			Success: true,
+			Data:    services,
 		})
 	}
 }
 
-// CORSMiddleware adds CORS headers for frontend development
-func CORSMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set(
-			"Access-Control-Allow-Methods",
-			"GET, POST, PUT, DELETE, OPTIONS",
-		)
-		w.Header().Set(
-			"Access-Control-Allow-Headers",
-			"Content-Type, Authorization",
-		)
+func putServiceHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agentID := r.PathValue("id")
+		if !requireAgentScope(w, r, hub, agentID) {
+			return
+		}
 
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
+		var spec protocol.ServiceSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil || spec.Name == "" {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+		queueTTL, ok := queueTTLParam(w, r, protocol.ActionServicePut)
+		if !ok {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		job := hub.RunCommand(agentID, protocol.AgentCommand{
+			Action:  protocol.ActionServicePut,
+			Target:  spec.Name,
+			Service: &spec,
+		}, hub.requester(r), queueTTL)
+		writeJobResult(w, job)
+	}
+}
+
+func deleteServiceHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agentID := r.PathValue("id")
+		if !requireAgentScope(w, r, hub, agentID) {
+			return
+		}
+
+		queueTTL, ok := queueTTLParam(w, r, protocol.ActionServiceDelete)
+		if !ok {
+			return
+		}
+
+		job := hub.RunCommand(agentID, protocol.AgentCommand{
+			Action: protocol.ActionServiceDelete,
+			Target: r.PathValue("name"),
+		}, hub.requester(r), queueTTL)
+		writeJobResult(w, job)
+	}
+}
+
+// queueTTLParam parses the optional queue_ttl query parameter, for how long
+// the command waits for the agent if it is offline. On error it writes a 400
+// and returns false.
+func queueTTLParam(w http.ResponseWriter, r *http.Request, action string) (time.Duration, bool) {
+	ttl, err := parseQueueTTL(r.URL.Query().Get("queue_ttl"), action)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return 0, false
+	}
+	return ttl, true
+}
+
+// writeJobResult writes a command job as the response: 202 while it is still
+// pending, 500 if the agent never answered, otherwise the agent's reply
+func writeJobResult(w http.ResponseWriter, job protocol.CommandJob) {
+	if !job.Done() {
+		writeJSON(w, http.StatusAccepted, protocol.APIResponse{
+			Success: true,
+			Message: job.State,
+			Data:    job,
+		})
+		return
+	}
+
+	if job.Response == nil {
+		writeJSON(
+			w,
+			http.StatusInternalServerError,
+			protocol.APIResponse{
+				Success: false,
+				Message: job.Error,
+				Data:    job,
+			},
+		)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, protocol.APIResponse{
+		Success: job.Response.Success,
+		Message: job.Response.Message,
+		Data:    job,
 	})
 }
 
-func writeJSON(w http.ResponseWriter, status int, data any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(data); err != nil {
-		log.Printf("[API] Failed to write response: %v", err)
+func bulkCommandHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.BulkCommandRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		principal := PrincipalFromContext(r.Context())
+		req.Selector = principal.narrow(req.Selector)
+
+		result, err := hub.BulkCommand(req, hub.requester(r), isAsync(r))
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errNoAgentsMatched) {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		status := http.StatusOK
+		queued := result.Status == protocol.BulkStatusQueued
+		if queued {
+			status = http.StatusAccepted
+		}
+		writeJSON(w, status, protocol.APIResponse{
+			Success: result.Status == protocol.BulkStatusSucceeded || queued,
+			Message: result.Status,
+			Data:    result,
+		})
+	}
+}
+
+func listJobsHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter := JobFilter{
+			AgentID: q.Get("agent"),
+			State:   q.Get("state"),
+		}
+		if limit := q.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+					Success: false,
+					Message: "Invalid limit: " + limit,
+				})
+				return
+			}
+			filter.Limit = n
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    hub.ListJobs(filter),
+		})
+	}
+}
+
+func getJobHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID := r.PathValue("id")
+
+		job, ok := hub.GetJob(jobID)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Command not found: " + jobID,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    job,
+		})
+	}
+}
+
+func listSchedulesHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    hub.scheduler.List(),
+		})
+	}
+}
+
+func createScheduleHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.ScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		principal := PrincipalFromContext(r.Context())
+		req.Command.Selector = principal.narrow(req.Command.Selector)
+
+		sched, err := hub.scheduler.Create(req, principal.Username)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, protocol.APIResponse{
+			Success: true,
+			Data:    sched,
+		})
+	}
+}
+
+func getScheduleHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		sched, ok := hub.scheduler.Get(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Schedule not found: " + id,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    sched,
+		})
+	}
+}
+
+func updateScheduleHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var req protocol.ScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		principal := PrincipalFromContext(r.Context())
+		if existing, ok := hub.scheduler.Get(id); ok && !principal.selectorInScope(existing.Command.Selector) {
+			writeOutOfScope(w, r, hub, "schedule")
+			return
+		}
+		req.Command.Selector = principal.narrow(req.Command.Selector)
+
+		sched, err := hub.scheduler.Update(id, req, principal.Username)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errScheduleNotFound) {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    sched,
+		})
+	}
+}
+
+func deleteScheduleHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		existing, ok := hub.scheduler.Get(id)
+		if ok && !PrincipalFromContext(r.Context()).selectorInScope(existing.Command.Selector) {
+			writeOutOfScope(w, r, hub, "schedule")
+			return
+		}
+
+		if err := hub.scheduler.Delete(id); err != nil {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Schedule not found: " + id,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Message: "Schedule deleted",
+		})
+	}
+}
+
+func scheduleRunsHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		runs, err := hub.scheduler.Runs(id)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Schedule not found: " + id,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    runs,
+		})
+	}
+}
+
+func listDesiredStatesHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    hub.reconciler.List(),
+		})
+	}
+}
+
+func createDesiredStateHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.DesiredStateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		principal := PrincipalFromContext(r.Context())
+		if !desiredStateInScope(hub, principal, &req) {
+			writeOutOfScope(w, r, hub, "desired state")
+			return
+		}
+
+		st, err := hub.reconciler.Create(req, principal.Username)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, protocol.APIResponse{
+			Success: true,
+			Data:    st,
+		})
+	}
+}
+
+func getDesiredStateHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		st, ok := hub.reconciler.Get(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Desired state not found: " + id,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    st,
+		})
+	}
+}
+
+func updateDesiredStateHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var req protocol.DesiredStateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		principal := PrincipalFromContext(r.Context())
+		existing, ok := hub.reconciler.Get(id)
+		if (ok && !existingStateInScope(hub, principal, existing)) || !desiredStateInScope(hub, principal, &req) {
+			writeOutOfScope(w, r, hub, "desired state")
+			return
+		}
+
+		st, err := hub.reconciler.Update(id, req, principal.Username)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errDesiredStateNotFound) {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    st,
+		})
+	}
+}
+
+func deleteDesiredStateHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		existing, ok := hub.reconciler.Get(id)
+		if ok && !existingStateInScope(hub, PrincipalFromContext(r.Context()), existing) {
+			writeOutOfScope(w, r, hub, "desired state")
+			return
+		}
+
+		if err := hub.reconciler.Delete(id); err != nil {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Desired state not found: " + id,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Message: "Desired state deleted",
+		})
+	}
+}
+
+func driftHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    hub.reconciler.Drift(r.URL.Query().Get("agent")),
+		})
+	}
+}
+
+// isAsync reports whether the request asked for the command to run in the
+// background (?async=true)
+func isAsync(r *http.Request) bool {
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	return async
+}
+
+// CORSMiddleware adds CORS headers for frontend development
+func CORSMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set(
+			"Access-Control-Allow-Methods",
+			"GET, POST, PUT, DELETE, OPTIONS",
+		)
+		w.Header().Set(
+			"Access-Control-Allow-Headers",
+			"Content-Type, Authorization, "+protocol.APIKeyHeader,
+		)
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("[API] Failed to write response: %v", err)
+	}
+}
+
+func listEnrollmentTokensHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    hub.credentials.ListTokens(),
+		})
+	}
+}
+
+func createEnrollmentTokenHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.EnrollmentTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		token, err := hub.credentials.CreateToken(req, UsernameFromContext(r.Context()))
+		hub.auditRequest(r, protocol.AuditTokenCreate, token.ID, err)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, protocol.APIResponse{
+			Success: true,
+			Message: "Store the token now, it won't be shown again",
+			Data:    token,
+		})
+	}
+}
+
+func deleteEnrollmentTokenHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		err := hub.credentials.DeleteToken(id)
+		hub.auditRequest(r, protocol.AuditTokenDelete, id, err)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Enrollment token not found: " + id,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Message: "Enrollment token deleted",
+		})
+	}
+}
+
+func listCredentialsHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    hub.credentials.ListCredentials(),
+		})
+	}
+}
+
+func revokeCredentialHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		cred, err := hub.RevokeCredential(id, UsernameFromContext(r.Context()))
+		hub.auditRequest(r, protocol.AuditCredRevoke, id, err)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "Credential not found: " + id,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Message: "Credential revoked",
+			Data:    cred,
+		})
+	}
+}
+
+// commandKeyHandler returns the PEM-encoded public key agents verify
+// commands with
+func commandKeyHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := pki.EncodePublicKey(hub.signingKey.Public().(ed25519.PublicKey))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    string(key),
+		})
+	}
+}
+
+// userErrorStatus maps user store errors to HTTP status codes
+func userErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errUserExists), errors.Is(err, errLastAdmin):
+		return http.StatusConflict
+	case errors.Is(err, errWrongPassword), errors.Is(err, errExternalUser):
+		return http.StatusForbidden
+	case errors.Is(err, errUsersNotSaved):
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+func accountHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := PrincipalFromContext(r.Context())
+		user, ok := hub.users.Get(principal.Username)
+		if !ok {
+			// API keys aren't users
+			user = protocol.User{Username: principal.Username, Role: principal.Role, Scope: principal.Scope}
+		}
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    protocol.Account{User: user, Permissions: principal.Permissions},
+		})
+	}
+}
+
+func changePasswordHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.PasswordChangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		username := UsernameFromContext(r.Context())
+		err := hub.users.ChangePassword(username, req.CurrentPassword, req.NewPassword)
+		hub.auditRequest(r, protocol.AuditPasswordChange, username, err)
+		if err != nil {
+			writeJSON(w, userErrorStatus(err), protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+		hub.sessions.RevokeUser(username)
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Message: "Password changed, log in again",
+		})
+	}
+}
+
+func listUsersHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    hub.users.List(),
+		})
+	}
+}
+
+func createUserHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		user, err := hub.users.Create(req, UsernameFromContext(r.Context()))
+		hub.auditRequest(r, protocol.AuditUserCreate, req.Username, err)
+		if err != nil {
+			writeJSON(w, userErrorStatus(err), protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, protocol.APIResponse{
+			Success: true,
+			Data:    user,
+		})
+	}
+}
+
+func getUserHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+
+		user, ok := hub.users.Get(username)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "User not found: " + username,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    user,
+		})
+	}
+}
+
+func updateUserHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var update protocol.UserUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		user, err := hub.users.Update(r.PathValue("username"), update)
+		hub.auditRequest(r, protocol.AuditUserUpdate, r.PathValue("username"), err)
+		if err != nil {
+			writeJSON(w, userErrorStatus(err), protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+		if user.Disabled || update.Password != nil {
+			hub.sessions.RevokeUser(user.Username)
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    user,
+		})
+	}
+}
+
+func deleteUserHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+
+		err := hub.users.Delete(username)
+		hub.auditRequest(r, protocol.AuditUserDelete, username, err)
+		if err != nil {
+			writeJSON(w, userErrorStatus(err), protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+		hub.sessions.RevokeUser(username)
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Message: "User deleted",
+		})
+	}
+}
+
+func listAPIKeysHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    hub.apiKeys.List(),
+		})
+	}
+}
+
+func createAPIKeyHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.APIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		key, err := hub.apiKeys.Create(req, UsernameFromContext(r.Context()))
+		hub.auditRequest(r, protocol.AuditAPIKeyCreate, req.Name, err)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errAPIKeyExists) {
+				status = http.StatusConflict
+			}
+			writeJSON(w, status, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, protocol.APIResponse{
+			Success: true,
+			Message: "Store the key now, it won't be shown again",
+			Data:    key,
+		})
+	}
+}
+
+func deleteAPIKeyHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		err := hub.apiKeys.Delete(id)
+		hub.auditRequest(r, protocol.AuditAPIKeyDelete, id, err)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, protocol.APIResponse{
+				Success: false,
+				Message: "API key not found: " + id,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Message: "API key deleted",
+		})
+	}
+}
+
+// defaultAuditLimit is how many audit entries a query returns by default
+const defaultAuditLimit = 100
+
+// auditHandler queries the audit log, newest first. With ?format=jsonl the
+// matching entries are exported as JSON lines, oldest first and without a
+// default limit.
+func auditHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter := AuditFilter{
+			User:    q.Get("user"),
+			Action:  q.Get("action"),
+			AgentID: q.Get("agent"),
+			Result:  q.Get("result"),
+		}
+		for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if s := q.Get(name); s != "" {
+				parsed, err := time.Parse(time.RFC3339, s)
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+						Success: false,
+						Message: "Invalid " + name + ", expected RFC 3339: " + s,
+					})
+					return
+				}
+				*t = parsed
+			}
+		}
+		export := q.Get("format") == "jsonl"
+		if !export {
+			filter.Limit = defaultAuditLimit
+		}
+		if limit := q.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				writeJSON(w, http.StatusBadRequest, protocol.APIResponse{
+					Success: false,
+					Message: "Invalid limit: " + limit,
+				})
+				return
+			}
+			filter.Limit = n
+		}
+
+		if export {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+			if err := hub.auditLog.Export(w, filter); err != nil {
+				// The status is already sent; the export ends short
+				log.Printf("[API] Audit export failed: %v", err)
+			}
+			return
+		}
+
+		entries, err := hub.auditLog.Query(filter)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: true,
+			Data:    entries,
+		})
+	}
+}
+
+// verifyAuditHandler checks the audit log's hash chain
+func verifyAuditHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, err := hub.auditLog.Verify()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, protocol.APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+		message := "Audit log intact"
+		if !v.Valid {
+			message = "Audit log tampered with or corrupted"
+		}
+		writeJSON(w, http.StatusOK, protocol.APIResponse{
+			Success: v.Valid,
+			Message: message,
+			Data:    v,
+		})
 	}
 }
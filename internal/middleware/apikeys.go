@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// lastUsedResolution is how stale an API key's last use may be before it is
+// recorded again, so busy keys don't rewrite the store on every request
+const lastUsedResolution = time.Minute
+
+var (
+	errInvalidAPIKey  = errors.New("invalid or expired API key")
+	errAPIKeyNotFound = errors.New("API key not found")
+	errAPIKeyExists   = errors.New("an API key with that name already exists")
+)
+
+// apiKeyRecord is what is persisted: the public fields plus the hash of the
+// key's secret
+type apiKeyRecord struct {
+	protocol.APIKey
+	Hash string `json:"hash"`
+}
+
+// APIKeyStore holds the API keys of automation clients, persisted as a JSON
+// file. Like agent credentials, keys are random and kept as SHA-256 hashes.
+type APIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]*apiKeyRecord
+	path string
+}
+
+// NewAPIKeyStore loads the API keys from path
+func NewAPIKeyStore(path string) (*APIKeyStore, error) {
+	s := &APIKeyStore{keys: make(map[string]*apiKeyRecord), path: path}
+	var saved []*apiKeyRecord
+	if err := loadJSON(path, &saved); err != nil {
+		return nil, err
+	}
+	for _, k := range saved {
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+// Create mints an API key. The returned key is the only copy of its secret.
+func (s *APIKeyStore) Create(req protocol.APIKeyRequest, user string) (protocol.APIKey, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return protocol.APIKey{}, errors.New("name is required")
+	}
+	if err := validateRole(req.Role, req.Scope); err != nil {
+		return protocol.APIKey{}, err
+	}
+	perms := protocol.RolePermissions[req.Role]
+	if len(req.Permissions) > 0 {
+		for _, p := range req.Permissions {
+			if !slices.Contains(perms, p) {
+				return protocol.APIKey{}, fmt.Errorf("role %s doesn't grant %s", req.Role, p)
+			}
+		}
+		perms = req.Permissions
+	}
+
+	now := time.Now()
+	k := &apiKeyRecord{APIKey: protocol.APIKey{
+		ID:          generateID(),
+		Name:        req.Name,
+		Role:        req.Role,
+		Permissions: slices.Clone(perms),
+		Scope:       req.Scope,
+		CreatedBy:   user,
+		CreatedAt:   now,
+	}}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return protocol.APIKey{}, errors.New("invalid ttl: " + req.TTL)
+		}
+		expires := now.Add(ttl)
+		k.ExpiresAt = &expires
+	}
+
+	var secret string
+	secret, k.Hash = newSecret(k.ID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.keys {
+		if other.Name == k.Name {
+			return protocol.APIKey{}, errAPIKeyExists
+		}
+	}
+	s.keys[k.ID] = k
+	s.persist()
+
+	minted := k.APIKey
+	minted.Key = secret
+	return minted, nil
+}
+
+// List returns the API keys, newest first
+func (s *APIKeyStore) List() []protocol.APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]protocol.APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k.APIKey)
+	}
+	slices.SortFunc(list, func(a, b protocol.APIKey) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return list
+}
+
+// Delete revokes an API key
+func (s *APIKeyStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[id]; !ok {
+		return errAPIKeyNotFound
+	}
+	delete(s.keys, id)
+	s.persist()
+	return nil
+}
+
+// Authenticate checks an API key and records its use
+func (s *APIKeyStore) Authenticate(key string) (protocol.APIKey, error) {
+	id, hash, ok := splitSecret(key)
+	if !ok {
+		return protocol.APIKey{}, errInvalidAPIKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok || !hashesEqual(k.Hash, hash) {
+		return protocol.APIKey{}, errInvalidAPIKey
+	}
+	now := time.Now()
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return protocol.APIKey{}, errInvalidAPIKey
+	}
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= lastUsedResolution {
+		k.LastUsedAt = &now
+		s.persist()
+	}
+	return k.APIKey, nil
+}
+
+// persist writes the store to disk. Callers must hold the lock.
+func (s *APIKeyStore) persist() {
+	list := make([]*apiKeyRecord, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	if err := saveJSON(s.path, list); err != nil {
+		log.Printf("[Auth] Failed to persist API keys: %v", err)
+	}
+}
@@ -0,0 +1,529 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// AuditFile is the name of the audit log in the data directory
+const AuditFile = "audit.jsonl"
+
+// maxAuditLine bounds the size of a single audit log line when reading
+const maxAuditLine = 1 << 20
+
+// Failed authentications are recorded for each client address in bursts of
+// up to failureAuditBurst, then at failureAuditRate per second, so that
+// unauthenticated clients can't grow the log as fast as they send requests
+const (
+	failureAuditRate  = 0.1
+	failureAuditBurst = 10
+)
+
+var errCorruptAudit = errors.New("corrupt audit log")
+
+// AuditFilter narrows the entries returned by AuditLog.Query. Action matches
+// exactly, or as a prefix when it ends in a dot, e.g. "auth.".
+type AuditFilter struct {
+	User    string
+	Action  string
+	AgentID string
+	Result  string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (f AuditFilter) matches(e protocol.AuditEntry) bool {
+	switch {
+	case f.User != "" && e.User != f.User:
+		return false
+	case f.Action != "" && e.Action != f.Action &&
+		!(strings.HasSuffix(f.Action, ".") && strings.HasPrefix(e.Action, f.Action)):
+		return false
+	case f.AgentID != "" && e.AgentID != f.AgentID:
+		return false
+	case f.Result != "" && e.Result != f.Result:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only, hash-chained log of commands and auth events,
+// stored as JSON lines. Entries are never rewritten; the log is read back
+// from disk for queries, so it isn't held in memory. Without a path it is
+// kept in memory.
+type AuditLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries []protocol.AuditEntry // only when not persisted
+	seq     uint64
+	last    string // hash of the last entry
+}
+
+// NewAuditLog opens the audit log at path, verifying its hash chain. A broken
+// chain is reported but doesn't prevent appending, so tampering can't be
+// used to stop auditing.
+func NewAuditLog(path string) (*AuditLog, error) {
+	l := &AuditLog{path: path}
+	if path == "" {
+		return l, nil
+	}
+
+	v, err := l.Verify()
+	if err != nil {
+		return nil, err
+	}
+	if !v.Valid {
+		log.Printf("[Audit] WARNING: audit log hash chain broken at entry %d: %s", v.BrokenAt, v.Error)
+	}
+	// Continue the chain from the last readable entry
+	err = l.scan(func(e protocol.AuditEntry) bool {
+		l.seq, l.last = e.Seq, e.Hash
+		return true
+	})
+	if err != nil && !errors.Is(err, errCorruptAudit) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// hashEntry returns the chain hash of an entry
+func hashEntry(e protocol.AuditEntry) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Append adds an entry to the log, chaining it to the previous one
+func (l *AuditLog) Append(e protocol.AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.Seq = l.seq + 1
+	e.PrevHash = l.last
+	e.Hash = hashEntry(e)
+
+	if l.file == nil {
+		l.entries = append(l.entries, e)
+	} else {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := l.file.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+	l.seq, l.last = e.Seq, e.Hash
+	return nil
+}
+
+// scan calls fn for every entry, oldest first, until fn returns false
+func (l *AuditLog) scan(fn func(protocol.AuditEntry) bool) error {
+	if l.path == "" {
+		l.mu.Lock()
+		entries := l.entries
+		l.mu.Unlock()
+		for _, e := range entries {
+			if !fn(e) {
+				break
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Entries are appended whole under the lock, so the size taken under it
+	// ends on a line boundary
+	l.mu.Lock()
+	info, err := f.Stat()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sc := bufio.NewScanner(io.LimitReader(f, info.Size()))
+	sc.Buffer(nil, maxAuditLine)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e protocol.AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return fmt.Errorf("%w: line %d: %v", errCorruptAudit, line, err)
+		}
+		if !fn(e) {
+			break
+		}
+	}
+	return sc.Err()
+}
+
+// Query returns the entries matching the filter, newest first
+func (l *AuditLog) Query(f AuditFilter) ([]protocol.AuditEntry, error) {
+	var list []protocol.AuditEntry
+	err := l.scan(func(e protocol.AuditEntry) bool {
+		if f.matches(e) {
+			list = append(list, e)
+			// Only the newest Limit entries are returned
+			if f.Limit > 0 && len(list) > 2*f.Limit {
+				list = append(list[:0], list[len(list)-f.Limit:]...)
+			}
+		}
+		return true
+	})
+	if f.Limit > 0 && len(list) > f.Limit {
+		list = list[len(list)-f.Limit:]
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, err
+}
+
+// Export writes the entries matching the filter as JSON lines, oldest first.
+// An unfiltered export can be verified independently.
+func (l *AuditLog) Export(w io.Writer, f AuditFilter) error {
+	enc := json.NewEncoder(w)
+	n := 0
+	var werr error
+	err := l.scan(func(e protocol.AuditEntry) bool {
+		if !f.matches(e) {
+			return true
+		}
+		if werr = enc.Encode(e); werr != nil {
+			return false
+		}
+		n++
+		return f.Limit <= 0 || n < f.Limit
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}
+
+// Verify checks the hash chain of the whole log
+func (l *AuditLog) Verify() (protocol.AuditVerification, error) {
+	var v protocol.AuditVerification
+	prev := ""
+	err := l.scan(func(e protocol.AuditEntry) bool {
+		v.Entries++
+		switch {
+		case e.Seq != v.Entries:
+			v.Error = fmt.Sprintf("expected sequence number %d, found %d", v.Entries, e.Seq)
+		case e.PrevHash != prev:
+			v.Error = "previous hash doesn't match"
+		case hashEntry(e) != e.Hash:
+			v.Error = "entry hash doesn't match its content"
+		default:
+			prev = e.Hash
+			return true
+		}
+		v.BrokenAt = v.Entries
+		return false
+	})
+	if errors.Is(err, errCorruptAudit) {
+		v.BrokenAt = v.Entries + 1
+		v.Error = err.Error()
+	} else if err != nil {
+		return v, err
+	}
+	v.Valid = v.Error == ""
+	return v, nil
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// prefixes
+func ParseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for s := range strings.SplitSeq(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientIP returns the address of the client of a request. X-Forwarded-For
+// is only believed when the request comes from a trusted proxy, and then
+// only up to the first address that isn't one.
+func (h *Hub) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !h.trustedProxy(addr) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	// Walk back from the nearest hop, as earlier ones can be forged
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !h.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+func (h *Hub) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range h.cfg.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// record appends an entry, logging failures rather than returning them: the
+// action has already happened
+func (l *AuditLog) record(e protocol.AuditEntry) {
+	if err := l.Append(e); err != nil {
+		log.Printf("[Audit] Failed to record %s by %s: %v", e.Action, e.User, err)
+	}
+}
+
+// requester returns who is asking for a command through the API
+func (h *Hub) requester(r *http.Request) Requester {
+	return Requester{Name: UsernameFromContext(r.Context()), SourceIP: h.clientIP(r)}
+}
+
+// audit records an entry in the audit log
+func (h *Hub) audit(e protocol.AuditEntry) {
+	h.auditLog.record(e)
+}
+
+// auditAuth records an authentication attempt by user, who may not exist. A
+// nil err records success; failures are sampled, see auditFailure.
+func (h *Hub) auditAuth(r *http.Request, action, user string, err error) {
+	e := requestEntry(h, r, action, user, "", err)
+	if err != nil {
+		h.auditFailure(e)
+		return
+	}
+	h.audit(e)
+}
+
+// auditFailure records a failed authentication unless its client address
+// is over its share of entries. The number skipped is added to the next
+// entry recorded for the address, or recorded on its own once the address
+// has gone quiet.
+func (h *Hub) auditFailure(e protocol.AuditEntry) {
+	record, skipped, quiet := h.authFailures.sample(e.SourceIP, time.Now())
+	for ip, n := range quiet {
+		h.audit(protocol.AuditEntry{
+			SourceIP: ip,
+			Action:   protocol.AuditSkipped,
+			Result:   protocol.AuditResultFailure,
+			Detail:   fmt.Sprintf("%d more failed authentications not recorded", n),
+		})
+	}
+	if !record {
+		return
+	}
+	if skipped > 0 {
+		e.Detail = fmt.Sprintf("%s (%d more not recorded before this)", e.Detail, skipped)
+	}
+	h.audit(e)
+}
+
+// auditSampler decides which failed authentications are recorded, per
+// client address
+type auditSampler struct {
+	mu        sync.Mutex
+	sources   map[string]*sampledSource
+	lastPrune time.Time
+}
+
+type sampledSource struct {
+	bucket
+	skipped int
+}
+
+func newAuditSampler() *auditSampler {
+	return &auditSampler{sources: make(map[string]*sampledSource)}
+}
+
+// sample reports whether an entry from ip is recorded, and if so how many
+// were skipped before it. It also returns the skipped counts of addresses
+// that have gone quiet, which are forgotten.
+func (s *auditSampler) sample(ip string, now time.Time) (bool, int, map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	quiet := s.prune(now)
+	src, ok := s.sources[ip]
+	if !ok {
+		src = &sampledSource{bucket: bucket{tokens: failureAuditBurst, last: now}}
+		s.sources[ip] = src
+	}
+	if src.take(now, failureAuditRate, failureAuditBurst) > 0 {
+		src.skipped++
+		return false, 0, quiet
+	}
+	skipped := src.skipped
+	src.skipped = 0
+	return true, skipped, quiet
+}
+
+// prune drops the addresses whose bucket has refilled, returning their
+// skipped counts. Callers must hold the lock.
+func (s *auditSampler) prune(now time.Time) map[string]int {
+	if now.Sub(s.lastPrune) < pruneInterval {
+		return nil
+	}
+	s.lastPrune = now
+	var quiet map[string]int
+	for ip, src := range s.sources {
+		if src.tokens+now.Sub(src.last).Seconds()*failureAuditRate < failureAuditBurst {
+			continue
+		}
+		if src.skipped > 0 {
+			if quiet == nil {
+				quiet = make(map[string]int)
+			}
+			quiet[ip] = src.skipped
+		}
+		delete(s.sources, ip)
+	}
+	return quiet
+}
+
+// auditRequest records an action taken through the API by the request's
+// principal. A nil err records success.
+func (h *Hub) auditRequest(r *http.Request, action, target string, err error) {
+	h.audit(requestEntry(h, r, action, UsernameFromContext(r.Context()), target, err))
+}
+
+// auditDenied records a request refused for lack of permission or scope
+func (h *Hub) auditDenied(r *http.Request, agentID, reason string) {
+	h.audit(protocol.AuditEntry{
+		User:     UsernameFromContext(r.Context()),
+		SourceIP: h.clientIP(r),
+		Action:   protocol.AuditDenied,
+		AgentID:  agentID,
+		Target:   r.Method + " " + r.URL.Path,
+		Result:   protocol.AuditResultDenied,
+		Detail:   reason,
+	})
+}
+
+func requestEntry(h *Hub, r *http.Request, action, user, target string, err error) protocol.AuditEntry {
+	e := protocol.AuditEntry{
+		User:     user,
+		SourceIP: h.clientIP(r),
+		Action:   action,
+		Target:   target,
+		Result:   protocol.AuditResultSuccess,
+	}
+	if err != nil {
+		e.Result = protocol.AuditResultFailure
+		e.Detail = err.Error()
+	}
+	return e
+}
+
+// recordJob records the outcome of a command job
+func (l *AuditLog) recordJob(job protocol.CommandJob) {
+	e := protocol.AuditEntry{
+		User:        job.Requester,
+		SourceIP:    job.SourceIP,
+		Action:      protocol.AuditCommandPrefix + strings.ToLower(job.Action),
+		AgentID:     job.AgentID,
+		ProcessName: job.ProcessName,
+		Result:      protocol.AuditResultSuccess,
+		Detail:      job.ID,
+	}
+	if job.Via != "" {
+		e.Detail += " via " + job.Via
+	}
+	if pid, err := strconv.ParseInt(job.Target, 10, 32); err == nil && commandTargetsPID(job.Action) {
+		e.PID = int32(pid)
+	} else {
+		e.Target = job.Target
+	}
+	if job.State != protocol.JobSucceeded {
+		e.Result = protocol.AuditResultFailure
+		msg := job.Error
+		if job.Response != nil {
+			msg = job.Response.Message
+		}
+		e.Detail = strings.TrimSpace(e.Detail + " " + job.State + ": " + msg)
+	}
+	l.record(e)
+}
+
+// commandTargetsPID reports whether a command action's target is a PID
+func commandTargetsPID(action string) bool {
+	return action == protocol.ActionStop || action == protocol.ActionSignal
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// writeAuditLog appends n entries to a new audit log file and returns its
+// path and lines
+func writeAuditLog(t *testing.T, n int) (string, []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), AuditFile)
+	l, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatalf("NewAuditLog: %v", err)
+	}
+	for i := range n {
+		err := l.Append(protocol.AuditEntry{
+			User:   "admin",
+			Action: protocol.AuditCommandPrefix + "stop",
+			PID:    int32(100 + i),
+			Result: protocol.AuditResultSuccess,
+		})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	l.file.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// rewriteEntry decodes line, lets edit change the entry and encodes it back
+func rewriteEntry(t *testing.T, line string, edit func(*protocol.AuditEntry)) string {
+	t.Helper()
+	var e protocol.AuditEntry
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatal(err)
+	}
+	edit(&e)
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+func TestAuditVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(t *testing.T, lines []string) []string
+		entries  uint64
+		brokenAt uint64
+	}{
+		{
+			name:    "intact",
+			tamper:  func(_ *testing.T, lines []string) []string { return lines },
+			entries: 4,
+		},
+		{
+			name: "edited entry",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1] = rewriteEntry(t, lines[1], func(e *protocol.AuditEntry) { e.User = "mallory" })
+				return lines
+			},
+			entries:  2,
+			brokenAt: 2,
+		},
+		{
+			name: "edited entry with its hash recomputed",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1] = rewriteEntry(t, lines[1], func(e *protocol.AuditEntry) {
+					e.User = "mallory"
+					e.Hash = hashEntry(*e)
+				})
+				return lines
+			},
+			entries:  3,
+			brokenAt: 3,
+		},
+		{
+			name: "removed entry",
+			tamper: func(_ *testing.T, lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			entries:  2,
+			brokenAt: 2,
+		},
+		{
+			name: "removed entry with the rest renumbered",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines = append(lines[:1], lines[2:]...)
+				for i := 1; i < len(lines); i++ {
+					lines[i] = rewriteEntry(t, lines[i], func(e *protocol.AuditEntry) {
+						e.Seq--
+						e.Hash = hashEntry(*e)
+					})
+				}
+				return lines
+			},
+			entries:  2,
+			brokenAt: 2,
+		},
+		{
+			name: "swapped entries",
+			tamper: func(_ *testing.T, lines []string) []string {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			entries:  2,
+			brokenAt: 2,
+		},
+		{
+			name: "unreadable entry",
+			tamper: func(_ *testing.T, lines []string) []string {
+				lines[2] = "{not json"
+				return lines
+			},
+			entries:  2,
+			brokenAt: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, lines := writeAuditLog(t, 4)
+			lines = tt.tamper(t, lines)
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			v, err := (&AuditLog{path: path}).Verify()
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if v.Valid != (tt.brokenAt == 0) || v.BrokenAt != tt.brokenAt || v.Entries != tt.entries {
+				t.Errorf("got %+v, want %d entries broken at %d", v, tt.entries, tt.brokenAt)
+			}
+			if !v.Valid && v.Error == "" {
+				t.Error("broken chain without an error")
+			}
+		})
+	}
+}
+
+func TestAuditReopenContinuesChain(t *testing.T) {
+	path, _ := writeAuditLog(t, 3)
+
+	l, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatalf("NewAuditLog: %v", err)
+	}
+	defer l.file.Close()
+	if err := l.Append(protocol.AuditEntry{Action: protocol.AuditCommandPrefix + "start"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	v, err := l.Verify()
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !v.Valid || v.Entries != 4 {
+		t.Errorf("got %+v, want 4 valid entries", v)
+	}
+}
+
+func TestAuditBrokenLogStillAppends(t *testing.T) {
+	path, lines := writeAuditLog(t, 3)
+	lines[0] = rewriteEntry(t, lines[0], func(e *protocol.AuditEntry) { e.Result = protocol.AuditResultFailure })
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatalf("NewAuditLog on a broken log: %v", err)
+	}
+	defer l.file.Close()
+	if err := l.Append(protocol.AuditEntry{Action: protocol.AuditCommandPrefix + "start"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	entries, err := l.Query(AuditFilter{Limit: 1})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Seq != 4 || entries[0].PrevHash == "" {
+		t.Errorf("new entry doesn't continue the chain: %+v", entries)
+	}
+	if v, _ := l.Verify(); v.Valid || v.BrokenAt != 1 {
+		t.Errorf("got %+v, want the chain still broken at 1", v)
+	}
+}
+
+func TestAuditInMemory(t *testing.T) {
+	l, err := NewAuditLog("")
+	if err != nil {
+		t.Fatalf("NewAuditLog: %v", err)
+	}
+	for range 3 {
+		if err := l.Append(protocol.AuditEntry{Action: protocol.AuditCommandPrefix + "stop"}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	l.entries[1].User = "mallory"
+
+	v, err := l.Verify()
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if v.Valid || v.BrokenAt != 2 {
+		t.Errorf("got %+v, want the chain broken at 2", v)
+	}
+}
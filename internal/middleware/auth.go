@@ -1,8 +1,10 @@
 package middleware
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -10,55 +12,152 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecretKey = []byte("super-secret-key-change-me")
+type contextKey string
 
-// GenerateJWT creates a new token for a valid user
-func GenerateJWT(username string) (string, error) {
-	claims := jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(), // 24 hours
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecretKey)
+const principalKey contextKey = "principal"
+
+// Principal is the authenticated user of a request, as described by the
+// claims of their token
+type Principal struct {
+	Username    string
+	Role        string
+	Permissions []string
+	// Scope is a label selector limiting the agents the user can operate,
+	// empty for all agents
+	Scope string
+	// SessionID is the login session the token belongs to
+	SessionID string
+	// APIKeyID is set when the request authenticated with an API key
+	APIKeyID string
+}
+
+// Can reports whether the principal has a permission
+func (p Principal) Can(perm string) bool {
+	return slices.Contains(p.Permissions, perm)
+}
+
+// PrincipalFromContext returns the principal stored by AuthMiddleware
+func PrincipalFromContext(ctx context.Context) Principal {
+	p, _ := ctx.Value(principalKey).(Principal)
+	return p
+}
+
+// UsernameFromContext returns the authenticated username stored by AuthMiddleware
+func UsernameFromContext(ctx context.Context) string {
+	return PrincipalFromContext(ctx).Username
 }
 
-// AuthMiddleware intercepts requests and validates the JWT token
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+// tokenClaims are the claims of access tokens. The JWT ID is the session ID.
+type tokenClaims struct {
+	Username    string   `json:"username"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"perms"`
+	Scope       string   `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+var (
+	errMissingAuth = errors.New("Missing Authorization header")
+	errAuthFormat  = errors.New("Invalid Authorization format")
+	errBadToken    = errors.New("Invalid or expired token")
+	errRoleChanged = errors.New("Your role has changed, log in again")
+)
+
+// AuthMiddleware intercepts requests, rate limits them per client address,
+// authenticates them with a JWT access token or an API key, rate limits them
+// per principal and checks that the principal has perm; an empty perm only
+// requires authentication.
+func AuthMiddleware(hub *Hub, perm string, next http.HandlerFunc) http.HandlerFunc {
+	return RateLimitMiddleware(hub, func(w http.ResponseWriter, r *http.Request) {
+		var principal Principal
+		var err error
+		if key := r.Header.Get(protocol.APIKeyHeader); key != "" {
+			principal, err = hub.authenticateAPIKey(key)
+		} else {
+			principal, err = hub.authenticateToken(r.Header.Get("Authorization"))
+		}
+		if err != nil {
+			hub.auditAuth(r, protocol.AuditRejected, "", err)
 			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{
 				Success: false,
-				Message: "Missing Authorization header",
+				Message: err.Error(),
 			})
 			return
 		}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{
-				Success: false,
-				Message: "Invalid Authorization format",
-			})
+		if ok, wait := hub.apiLimiter.Allow(principal.Username); !ok {
+			writeTooManyRequests(w, wait, "Rate limit exceeded, slow down")
 			return
 		}
 
-		tokenStr := parts[1]
-		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (any, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method")
-			}
-			return jwtSecretKey, nil
-		})
+		ctx := context.WithValue(r.Context(), principalKey, principal)
+		r = r.WithContext(ctx)
 
-		if err != nil || !token.Valid {
-			writeJSON(w, http.StatusUnauthorized, protocol.APIResponse{
+		if perm != "" && !principal.Can(perm) {
+			hub.auditDenied(r, "", "requires "+perm)
+			writeJSON(w, http.StatusForbidden, protocol.APIResponse{
 				Success: false,
-				Message: "Invalid or expired token",
+				Message: "Permission denied: requires " + perm,
 			})
 			return
 		}
 
 		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateToken validates a bearer access token. The token's session
+// must not be revoked, the user must still exist and be enabled with the
+// role and scope in the token, and tokens issued before the user's last
+// password change are rejected.
+func (h *Hub) authenticateToken(authHeader string) (Principal, error) {
+	if authHeader == "" {
+		return Principal{}, errMissingAuth
+	}
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return Principal{}, errAuthFormat
+	}
+
+	var claims tokenClaims
+	token, err := jwt.ParseWithClaims(parts[1], &claims, h.jwtKey)
+	if err != nil || !token.Valid || !h.sessions.Active(claims.ID) {
+		return Principal{}, errBadToken
+	}
+
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	user, ok := h.users.Get(claims.Username)
+	if !ok || user.Disabled || issuedAt.Before(user.PasswordChangedAt.Truncate(time.Second)) {
+		return Principal{}, errBadToken
+	}
+	if user.Role != claims.Role || user.Scope != claims.Scope {
+		return Principal{}, errRoleChanged
+	}
+
+	return Principal{
+		Username:    claims.Username,
+		Role:        claims.Role,
+		Permissions: claims.Permissions,
+		Scope:       claims.Scope,
+		SessionID:   claims.ID,
+	}, nil
+}
+
+// authenticateAPIKey validates an API key. Its principal is named after the
+// key, so actions taken with it can be told apart from the user's own.
+func (h *Hub) authenticateAPIKey(key string) (Principal, error) {
+	k, err := h.apiKeys.Authenticate(key)
+	if err != nil {
+		return Principal{}, err
 	}
+	return Principal{
+		Username:    "apikey:" + k.Name,
+		Role:        k.Role,
+		Permissions: k.Permissions,
+		Scope:       k.Scope,
+		APIKeyID:    k.ID,
+	}, nil
 }
@@ -0,0 +1,345 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+var (
+	errNoAgentsMatched = errors.New("no agents matched the selection")
+	errUnconfirmed     = errors.New("set confirm to stop or signal them all")
+)
+
+// bulkTarget is a single command dispatch within a bulk request
+type bulkTarget struct {
+	agentID string
+	target  string
+	// queue defers the command if the agent is offline
+	queue bool
+}
+
+// BulkCommand sends the same action to every selected agent concurrently,
+// recording a job per dispatch. With a queue TTL, known offline agents
+// matching the selector get the command deferred until they reconnect. When
+// a process query is given without an explicit target, STOP and SIGNAL are
+// applied to every matching PID. If async is set the jobs are started in the
+// background and returned queued.
+func (h *Hub) BulkCommand(
+	req protocol.BulkCommandRequest, requester Requester, async bool,
+) (*protocol.BulkCommandResponse, error) {
+	if err := validateBulkRequest(req); err != nil {
+		return nil, err
+	}
+
+	sel, err := ParseSelector(req.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	queueTTL, err := parseQueueTTL(req.QueueTTL, req.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	match, err := processMatcher(req.Process, req.ProcessMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := dedupe(req.AgentIDs)
+	agents, missing := h.SelectAgents(ids, sel)
+
+	var targets []bulkTarget
+	pidTargets := 0
+	for _, agent := range agents {
+		if req.Process == "" {
+			targets = append(targets, bulkTarget{agentID: agent.ID, target: req.Target})
+			continue
+		}
+
+		pids := agent.findProcesses(match)
+		if len(pids) == 0 {
+			continue
+		}
+		if req.Target != "" || req.Action == protocol.ActionStart {
+			targets = append(targets, bulkTarget{agentID: agent.ID, target: req.Target})
+			continue
+		}
+		for _, pid := range pids {
+			targets = append(targets, bulkTarget{agentID: agent.ID, target: strconv.Itoa(int(pid))})
+		}
+		pidTargets += len(pids)
+	}
+	if pidTargets > protocol.MaxProcessTargets && !req.Confirm {
+		return nil, fmt.Errorf("process %q matches %d processes, more than %d: %w",
+			req.Process, pidTargets, protocol.MaxProcessTargets, errUnconfirmed)
+	}
+	// Offline agents can't be matched against a process query
+	if queueTTL > 0 && req.Process == "" {
+		for _, id := range h.SelectOfflineAgents(ids, sel) {
+			targets = append(targets, bulkTarget{agentID: id, target: req.Target, queue: true})
+			missing = slices.DeleteFunc(missing, func(m string) bool { return m == id })
+		}
+	}
+	// Other IDs that aren't connected still get a job so the failure is
+	// recorded, unless they are known agents the selector doesn't match,
+	// which are skipped like connected ones
+	for _, id := range missing {
+		if info, known := h.registry.Get(id); known && !sel.Matches(agentLabels(info)) {
+			continue
+		}
+		targets = append(targets, bulkTarget{agentID: id, target: req.Target})
+	}
+
+	if len(targets) == 0 {
+		return nil, errNoAgentsMatched
+	}
+
+	slices.SortStableFunc(targets, func(a, b bulkTarget) int {
+		return strings.Compare(a.agentID, b.agentID)
+	})
+
+	jobs := make([]protocol.CommandJob, len(targets))
+	for i, t := range targets {
+		ttl := queueTTL
+		if !t.queue {
+			ttl = 0
+		}
+		jobs[i] = h.newJob(t.agentID, protocol.AgentCommand{
+			Action: req.Action,
+			Target: t.target,
+			Signal: req.Signal,
+			Args:   req.Args,
+		}, requester, ttl)
+	}
+
+	if async {
+		go h.runJobs(jobs, req.MaxParallel)
+		return summarizeBulk(jobs), nil
+	}
+	return summarizeBulk(h.runJobs(jobs, req.MaxParallel)), nil
+}
+
+// runJobs runs the jobs with at most maxParallel in flight (0 = unbounded)
+// and returns them in their final state
+func (h *Hub) runJobs(jobs []protocol.CommandJob, maxParallel int) []protocol.CommandJob {
+	done := make([]protocol.CommandJob, len(jobs))
+	sem := make(chan struct{}, parallelism(maxParallel, len(jobs)))
+	var wg sync.WaitGroup
+
+	for i, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			done[i] = h.runJob(job)
+		}()
+	}
+	wg.Wait()
+	return done
+}
+
+// processName returns the name of the process with the given PID in the
+// agent's latest telemetry, empty if it isn't there
+func (a *AgentConnection) processName(target string) string {
+	pid, err := strconv.ParseInt(target, 10, 32)
+	if err != nil {
+		return ""
+	}
+
+	a.processesMu.RLock()
+	defer a.processesMu.RUnlock()
+
+	for _, p := range a.processes {
+		if p.PID == int32(pid) {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+// findProcesses returns the PIDs of the processes whose name matches
+func (a *AgentConnection) findProcesses(match func(name string) bool) []int32 {
+	a.processesMu.RLock()
+	defer a.processesMu.RUnlock()
+
+	var pids []int32
+	for _, p := range a.processes {
+		if match(p.Name) {
+			pids = append(pids, p.PID)
+		}
+	}
+	return pids
+}
+
+// processMatcher returns the function matching process names against a
+// process query in the given mode, exact by default
+func processMatcher(query, mode string) (func(name string) bool, error) {
+	switch mode {
+	case "", protocol.ProcessMatchExact:
+		return func(name string) bool { return name == query }, nil
+	case protocol.ProcessMatchGlob:
+		re, err := globRegexp(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid process glob %q: %w", query, err)
+		}
+		return re.MatchString, nil
+	case protocol.ProcessMatchRegex:
+		re, err := regexp.Compile(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid process regex %q: %w", query, err)
+		}
+		return re.MatchString, nil
+	}
+	return nil, fmt.Errorf("unknown process_match: %s", mode)
+}
+
+// globRegexp converts a glob into an anchored regular expression. Unlike
+// path.Match, * and ? also match slashes, which process names can contain.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if rest, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + rest
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func validateBulkRequest(req protocol.BulkCommandRequest) error {
+	if len(req.AgentIDs) == 0 && req.Selector == "" && req.Process == "" {
+		return errors.New("one of agent_ids, selector or process is required")
+	}
+	if _, err := processMatcher(req.Process, req.ProcessMatch); err != nil {
+		return err
+	}
+
+	switch req.Action {
+	case protocol.ActionStop:
+	case protocol.ActionSignal:
+		if req.Signal == "" {
+			return errors.New("signal is required for SIGNAL")
+		}
+	case protocol.ActionStart:
+		if req.Target == "" {
+			return errors.New("target is required for START")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown action: %s", req.Action)
+	}
+
+	if req.Target == "" && req.Process == "" {
+		return fmt.Errorf("target or process is required for %s", req.Action)
+	}
+	return nil
+}
+
+func summarizeBulk(jobs []protocol.CommandJob) *protocol.BulkCommandResponse {
+	summary := &protocol.BulkCommandResponse{
+		Total:   len(jobs),
+		Results: make([]protocol.BulkCommandResult, 0, len(jobs)),
+	}
+
+	pending := 0
+	for _, job := range jobs {
+		result := protocol.BulkCommandResult{
+			JobID:    job.ID,
+			AgentID:  job.AgentID,
+			Hostname: job.Hostname,
+			Target:   job.Target,
+			Success:  job.State == protocol.JobSucceeded,
+			Message:  job.Error,
+		}
+		if job.Response != nil {
+			result.Message = job.Response.Message
+		}
+
+		switch {
+		case !job.Done():
+			pending++
+			result.Message = job.State
+		case result.Success:
+			summary.Succeeded++
+		default:
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, result)
+	}
+
+	switch {
+	case pending > 0:
+		summary.Status = protocol.BulkStatusQueued
+	case summary.Failed == 0:
+		summary.Status = protocol.BulkStatusSucceeded
+	case summary.Succeeded == 0:
+		summary.Status = protocol.BulkStatusFailed
+	default:
+		summary.Status = protocol.BulkStatusPartial
+	}
+	return summary
+}
+
+// parallelism bounds the number of in-flight commands; 0 means unbounded
+func parallelism(limit, n int) int {
+	if limit <= 0 || limit > n {
+		return max(n, 1)
+	}
+	return limit
+}
+
+// parseQueueTTL parses the optional offline queue TTL of a request for an
+// action. STOP and SIGNAL can't be queued: by the time the agent reconnects,
+// possibly after a reboot, their PID may belong to another process.
+func parseQueueTTL(s, action string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if commandTargetsPID(action) {
+		return 0, fmt.Errorf("%s targets a PID and can't be queued for offline agents", action)
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid queue_ttl: %s", s)
+	}
+	return ttl, nil
+}
+
+func dedupe(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	hub, err := NewHub(HubConfig{})
+	if err != nil {
+		t.Fatalf("NewHub: %v", err)
+	}
+	return hub
+}
+
+// postBulk calls the bulk command handler as the given principal
+func postBulk(hub *Hub, p Principal, req protocol.BulkCommandRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest(http.MethodPost, "/api/commands", bytes.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), principalKey, p))
+	w := httptest.NewRecorder()
+	bulkCommandHandler(hub)(w, r)
+	return w
+}
+
+func TestBulkCommandQueueRespectsScope(t *testing.T) {
+	hub := newTestHub(t)
+	hub.registry.Put(protocol.AgentInfo{ID: "prod-1", Hostname: "prod-1", Labels: map[string]string{"env": "prod"}})
+	hub.registry.Put(protocol.AgentInfo{ID: "dev-1", Hostname: "dev-1", Labels: map[string]string{"env": "dev"}})
+
+	operator := Principal{Username: "op", Role: protocol.RoleOperator, Scope: "env=dev"}
+
+	w := postBulk(hub, operator, protocol.BulkCommandRequest{
+		AgentIDs: []string{"prod-1"},
+		Action:   protocol.ActionStart,
+		Target:   "/usr/local/bin/backup",
+		QueueTTL: "1h",
+	})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("out-of-scope offline agent: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w = postBulk(hub, operator, protocol.BulkCommandRequest{
+		AgentIDs: []string{"prod-1", "dev-1"},
+		Action:   protocol.ActionStart,
+		Target:   "/usr/local/bin/backup",
+		QueueTTL: "1h",
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("mixed agents: got status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	if jobs := hub.ListJobs(JobFilter{AgentID: "prod-1"}); len(jobs) != 0 {
+		t.Errorf("got %d jobs for the out-of-scope agent, want none", len(jobs))
+	}
+	if queued := hub.jobs.Deferred("dev-1"); len(queued) != 1 {
+		t.Errorf("got %d deferred jobs for the in-scope agent, want 1", len(queued))
+	}
+}
+
+func TestBulkCommandNeverDefersUnselectedAgents(t *testing.T) {
+	hub := newTestHub(t)
+	hub.registry.Put(protocol.AgentInfo{ID: "web-1", Hostname: "web-1"})
+
+	// A process query can't be matched on an offline agent, so it isn't
+	// queued for it even with a TTL
+	resp, err := hub.BulkCommand(protocol.BulkCommandRequest{
+		AgentIDs: []string{"web-1", "unknown"},
+		Action:   protocol.ActionStart,
+		Target:   "/usr/sbin/nginx",
+		Process:  "nginx",
+		QueueTTL: "1h",
+	}, Requester{Name: "test"}, false)
+	if err != nil {
+		t.Fatalf("BulkCommand: %v", err)
+	}
+	if resp.Failed != 2 {
+		t.Errorf("got %d failed jobs, want 2", resp.Failed)
+	}
+	if queued := hub.jobs.Deferred("web-1"); len(queued) != 0 {
+		t.Errorf("got %d deferred jobs, want none", len(queued))
+	}
+}
+
+func TestBulkCommandRefusesToQueuePIDs(t *testing.T) {
+	hub := newTestHub(t)
+	hub.registry.Put(protocol.AgentInfo{ID: "web-1", Hostname: "web-1"})
+
+	for _, action := range []string{protocol.ActionStop, protocol.ActionSignal} {
+		_, err := hub.BulkCommand(protocol.BulkCommandRequest{
+			AgentIDs: []string{"web-1"},
+			Action:   action,
+			Target:   "1234",
+			Signal:   "HUP",
+			QueueTTL: "1h",
+		}, Requester{Name: "test"}, false)
+		if err == nil {
+			t.Errorf("%s with queue_ttl was accepted", action)
+		}
+	}
+	if jobs := hub.ListJobs(JobFilter{}); len(jobs) != 0 {
+		t.Errorf("got %d jobs, want none", len(jobs))
+	}
+}
+
+func TestProcessMatcher(t *testing.T) {
+	tests := []struct {
+		query, mode, name string
+		want              bool
+	}{
+		{"sh", "", "sh", true},
+		{"sh", "", "bash", false},
+		{"sh", protocol.ProcessMatchExact, "sshd", false},
+		{"nginx*", protocol.ProcessMatchGlob, "nginx-worker", true},
+		{"nginx*", protocol.ProcessMatchGlob, "my-nginx", false},
+		{"kworker/*", protocol.ProcessMatchGlob, "kworker/0:1-events", true},
+		{"php-fpm[78]", protocol.ProcessMatchGlob, "php-fpm8", true},
+		{"php-fpm[!78]", protocol.ProcessMatchGlob, "php-fpm8", false},
+		{"^(ba|z)sh$", protocol.ProcessMatchRegex, "zsh", true},
+		{"^(ba|z)sh$", protocol.ProcessMatchRegex, "sshd", false},
+	}
+	for _, tt := range tests {
+		match, err := processMatcher(tt.query, tt.mode)
+		if err != nil {
+			t.Fatalf("processMatcher(%q, %q): %v", tt.query, tt.mode, err)
+		}
+		if got := match(tt.name); got != tt.want {
+			t.Errorf("%s %q on %q = %v, want %v", tt.mode, tt.query, tt.name, got, tt.want)
+		}
+	}
+
+	for _, mode := range []string{protocol.ProcessMatchGlob, protocol.ProcessMatchRegex, "fuzzy"} {
+		if _, err := processMatcher("[", mode); err == nil {
+			t.Errorf("processMatcher(%q, %q) accepted an invalid query", "[", mode)
+		}
+	}
+}
+
+func TestBulkCommandRequiresConfirmForManyProcesses(t *testing.T) {
+	hub := newTestHub(t)
+	agent := &AgentConnection{ID: "web-1", Info: protocol.AgentInfo{ID: "web-1", Hostname: "web-1"}}
+	for pid := range int32(protocol.MaxProcessTargets + 1) {
+		agent.processes = append(agent.processes, protocol.ProcessInfo{PID: 100 + pid, Name: "worker"})
+	}
+	hub.agents[agent.ID] = agent
+
+	_, err := hub.BulkCommand(protocol.BulkCommandRequest{
+		Process: "worker",
+		Action:  protocol.ActionStop,
+	}, Requester{Name: "test"}, false)
+	if !errors.Is(err, errUnconfirmed) {
+		t.Errorf("got error %v, want %v", err, errUnconfirmed)
+	}
+	if jobs := hub.ListJobs(JobFilter{}); len(jobs) != 0 {
+		t.Errorf("got %d jobs, want none", len(jobs))
+	}
+}
@@ -0,0 +1,374 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+var (
+	errInvalidToken       = errors.New("invalid or exhausted enrollment token")
+	errInvalidCredential  = errors.New("invalid credential")
+	errRevokedCredential  = errors.New("credential revoked")
+	errTokenNotFound      = errors.New("enrollment token not found")
+	errCredentialNotFound = errors.New("credential not found")
+)
+
+// enrollmentRecord and credentialRecord are what is persisted: the public
+// fields plus the hash of the secret
+type enrollmentRecord struct {
+	protocol.EnrollmentToken
+	Hash string `json:"hash"`
+}
+
+type credentialRecord struct {
+	protocol.AgentCredential
+	Hash string `json:"hash"`
+}
+
+// CredentialStore holds the enrollment tokens and the per-agent credentials
+// issued in exchange for them, persisted as a JSON file. Secrets are only
+// kept as SHA-256 hashes; they are random, so a plain hash is enough.
+type CredentialStore struct {
+	mu          sync.Mutex
+	tokens      map[string]*enrollmentRecord
+	credentials map[string]*credentialRecord
+	path        string
+}
+
+type credentialsFile struct {
+	Tokens      []*enrollmentRecord `json:"tokens"`
+	Credentials []*credentialRecord `json:"credentials"`
+}
+
+// NewCredentialStore loads the tokens and credentials from path
+func NewCredentialStore(path string) (*CredentialStore, error) {
+	s := &CredentialStore{
+		tokens:      make(map[string]*enrollmentRecord),
+		credentials: make(map[string]*credentialRecord),
+		path:        path,
+	}
+	var saved credentialsFile
+	if err := loadJSON(path, &saved); err != nil {
+		return nil, err
+	}
+	for _, t := range saved.Tokens {
+		s.tokens[t.ID] = t
+	}
+	for _, c := range saved.Credentials {
+		s.credentials[c.ID] = c
+	}
+	return s, nil
+}
+
+// newSecret returns a "<id>.<secret>" string and the hash of its secret
+func newSecret(id string) (string, string) {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	secret := hex.EncodeToString(b)
+	return id + "." + secret, hashSecret(secret)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitSecret splits a "<id>.<secret>" string
+func splitSecret(s string) (id, hash string, ok bool) {
+	id, secret, ok := strings.Cut(s, ".")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+	return id, hashSecret(secret), true
+}
+
+func hashesEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// CreateToken mints an enrollment token. The returned token is the only
+// copy of its secret.
+func (s *CredentialStore) CreateToken(req protocol.EnrollmentTokenRequest, user string) (protocol.EnrollmentToken, error) {
+	if req.MaxUses < 0 {
+		return protocol.EnrollmentToken{}, errors.New("max_uses must be positive")
+	}
+	now := time.Now()
+	t := &enrollmentRecord{EnrollmentToken: protocol.EnrollmentToken{
+		ID:          generateID(),
+		Description: req.Description,
+		MaxUses:     max(req.MaxUses, 1),
+		CreatedBy:   user,
+		CreatedAt:   now,
+	}}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return protocol.EnrollmentToken{}, errors.New("invalid ttl: " + req.TTL)
+		}
+		expires := now.Add(ttl)
+		t.ExpiresAt = &expires
+	}
+
+	var token string
+	token, t.Hash = newSecret(t.ID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.ID] = t
+	s.persist()
+
+	minted := t.EnrollmentToken
+	minted.Token = token
+	return minted, nil
+}
+
+// ListTokens returns the enrollment tokens, newest first
+func (s *CredentialStore) ListTokens() []protocol.EnrollmentToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]protocol.EnrollmentToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t.EnrollmentToken)
+	}
+	slices.SortFunc(list, func(a, b protocol.EnrollmentToken) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return list
+}
+
+// DeleteToken removes an enrollment token. Credentials already issued with
+// it stay valid.
+func (s *CredentialStore) DeleteToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[id]; !ok {
+		return errTokenNotFound
+	}
+	delete(s.tokens, id)
+	s.persist()
+	return nil
+}
+
+// Enroll consumes one use of an enrollment token and issues a credential
+// for the agent. The credential is bound to an agent ID later, with Bind, or
+// released with Release if it can't be delivered.
+func (s *CredentialStore) Enroll(token, hostname string) (protocol.AgentCredential, string, error) {
+	id, hash, ok := splitSecret(token)
+	if !ok {
+		return protocol.AgentCredential{}, "", errInvalidToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || !hashesEqual(t.Hash, hash) || t.Uses >= t.MaxUses {
+		return protocol.AgentCredential{}, "", errInvalidToken
+	}
+	now := time.Now()
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return protocol.AgentCredential{}, "", errInvalidToken
+	}
+	t.Uses++
+
+	c := &credentialRecord{AgentCredential: protocol.AgentCredential{
+		ID:         generateID(),
+		Hostname:   hostname,
+		TokenID:    t.ID,
+		CreatedAt:  now,
+		LastUsedAt: &now,
+	}}
+	var secret string
+	secret, c.Hash = newSecret(c.ID)
+	s.credentials[c.ID] = c
+	s.persist()
+	return c.AgentCredential, secret, nil
+}
+
+// Release undoes an enrollment whose credential never reached the agent:
+// the credential is dropped and the token use is given back, so the agent
+// can enroll again
+func (s *CredentialStore) Release(credentialID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.credentials[credentialID]
+	if !ok {
+		return
+	}
+	delete(s.credentials, credentialID)
+	if t, ok := s.tokens[c.TokenID]; ok && t.Uses > 0 {
+		t.Uses--
+	}
+	s.persist()
+}
+
+// Bind records the agent ID a credential belongs to
+func (s *CredentialStore) Bind(credentialID, agentID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.credentials[credentialID]; ok {
+		c.AgentID = agentID
+		s.persist()
+	}
+}
+
+// Authenticate checks an agent credential and records its use
+func (s *CredentialStore) Authenticate(credential string) (protocol.AgentCredential, error) {
+	id, hash, ok := splitSecret(credential)
+	if !ok {
+		return protocol.AgentCredential{}, errInvalidCredential
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.credentials[id]
+	if !ok || !hashesEqual(c.Hash, hash) {
+		return protocol.AgentCredential{}, errInvalidCredential
+	}
+	if c.RevokedAt != nil {
+		return protocol.AgentCredential{}, errRevokedCredential
+	}
+	now := time.Now()
+	c.LastUsedAt = &now
+	s.persist()
+	return c.AgentCredential, nil
+}
+
+// ListCredentials returns every agent credential, newest first
+func (s *CredentialStore) ListCredentials() []protocol.AgentCredential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]protocol.AgentCredential, 0, len(s.credentials))
+	for _, c := range s.credentials {
+		list = append(list, c.AgentCredential)
+	}
+	slices.SortFunc(list, func(a, b protocol.AgentCredential) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return list
+}
+
+// Revoke permanently invalidates a credential
+func (s *CredentialStore) Revoke(id, user string) (protocol.AgentCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.credentials[id]
+	if !ok {
+		return protocol.AgentCredential{}, errCredentialNotFound
+	}
+	if c.RevokedAt == nil {
+		now := time.Now()
+		c.RevokedAt = &now
+		c.RevokedBy = user
+		s.persist()
+	}
+	return c.AgentCredential, nil
+}
+
+// persist writes the store to disk. Callers must hold the lock.
+func (s *CredentialStore) persist() {
+	var file credentialsFile
+	for _, t := range s.tokens {
+		file.Tokens = append(file.Tokens, t)
+	}
+	for _, c := range s.credentials {
+		file.Credentials = append(file.Credentials, c)
+	}
+	if err := saveJSON(s.path, file); err != nil {
+		log.Printf("[Credentials] Failed to persist credentials: %v", err)
+	}
+}
+
+// agentAuth is how a registering agent proved its identity
+type agentAuth struct {
+	method string
+	// agentID is the identity bound to the certificate or credential, empty
+	// if the hub should assign one
+	agentID string
+	// credential is set for agents using an enrolled credential
+	credential *protocol.AgentCredential
+	// issued is the credential secret minted by enrollment, to be returned
+	// to the agent in its register_ack
+	issued string
+}
+
+// authenticateAgent checks a registration's client certificate, credential,
+// enrollment token or shared secret, in that order
+func (h *Hub) authenticateAgent(reg protocol.AgentRegistration, transport AgentTransport) (agentAuth, error) {
+	switch {
+	case transport.CertIdentity != "":
+		return agentAuth{method: protocol.AuthCertificate, agentID: transport.CertIdentity}, nil
+
+	case reg.Credential != "":
+		cred, err := h.credentials.Authenticate(reg.Credential)
+		if err != nil {
+			return agentAuth{}, err
+		}
+		return agentAuth{method: protocol.AuthCredential, agentID: cred.AgentID, credential: &cred}, nil
+
+	case reg.EnrollmentToken != "":
+		cred, secret, err := h.credentials.Enroll(reg.EnrollmentToken, reg.Hostname)
+		if err != nil {
+			return agentAuth{}, err
+		}
+		log.Printf("[Hub] Agent %s enrolled with token %s", reg.Hostname, cred.TokenID)
+		return agentAuth{method: protocol.AuthCredential, credential: &cred, issued: secret}, nil
+
+	case h.cfg.AgentSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(reg.SecretKey), []byte(h.cfg.AgentSecret)) == 1:
+		return agentAuth{method: protocol.AuthSharedSecret, agentID: h.reclaimID(reg.AgentID)}, nil
+	}
+	return agentAuth{}, errInvalidCredential
+}
+
+// reclaimID returns the ID an agent on the shared secret was assigned before,
+// or "" to assign a new one. Only the IDs of agents that also used the shared
+// secret can be reclaimed, so the ID of an agent with its own credential
+// can't be taken over.
+func (h *Hub) reclaimID(id string) string {
+	if id == "" {
+		return ""
+	}
+	info, ok := h.registry.Get(id)
+	if !ok || (info.Auth != "" && info.Auth != protocol.AuthSharedSecret) {
+		return ""
+	}
+	return id
+}
+
+// RevokeCredential invalidates an agent's credential and disconnects the
+// agent if it is connected with it
+func (h *Hub) RevokeCredential(id, user string) (protocol.AgentCredential, error) {
+	cred, err := h.credentials.Revoke(id, user)
+	if err != nil {
+		return cred, err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, agent := range h.agents {
+		if agent.credentialID == id {
+			log.Printf("[Hub] Credential %s revoked, disconnecting %s", id, agent.ID)
+			// Unblock the read loop, which unregisters the agent
+			_ = agent.conn.SetReadDeadline(time.Now())
+		}
+	}
+	return cred, nil
+}
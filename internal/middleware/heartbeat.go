@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// Default heartbeat thresholds, used when HubConfig leaves them unset
+const (
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultStaleAfter        = 30 * time.Second
+	defaultDisconnectAfter   = 60 * time.Second
+)
+
+// readDeadline is when a silent agent's read loop gives up. It is a backstop
+// one heartbeat past the reaper's disconnect threshold.
+func (h *Hub) readDeadline(now time.Time) time.Time {
+	return now.Add(h.cfg.DisconnectAfter + h.cfg.HeartbeatInterval)
+}
+
+// startHeartbeat installs the pong handler on the agent's connection and
+// pings it every heartbeat interval until done is closed. Any frame from the
+// agent, pongs included, pushes back its read deadline.
+func (h *Hub) startHeartbeat(agent *AgentConnection, done <-chan struct{}) {
+	conn := agent.conn
+	_ = conn.SetReadDeadline(h.readDeadline(time.Now()))
+
+	conn.SetPongHandler(func(appData string) error {
+		now := time.Now()
+		h.mu.Lock()
+		agent.Info.LastSeen = now
+		health := &agent.health
+		health.LastPong = &now
+		health.MissedHeartbeats = 0
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			rtt := now.Sub(time.Unix(0, sent))
+			health.RTTMillis = float64(rtt.Microseconds()) / 1000
+		}
+		agent.pingPending = false
+		h.mu.Unlock()
+		return conn.SetReadDeadline(h.readDeadline(now))
+	})
+
+	go func() {
+		ticker := time.NewTicker(h.cfg.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				h.mu.Lock()
+				if agent.pingPending {
+					agent.health.MissedHeartbeats++
+				}
+				agent.pingPending = true
+				h.mu.Unlock()
+
+				payload := []byte(strconv.FormatInt(now.UnixNano(), 10))
+				deadline := now.Add(h.cfg.HeartbeatInterval)
+				if err := conn.WriteControl(websocket.PingMessage, payload, deadline); err != nil {
+					log.Printf("[Hub] Ping to %s failed: %v", agent.ID, err)
+				}
+			}
+		}
+	}()
+}
+
+// touch records traffic from the agent and pushes back its read deadline
+func (h *Hub) touch(agent *AgentConnection) {
+	now := time.Now()
+	h.mu.Lock()
+	agent.Info.LastSeen = now
+	h.mu.Unlock()
+	_ = agent.conn.SetReadDeadline(h.readDeadline(now))
+}
+
+// reapLoop marks agents that have gone quiet as stale, then disconnects them
+func (h *Hub) reapLoop() {
+	ticker := time.NewTicker(h.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.reap(now)
+	}
+}
+
+func (h *Hub) reap(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, agent := range h.agents {
+		idle := now.Sub(agent.Info.LastSeen)
+		health := &agent.health
+
+		switch {
+		case idle >= h.cfg.DisconnectAfter:
+			log.Printf("[Hub] Agent %s silent for %s, disconnecting", agent.ID, idle.Round(time.Second))
+			// Unblock the read loop, which unregisters the agent
+			_ = agent.conn.SetReadDeadline(now)
+		case idle >= h.cfg.StaleAfter:
+			if health.Status != protocol.HealthStale {
+				log.Printf("[Hub] Agent %s is stale (silent for %s)", agent.ID, idle.Round(time.Second))
+			}
+			health.Status = protocol.HealthStale
+		default:
+			health.Status = protocol.HealthHealthy
+		}
+	}
+}
@@ -2,16 +2,21 @@
 package middleware
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"maps"
+	"net/netip"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/Patopm/remote-monitor/internal/pki"
 	"github.com/Patopm/remote-monitor/internal/protocol"
 )
 
@@ -22,9 +27,20 @@ type AgentConnection struct {
 
 	conn    *websocket.Conn
 	writeMu sync.Mutex
+	// credentialID is the credential the agent authenticated with, if any
+	credentialID string
+
+	// Heartbeat state, guarded by the hub lock
+	health      protocol.ConnectionHealth
+	pingPending bool
 
 	processes   []protocol.ProcessInfo
+	services    []protocol.ServiceStatus // guarded by processesMu
 	processesMu sync.RWMutex
+	// Delta baseline, guarded by processesMu: the sequence number of the
+	// last applied sample, and whether a resync was requested
+	seq       uint64
+	resyncing bool
 
 	pending   map[string]chan protocol.AgentCommandResponse
 	pendingMu sync.Mutex
@@ -37,27 +53,291 @@ func (a *AgentConnection) writeJSON(v any) error {
 	return a.conn.WriteJSON(v)
 }
 
+// readMessage reads the next message from an agent. JSON text frames are
+// returned as is; binary frames are split into their type and a body to be
+// decoded with decodePayload.
+func readMessage(conn *websocket.Conn) (protocol.WSMessage, []byte, error) {
+	var msg protocol.WSMessage
+	frameType, frame, err := conn.ReadMessage()
+	if err != nil {
+		return msg, nil, err
+	}
+	if frameType == websocket.BinaryMessage {
+		msg.Type, frame, err = protocol.DecodeEnvelope(frame)
+		return msg, frame, err
+	}
+	return msg, nil, json.Unmarshal(frame, &msg)
+}
+
+// decodePayload decodes a message's payload from its binary body if it came
+// in a binary frame, or from its JSON data otherwise
+func decodePayload(msg protocol.WSMessage, body []byte, v any) error {
+	if body != nil {
+		return protocol.DecodeBinary(body, v)
+	}
+	return json.Unmarshal(msg.Data, v)
+}
+
+// agentLabels returns the labels used to match an agent against selectors:
+// its effective labels plus the built-in hostname and os, which can't be
+// overridden
+func agentLabels(info protocol.AgentInfo) map[string]string {
+	labels := make(map[string]string, len(info.Labels)+2)
+	maps.Copy(labels, info.Labels)
+	labels["hostname"] = info.Hostname
+	labels["os"] = info.OS
+	return labels
+}
+
+// commandTimeout is how long SendCommand waits for an agent's response
+const commandTimeout = 10 * time.Second
+
+// commandTTL is how long a signed command stays valid. It leaves room for
+// clock skew between the middleware and the agent.
+const commandTTL = 2 * time.Minute
+
+var errCommandTimeout = fmt.Errorf("command timed out after %s", commandTimeout)
+
+// HubConfig holds the settings used to build a Hub
+type HubConfig struct {
+	// DataDir is where persistent state is stored; empty keeps it in memory
+	DataDir string
+
+	// HeartbeatInterval is how often agents are pinged. An agent silent for
+	// StaleAfter is marked stale and after DisconnectAfter it is disconnected.
+	// Zero values take the defaults.
+	HeartbeatInterval time.Duration
+	StaleAfter        time.Duration
+	DisconnectAfter   time.Duration
+
+	// AgentSecret is the legacy secret shared by all agents. Empty disables
+	// it, so agents must enroll for their own credential.
+	AgentSecret string
+	// RequireAgentCert only admits agents with a verified client certificate
+	RequireAgentCert bool
+
+	// JWTKeys sign and verify access tokens; the first one signs. A random
+	// key is generated if none is given.
+	JWTKeys []JWTKey
+	// AccessTokenTTL and RefreshTokenTTL are the lifetimes of access tokens
+	// and of the sessions behind refresh tokens. Zero values take the
+	// defaults.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// OIDC enables login through an OpenID Connect provider; nil disables it
+	OIDC *OIDCConfig
+
+	// BootstrapAdmin is created as an admin when there are no users yet. It
+	// is the only way to get one when state is kept in memory.
+	BootstrapAdmin *protocol.UserRequest
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header
+	// gives the client address recorded in the audit log and rate limited
+	TrustedProxies []netip.Prefix
+
+	// RateLimits throttle logins, API requests and agent messages
+	RateLimits RateLimits
+}
+
+// AgentTransport describes the connection an agent registers over
+type AgentTransport struct {
+	// Compressed is set when permessage-deflate was negotiated
+	Compressed bool
+	// CertIdentity is the common name of the agent's verified client
+	// certificate, empty if it presented none
+	CertIdentity string
+	// SourceIP is the agent's address
+	SourceIP string
+}
+
 // Hub manages all connected agents
 type Hub struct {
+	cfg    HubConfig
 	agents map[string]*AgentConnection
 	mu     sync.RWMutex
+
+	registry     *AgentRegistry
+	jobs         *JobStore
+	credentials  *CredentialStore
+	users        *UserStore
+	sessions     *SessionStore
+	apiKeys      *APIKeyStore
+	auditLog     *AuditLog
+	authFailures *auditSampler
+	logins       *LoginLimiter
+	apiLimiter   *RateLimiter
+	ipLimiter    *RateLimiter
+	agentLimiter *RateLimiter
+	oidc         *oidcClient // nil unless OIDC login is configured
+	signingKey   ed25519.PrivateKey
+	history      *TelemetryHistory
+	flushing     map[string]bool // agents whose offline queue is being delivered
+	scheduler    *Scheduler
+	reconciler   *Reconciler
 }
 
-// NewHub creates a new Hub instance
-func NewHub() *Hub {
-	return &Hub{
-		agents: make(map[string]*AgentConnection),
+// NewHub creates a new Hub instance, loading any persisted state
+func NewHub(cfg HubConfig) (*Hub, error) {
+	registry, err := NewAgentRegistry(dataPath(cfg.DataDir, "agents.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading agent registry: %w", err)
+	}
+	auditLog, err := NewAuditLog(dataPath(cfg.DataDir, AuditFile))
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	jobs, err := NewJobStore(dataPath(cfg.DataDir, "jobs.json"), auditLog.recordJob)
+	if err != nil {
+		return nil, fmt.Errorf("loading job history: %w", err)
+	}
+	credentials, err := NewCredentialStore(dataPath(cfg.DataDir, "credentials.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading agent credentials: %w", err)
+	}
+	users, err := NewUserStore(dataPath(cfg.DataDir, UsersFile))
+	if err != nil {
+		return nil, fmt.Errorf("loading users: %w", err)
+	}
+	switch {
+	case users.Empty() && cfg.BootstrapAdmin != nil:
+		req := *cfg.BootstrapAdmin
+		req.Role = protocol.RoleAdmin
+		if _, err := users.Create(req, ""); err != nil {
+			return nil, fmt.Errorf("creating admin %s: %w", req.Username, err)
+		}
+		log.Printf("[Hub] Created admin %s", req.Username)
+	case users.Empty():
+		log.Printf("[Hub] No users yet, create an admin with: middleware user add -role admin -username <name>")
+	}
+	sessions, err := NewSessionStore(dataPath(cfg.DataDir, "sessions.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading sessions: %w", err)
+	}
+	apiKeys, err := NewAPIKeyStore(dataPath(cfg.DataDir, "api_keys.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading API keys: %w", err)
+	}
+	keyPath := dataPath(cfg.DataDir, "command.key")
+	signingKey, err := pki.LoadSigningKey(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading command signing key: %w", err)
+	}
+	if keyPath != "" {
+		log.Printf("[Hub] Signing commands, agents can pin %s", pki.PublicKeyPath(keyPath))
+	}
+
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if cfg.StaleAfter <= 0 {
+		cfg.StaleAfter = defaultStaleAfter
+	}
+	if cfg.DisconnectAfter <= 0 {
+		cfg.DisconnectAfter = defaultDisconnectAfter
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		cfg.AccessTokenTTL = defaultAccessTokenTTL
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = defaultRefreshTokenTTL
 	}
+	if len(cfg.JWTKeys) == 0 {
+		log.Printf("[Hub] No JWT keys configured, using a random key; logins won't survive a restart")
+		cfg.JWTKeys = []JWTKey{randomJWTKey()}
+	}
+	cfg.RateLimits.setDefaults()
+	if cfg.DisconnectAfter < cfg.StaleAfter {
+		return nil, fmt.Errorf("disconnect threshold %s is shorter than stale threshold %s",
+			cfg.DisconnectAfter, cfg.StaleAfter)
+	}
+
+	h := &Hub{
+		cfg:          cfg,
+		agents:       make(map[string]*AgentConnection),
+		registry:     registry,
+		jobs:         jobs,
+		credentials:  credentials,
+		users:        users,
+		sessions:     sessions,
+		apiKeys:      apiKeys,
+		auditLog:     auditLog,
+		authFailures: newAuditSampler(),
+		logins:       NewLoginLimiter(cfg.RateLimits),
+		apiLimiter:   NewRateLimiter(cfg.RateLimits.APIRate, cfg.RateLimits.APIBurst),
+		ipLimiter:    NewRateLimiter(cfg.RateLimits.IPRate, cfg.RateLimits.IPBurst),
+		agentLimiter: NewRateLimiter(cfg.RateLimits.AgentRate, cfg.RateLimits.AgentBurst),
+		signingKey:   signingKey,
+		history:      NewTelemetryHistory(),
+		flushing:     make(map[string]bool),
+	}
+
+	if cfg.OIDC != nil {
+		h.oidc = newOIDCClient(*cfg.OIDC)
+		log.Printf("[Hub] OIDC login enabled with issuer %s", h.oidc.cfg.Issuer)
+	}
+
+	h.scheduler, err = NewScheduler(h, dataPath(cfg.DataDir, "schedules.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading schedules: %w", err)
+	}
+
+	h.reconciler, err = NewReconciler(h, dataPath(cfg.DataDir, "desired_states.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading desired states: %w", err)
+	}
+
+	go h.reapLoop()
+	go h.expireLoop()
+	go h.scheduler.Run()
+	go h.reconciler.Run()
+	return h, nil
 }
 
-// Register adds an agent to the hub
+// Register adds an agent to the hub, assigning an ID to an agent without one
 func (h *Hub) Register(agent *AgentConnection) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+
+	if agent.ID == "" {
+		agent.ID = h.assignID(agent.Info)
+		agent.Info.ID = agent.ID
+	}
+	// Labels edited on the middleware survive reconnects
+	if known, ok := h.registry.Get(agent.ID); ok {
+		agent.Info.CustomLabels = known.CustomLabels
+	}
+	agent.Info.Labels = protocol.MergeLabels(agent.Info.AgentLabels, agent.Info.CustomLabels)
 	h.agents[agent.ID] = agent
+	h.registry.Put(agent.Info)
 	log.Printf("[Hub] Agent registered: %s (%s)", agent.ID, agent.Info.Hostname)
 }
 
+// assignID picks the ID for a newly connected agent. Agents are identified
+// by their credential, certificate or the ID they were assigned before, so
+// they get a new one. Legacy agents can't remember their ID: they take over
+// the ID of the known shared-secret agent with the same hostname if there
+// is exactly one and it is offline, since with repeated hostnames there is
+// no telling which one it is. Callers must hold the hub lock.
+func (h *Hub) assignID(info protocol.AgentInfo) string {
+	if info.ProtocolVersion < 2 {
+		var matches []string
+		for _, known := range h.registry.List() {
+			if known.Hostname == info.Hostname &&
+				(known.Auth == "" || known.Auth == protocol.AuthSharedSecret) {
+				matches = append(matches, known.ID)
+			}
+		}
+		if len(matches) == 1 {
+			if _, online := h.agents[matches[0]]; !online {
+				return matches[0]
+			}
+		}
+	}
+	// Build a unique ID: hostname-randomsuffix
+	return fmt.Sprintf("%s-%s", info.Hostname, generateID()[:8])
+}
+
 // Unregister removes an agent and cleans up resources
 func (h *Hub) Unregister(id string) {
 	h.mu.Lock()
@@ -78,6 +358,7 @@ func (h *Hub) Unregister(id string) {
 	if err := agent.conn.Close(); err != nil {
 		log.Fatalf("[Hub] Error closing agent connection: %v", err)
 	}
+	h.registry.Put(agent.Info)
 	delete(h.agents, id)
 	log.Printf("[Hub] Agent unregistered: %s", id)
 }
@@ -90,17 +371,105 @@ func (h *Hub) GetAgent(id string) (*AgentConnection, bool) {
 	return a, ok
 }
 
-// ListAgents returns info for all connected agents
-func (h *Hub) ListAgents() []protocol.AgentInfo {
+// ListAgents returns info for all connected agents matching the selector
+func (h *Hub) ListAgents(sel Selector) []protocol.AgentInfo {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 	list := make([]protocol.AgentInfo, 0, len(h.agents))
 	for _, a := range h.agents {
-		list = append(list, a.Info)
+		if sel.Matches(agentLabels(a.Info)) {
+			info := a.Info
+			health := a.health
+			info.Health = &health
+			list = append(list, info)
+		}
 	}
 	return list
 }
 
+// SetLabels replaces the middleware-side labels of a known agent, connected
+// or not, and returns its updated info
+func (h *Hub) SetLabels(agentID string, labels map[string]string) (protocol.AgentInfo, error) {
+	if err := protocol.ValidateLabels(labels); err != nil {
+		return protocol.AgentInfo{}, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	info, ok := h.registry.Get(agentID)
+	agent, online := h.agents[agentID]
+	if online {
+		info, ok = agent.Info, true
+	}
+	if !ok {
+		return protocol.AgentInfo{}, fmt.Errorf("agent %s not found", agentID)
+	}
+
+	if len(labels) == 0 {
+		labels = nil
+	}
+	info.CustomLabels = labels
+	info.Labels = protocol.MergeLabels(info.AgentLabels, info.CustomLabels)
+	if online {
+		agent.Info = info
+	}
+	h.registry.Put(info)
+	return info, nil
+}
+
+// SelectAgents returns the connected agents matching the selector. If ids is
+// non-empty only those agents are considered; the ones not connected are
+// returned in missing.
+func (h *Hub) SelectAgents(
+	ids []string, sel Selector,
+) (agents []*AgentConnection, missing []string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(ids) == 0 {
+		for _, a := range h.agents {
+			if sel.Matches(agentLabels(a.Info)) {
+				agents = append(agents, a)
+			}
+		}
+		return agents, nil
+	}
+
+	for _, id := range ids {
+		a, ok := h.agents[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		if sel.Matches(agentLabels(a.Info)) {
+			agents = append(agents, a)
+		}
+	}
+	return agents, missing
+}
+
+// SelectOfflineAgents returns the IDs of known agents that are not connected
+// and match the selector. If ids is non-empty only those agents are considered.
+func (h *Hub) SelectOfflineAgents(ids []string, sel Selector) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var offline []string
+	for _, info := range h.registry.List() {
+		if _, online := h.agents[info.ID]; online {
+			continue
+		}
+		if len(ids) > 0 && !slices.Contains(ids, info.ID) {
+			continue
+		}
+		if sel.Matches(agentLabels(info)) {
+			offline = append(offline, info.ID)
+		}
+	}
+	return offline
+}
+
 // GetProcesses returns the cached process list for an agent
 func (h *Hub) GetProcesses(agentID string) ([]protocol.ProcessInfo, bool) {
 	agent, ok := h.GetAgent(agentID)
@@ -114,20 +483,64 @@ func (h *Hub) GetProcesses(agentID string) ([]protocol.ProcessInfo, bool) {
 	return procs, true
 }
 
-// SendCommand sends a command to an agent and waits for the response
+// GetFacts returns the host facts of a known agent, connected or not
+func (h *Hub) GetFacts(agentID string) (*protocol.HostFacts, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if agent, ok := h.agents[agentID]; ok {
+		return agent.Info.Facts, true
+	}
+	info, ok := h.registry.Get(agentID)
+	return info.Facts, ok
+}
+
+// GetServices returns the supervised services last reported by an agent
+func (h *Hub) GetServices(agentID string) ([]protocol.ServiceStatus, bool) {
+	agent, ok := h.GetAgent(agentID)
+	if !ok {
+		return nil, false
+	}
+	agent.processesMu.RLock()
+	defer agent.processesMu.RUnlock()
+	services := make([]protocol.ServiceStatus, len(agent.services))
+	copy(services, agent.services)
+	return services, true
+}
+
+// SendCommand sends a command to an agent and waits for the response.
+// A command ID is assigned if the command has none.
 func (h *Hub) SendCommand(
-	agentID, action, target string,
+	agentID string, cmd protocol.AgentCommand,
+) (*protocol.AgentCommandResponse, error) {
+	return h.sendCommand(agentID, cmd, nil)
+}
+
+// sendCommand implements SendCommand, calling onSent (if set) once the
+// command has been written to the agent's socket
+func (h *Hub) sendCommand(
+	agentID string, cmd protocol.AgentCommand, onSent func(),
 ) (*protocol.AgentCommandResponse, error) {
 	agent, ok := h.GetAgent(agentID)
 	if !ok {
 		return nil, fmt.Errorf("agent %s not found", agentID)
 	}
 
-	cmdID := generateID()
-	cmd := protocol.AgentCommand{
-		CommandID: cmdID,
-		Action:    action,
-		Target:    target,
+	h.mu.RLock()
+	supported := supportsAction(agent.Info, cmd.Action)
+	h.mu.RUnlock()
+	if !supported {
+		return nil, fmt.Errorf("agent %s does not support action %s", agentID, cmd.Action)
+	}
+
+	if cmd.CommandID == "" {
+		cmd.CommandID = generateID()
+	}
+	cmdID := cmd.CommandID
+
+	cmd.AgentID = agentID
+	cmd.ExpiresAt = time.Now().Add(commandTTL).UTC()
+	if err := protocol.SignCommand(h.signingKey, &cmd); err != nil {
+		return nil, fmt.Errorf("failed to sign command: %w", err)
 	}
 
 	// Create a channel to receive the response
@@ -152,6 +565,9 @@ func (h *Hub) SendCommand(
 	if err := agent.writeJSON(msg); err != nil {
 		return nil, fmt.Errorf("failed to send command: %w", err)
 	}
+	if onSent != nil {
+		onSent()
+	}
 
 	// Wait for response with timeout
 	select {
@@ -160,14 +576,34 @@ func (h *Hub) SendCommand(
 			return nil, fmt.Errorf("agent disconnected while waiting")
 		}
 		return &resp, nil
-	case <-time.After(10 * time.Second):
-		return nil, fmt.Errorf("command timed out after 10s")
+	case <-time.After(commandTimeout):
+		return nil, errCommandTimeout
+	}
+}
+
+// rejectAgent tells a registering agent why it is refused and closes the
+// connection. Bad and revoked credentials are reported as permanent: they
+// can't succeed on retry without new ones, so the agent backs off for long.
+func rejectAgent(conn *websocket.Conn, code, reason string) {
+	data, _ := json.Marshal(protocol.RegisterReject{
+		Code:      code,
+		Reason:    reason,
+		Permanent: code == protocol.RejectUnauthorized || code == protocol.RejectRevoked,
+	})
+	deadline := time.Now().Add(time.Second)
+	_ = conn.SetWriteDeadline(deadline)
+	_ = conn.WriteJSON(protocol.WSMessage{Type: "register_reject", Data: data})
+	closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+	if err := conn.Close(); err != nil {
+		log.Printf("[Hub] Error closing connection: %v", err)
 	}
 }
 
 // HandleAgentConnection handles the full lifecycle of an agent WebSocket
-func (h *Hub) HandleAgentConnection(conn *websocket.Conn) {
+func (h *Hub) HandleAgentConnection(conn *websocket.Conn, transport AgentTransport) {
 	// First message must be registration
+	_ = conn.SetReadDeadline(h.readDeadline(time.Now()))
 	var msg protocol.WSMessage
 	if err := conn.ReadJSON(&msg); err != nil {
 		log.Printf("[Hub] Failed to read registration: %v", err)
@@ -179,72 +615,157 @@ func (h *Hub) HandleAgentConnection(conn *websocket.Conn) {
 
 	if msg.Type != "register" {
 		log.Printf("[Hub] Expected 'register', got '%s'", msg.Type)
-		if err := conn.Close(); err != nil {
-			log.Fatalf("[Hub] Error closing connection: %v", err)
-		}
+		rejectAgent(conn, protocol.RejectInvalidPayload, "expected register, got "+msg.Type)
 		return
 	}
 
 	var reg protocol.AgentRegistration
 	if err := json.Unmarshal(msg.Data, &reg); err != nil {
 		log.Printf("[Hub] Invalid registration payload: %v", err)
-		if err := conn.Close(); err != nil {
-			log.Fatalf("[Hub] Error closing connection: %v", err)
-		}
+		rejectAgent(conn, protocol.RejectInvalidPayload, "invalid registration payload")
 		return
 	}
 
-	// Validate Agent Secret Key
-	expectedSecret := os.Getenv("AGENT_SECRET_KEY")
-	if expectedSecret == "" {
-		expectedSecret = "default-agent-secret" // Para desarrollo
+	if err := protocol.ValidateLabels(reg.Labels); err != nil {
+		log.Printf("[Hub] Invalid labels from %s: %v", reg.Hostname, err)
+		rejectAgent(conn, protocol.RejectInvalidLabels, err.Error())
+		return
 	}
 
-	if reg.SecretKey != expectedSecret {
-		log.Printf("[Hub] Unauthorized agent connection attempt from %s", reg.Hostname)
-		if err := conn.Close(); err != nil {
-			log.Fatalf("[Hub] Error closing connection: %v", err)
+	ack, caps, err := negotiate(reg)
+	if err != nil {
+		log.Printf("[Hub] Rejecting incompatible agent %s: %v", reg.Hostname, err)
+		rejectAgent(conn, protocol.RejectIncompatible, err.Error())
+		return
+	}
+	if reg.EnrollmentToken != "" && ack.ProtocolVersion < 2 {
+		rejectAgent(conn, protocol.RejectIncompatible, "enrollment requires protocol version 2")
+		return
+	}
+
+	auth, err := h.authenticateAgent(reg, transport)
+	if err != nil {
+		log.Printf("[Hub] Unauthorized agent connection attempt from %s: %v", reg.Hostname, err)
+		h.auditFailure(protocol.AuditEntry{
+			User:     reg.Hostname,
+			SourceIP: transport.SourceIP,
+			Action:   protocol.AuditAgentAuth,
+			AgentID:  transport.CertIdentity,
+			Result:   protocol.AuditResultFailure,
+			Detail:   err.Error(),
+		})
+		code := protocol.RejectUnauthorized
+		if errors.Is(err, errRevokedCredential) {
+			code = protocol.RejectRevoked
 		}
+		rejectAgent(conn, code, err.Error())
 		return
 	}
+	agentID := auth.agentID
+	if agentID != "" {
+		if _, online := h.GetAgent(agentID); online {
+			log.Printf("[Hub] Agent %s is already connected", agentID)
+			rejectAgent(conn, protocol.RejectDuplicate, "agent "+agentID+" is already connected")
+			return
+		}
+	}
 
-	// Build a unique ID: hostname-randomsuffix
-	agentID := fmt.Sprintf("%s-%s", reg.Hostname, generateID()[:8])
 	now := time.Now()
 
+	var agentVersion string
+	if reg.Facts != nil {
+		agentVersion = reg.Facts.AgentVersion
+	}
+
 	agent := &AgentConnection{
 		ID: agentID,
 		Info: protocol.AgentInfo{
-			ID:          agentID,
-			Hostname:    reg.Hostname,
-			OS:          reg.OS,
-			ConnectedAt: now,
-			LastSeen:    now,
+			ID:              agentID,
+			Hostname:        reg.Hostname,
+			OS:              reg.OS,
+			AgentLabels:     reg.Labels,
+			Facts:           reg.Facts,
+			AgentVersion:    agentVersion,
+			Encoding:        ack.Encoding,
+			Compression:     transport.Compressed,
+			Auth:            auth.method,
+			ProtocolVersion: ack.ProtocolVersion,
+			Capabilities:    &caps,
+			ConnectedAt:     now,
+			LastSeen:        now,
 		},
 		conn:    conn,
+		health:  protocol.ConnectionHealth{Status: protocol.HealthHealthy},
 		pending: make(map[string]chan protocol.AgentCommandResponse),
 	}
 
+	if auth.credential != nil {
+		agent.credentialID = auth.credential.ID
+	}
+	// Hold the write lock until the ack is out, so that commands sent as soon
+	// as the agent is registered can't reach it first
+	agent.writeMu.Lock()
 	h.Register(agent)
 	defer h.Unregister(agent.ID)
+	h.audit(protocol.AuditEntry{
+		User:     reg.Hostname,
+		SourceIP: transport.SourceIP,
+		Action:   protocol.AuditAgentAuth,
+		AgentID:  agent.ID,
+		Result:   protocol.AuditResultSuccess,
+		Detail:   auth.method,
+	})
+	if auth.credential != nil && auth.credential.AgentID == "" {
+		h.credentials.Bind(auth.credential.ID, agent.ID)
+	}
+
+	// Agents that negotiate get the assigned ID and settings back
+	if ack.ProtocolVersion > 1 {
+		ack.AgentID = agent.ID
+		ack.Credential = auth.issued
+		data, _ := json.Marshal(ack)
+		if err := conn.WriteJSON(protocol.WSMessage{Type: "register_ack", Data: data}); err != nil {
+			agent.writeMu.Unlock()
+			log.Printf("[Hub] Failed to acknowledge %s: %v", agent.ID, err)
+			if auth.issued != "" {
+				// The agent never got its credential, let it enroll again
+				h.credentials.Release(auth.credential.ID)
+			}
+			return
+		}
+	}
+	agent.writeMu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	h.startHeartbeat(agent, done)
+
+	// Deliver commands queued while the agent was offline
+	go h.flushQueue(agent.ID)
 
 	// Read loop: process incoming messages from the agent
+	throttled := false
 	for {
-		var incoming protocol.WSMessage
-		if err := conn.ReadJSON(&incoming); err != nil {
+		incoming, body, err := readMessage(conn)
+		if err != nil {
 			log.Printf("[Hub] Agent %s read error: %v", agent.ID, err)
 			return
 		}
 
+		// Agents over their message rate are slowed down by not reading
+		// from them, which pushes back through the socket
+		if waited := h.agentLimiter.Wait(agent.ID); waited > 0 && !throttled {
+			log.Printf("[Hub] Agent %s exceeds %g messages/s, throttling", agent.ID, h.cfg.RateLimits.AgentRate)
+			throttled = true
+		}
+
 		// Update last seen timestamp
-		h.mu.Lock()
-		agent.Info.LastSeen = time.Now()
-		h.mu.Unlock()
+		h.touch(agent)
 
 		switch incoming.Type {
 		case "telemetry":
 			var telemetry protocol.AgentTelemetry
-			if err := json.Unmarshal(incoming.Data, &telemetry); err != nil {
+			if err := decodePayload(incoming, body, &telemetry); err != nil {
 				log.Printf(
 					"[Hub] Bad telemetry from %s: %v",
 					agent.ID, err,
@@ -253,7 +774,56 @@ func (h *Hub) HandleAgentConnection(conn *websocket.Conn) {
 			}
 			agent.processesMu.Lock()
 			agent.processes = telemetry.Processes
+			agent.services = telemetry.Services
+			agent.seq = telemetry.Seq
+			agent.resyncing = false
 			agent.processesMu.Unlock()
+			h.history.Add(agent.ID, telemetry, false)
+
+		case "telemetry_delta":
+			var delta protocol.TelemetryDelta
+			if err := decodePayload(incoming, body, &delta); err != nil {
+				log.Printf(
+					"[Hub] Bad telemetry delta from %s: %v",
+					agent.ID, err,
+				)
+				continue
+			}
+			if telemetry, ok := h.applyDelta(agent, delta); ok {
+				h.history.Add(agent.ID, telemetry, false)
+			}
+
+		case "telemetry_batch":
+			var batch protocol.TelemetryBatch
+			if err := decodePayload(incoming, body, &batch); err != nil {
+				log.Printf(
+					"[Hub] Bad telemetry batch from %s: %v",
+					agent.ID, err,
+				)
+				continue
+			}
+			for _, telemetry := range batch.Samples {
+				h.history.Add(agent.ID, telemetry, true)
+			}
+			log.Printf(
+				"[Hub] Agent %s backfilled %d samples (%d dropped)",
+				agent.ID, len(batch.Samples), batch.Dropped,
+			)
+
+		case "facts":
+			var facts protocol.HostFacts
+			if err := json.Unmarshal(incoming.Data, &facts); err != nil {
+				log.Printf(
+					"[Hub] Bad facts from %s: %v",
+					agent.ID, err,
+				)
+				continue
+			}
+			h.mu.Lock()
+			agent.Info.Facts = &facts
+			agent.Info.AgentVersion = facts.AgentVersion
+			h.registry.Put(agent.Info)
+			h.mu.Unlock()
 
 		case "command_response":
 			var resp protocol.AgentCommandResponse
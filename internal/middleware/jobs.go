@@ -0,0 +1,445 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// maxJobHistory bounds the number of jobs kept in memory and on disk
+const maxJobHistory = 1000
+
+// expireInterval is how often deferred jobs are checked for expiry
+const expireInterval = 30 * time.Second
+
+// jobSaveDelay batches writes of the job history: a change is saved at most
+// this long after it is made, along with the changes that followed it
+const jobSaveDelay = time.Second
+
+// JobFilter narrows the jobs returned by JobStore.List
+type JobFilter struct {
+	AgentID string
+	State   string
+	Limit   int
+}
+
+// Requester identifies who asked for a command: a user or an API key,
+// possibly through a schedule or desired state they last changed
+type Requester struct {
+	Name string
+	// Via is the schedule or desired state acting on Name's behalf
+	Via string
+	// SourceIP is the client address of API requests, empty for commands
+	// the middleware starts itself
+	SourceIP string
+}
+
+// JobStore keeps the history of command jobs, persisted as a JSON file
+type JobStore struct {
+	mu    sync.RWMutex
+	jobs  map[string]*protocol.CommandJob
+	order []string // job IDs, oldest first
+	path  string
+	// saving is set while a write of the history is scheduled
+	saving bool
+	// saveMu serializes writes of the history
+	saveMu sync.Mutex
+	// onDone is called, outside the lock, with each job reaching a
+	// terminal state
+	onDone func(protocol.CommandJob)
+}
+
+// NewJobStore loads the job history from path. Jobs left unfinished by a
+// previous run are marked as failed, except those still waiting for an
+// offline agent that don't target a PID. onDone, if set, is called with
+// every job that finishes, including the ones failed here.
+func NewJobStore(path string, onDone func(protocol.CommandJob)) (*JobStore, error) {
+	s := &JobStore{
+		jobs:   make(map[string]*protocol.CommandJob),
+		path:   path,
+		onDone: onDone,
+	}
+
+	var saved []*protocol.CommandJob
+	if err := loadJSON(path, &saved); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var interrupted []protocol.CommandJob
+	for _, job := range saved {
+		switch {
+		case job.Deferred() && commandTargetsPID(job.Action):
+			// Queued by an older version; the PID can't be trusted anymore
+			job.State = protocol.JobFailed
+			job.Error = "commands targeting a PID can't be queued"
+			job.ExpiresAt = nil
+			job.CompletedAt = &now
+			interrupted = append(interrupted, *job)
+		case !job.Done() && !job.Deferred():
+			job.State = protocol.JobFailed
+			job.Error = "middleware restarted before completion"
+			job.CompletedAt = &now
+			interrupted = append(interrupted, *job)
+		}
+		s.jobs[job.ID] = job
+		s.order = append(s.order, job.ID)
+	}
+	s.finished(interrupted)
+	return s, nil
+}
+
+// finished reports jobs that reached a terminal state to onDone
+func (s *JobStore) finished(jobs []protocol.CommandJob) {
+	if s.onDone == nil {
+		return
+	}
+	for _, job := range jobs {
+		s.onDone(job)
+	}
+}
+
+// Create records a new job
+func (s *JobStore) Create(job protocol.CommandJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = &job
+	s.order = append(s.order, job.ID)
+	for len(s.order) > maxJobHistory {
+		delete(s.jobs, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.persist()
+}
+
+// Update applies fn to the job and persists the result
+func (s *JobStore) Update(id string, fn func(*protocol.CommandJob)) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	wasDone := job.Done()
+	fn(job)
+	s.persist()
+	updated := *job
+	s.mu.Unlock()
+
+	if !wasDone && updated.Done() {
+		s.finished([]protocol.CommandJob{updated})
+	}
+}
+
+// Get returns a copy of a job by ID
+func (s *JobStore) Get(id string) (protocol.CommandJob, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return protocol.CommandJob{}, false
+	}
+	return *job, true
+}
+
+// List returns the jobs matching the filter, newest first
+func (s *JobStore) List(f JobFilter) []protocol.CommandJob {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]protocol.CommandJob, 0)
+	for i := len(s.order) - 1; i >= 0; i-- {
+		job := s.jobs[s.order[i]]
+		if f.AgentID != "" && job.AgentID != f.AgentID {
+			continue
+		}
+		if f.State != "" && job.State != f.State {
+			continue
+		}
+		list = append(list, *job)
+		if f.Limit > 0 && len(list) == f.Limit {
+			break
+		}
+	}
+	return list
+}
+
+// Deferred returns the jobs waiting for the agent to reconnect, oldest first
+func (s *JobStore) Deferred(agentID string) []protocol.CommandJob {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []protocol.CommandJob
+	for _, id := range s.order {
+		job := s.jobs[id]
+		if job.AgentID == agentID && job.Deferred() {
+			list = append(list, *job)
+		}
+	}
+	return list
+}
+
+// ExpireDeferred marks the deferred jobs whose expiry has passed as expired
+func (s *JobStore) ExpireDeferred(now time.Time) {
+	s.mu.Lock()
+	var expired []protocol.CommandJob
+	for _, job := range s.jobs {
+		if job.Deferred() && now.After(*job.ExpiresAt) {
+			expire(job, now)
+			expired = append(expired, *job)
+		}
+	}
+	if len(expired) > 0 {
+		s.persist()
+	}
+	s.mu.Unlock()
+
+	s.finished(expired)
+}
+
+// Claim takes a deferred job for delivery, clearing its expiry. It returns
+// false if the job is no longer deferred or has expired (marking it so).
+func (s *JobStore) Claim(id string, now time.Time) (protocol.CommandJob, bool) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	if !ok || !job.Deferred() {
+		s.mu.Unlock()
+		return protocol.CommandJob{}, false
+	}
+	if now.After(*job.ExpiresAt) {
+		expire(job, now)
+		s.persist()
+		expired := *job
+		s.mu.Unlock()
+		s.finished([]protocol.CommandJob{expired})
+		return protocol.CommandJob{}, false
+	}
+
+	job.ExpiresAt = nil
+	claimed := *job
+	s.mu.Unlock()
+	// Saved right away, so that the job isn't delivered again if the
+	// middleware restarts
+	s.flush()
+	return claimed, true
+}
+
+func expire(job *protocol.CommandJob, now time.Time) {
+	job.State = protocol.JobExpired
+	job.Error = "agent did not reconnect before the command expired"
+	job.CompletedAt = &now
+}
+
+// persist schedules a write of the job history. Callers must hold the lock.
+func (s *JobStore) persist() {
+	if s.path == "" || s.saving {
+		return
+	}
+	s.saving = true
+	time.AfterFunc(jobSaveDelay, s.flush)
+}
+
+// flush writes the job history to disk. Jobs are copied under the lock and
+// written outside it.
+func (s *JobStore) flush() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	s.saving = false
+	list := make([]protocol.CommandJob, 0, len(s.order))
+	for _, id := range s.order {
+		list = append(list, *s.jobs[id])
+	}
+	s.mu.Unlock()
+
+	if err := saveJSON(s.path, list); err != nil {
+		log.Printf("[Jobs] Failed to persist job history: %v", err)
+	}
+}
+
+// newJob records a queued job for the command and returns it. If queueTTL is
+// positive and the agent is known but offline, the job is deferred until the
+// agent reconnects or the TTL elapses, unless it targets a PID.
+func (h *Hub) newJob(
+	agentID string, cmd protocol.AgentCommand, requester Requester, queueTTL time.Duration,
+) protocol.CommandJob {
+	job := protocol.CommandJob{
+		ID:        generateID(),
+		AgentID:   agentID,
+		Action:    cmd.Action,
+		Target:    cmd.Target,
+		Signal:    cmd.Signal,
+		Args:      cmd.Args,
+		Service:   cmd.Service,
+		State:     protocol.JobQueued,
+		Requester: requester.Name,
+		Via:       requester.Via,
+		SourceIP:  requester.SourceIP,
+		CreatedAt: time.Now(),
+	}
+	if agent, ok := h.GetAgent(agentID); ok {
+		h.mu.RLock()
+		job.Hostname = agent.Info.Hostname
+		h.mu.RUnlock()
+		if commandTargetsPID(cmd.Action) {
+			job.ProcessName = agent.processName(cmd.Target)
+		}
+	} else if info, known := h.registry.Get(agentID); known {
+		job.Hostname = info.Hostname
+		if queueTTL > 0 && !commandTargetsPID(cmd.Action) {
+			expiresAt := job.CreatedAt.Add(queueTTL)
+			job.ExpiresAt = &expiresAt
+		}
+	}
+	h.jobs.Create(job)
+	return job
+}
+
+// runJob sends the job's command and records its outcome. Deferred jobs are
+// left queued for delivery on reconnect.
+func (h *Hub) runJob(job protocol.CommandJob) protocol.CommandJob {
+	if job.Deferred() {
+		// The agent may have reconnected since the job was created
+		if _, ok := h.GetAgent(job.AgentID); ok {
+			go h.flushQueue(job.AgentID)
+		}
+		return job
+	}
+	return h.deliverJob(job)
+}
+
+// deliverJob sends the job's command to the agent and records its outcome
+func (h *Hub) deliverJob(job protocol.CommandJob) protocol.CommandJob {
+	cmd := protocol.AgentCommand{
+		CommandID: job.ID,
+		Action:    job.Action,
+		Target:    job.Target,
+		Signal:    job.Signal,
+		Args:      job.Args,
+		Service:   job.Service,
+	}
+
+	resp, err := h.sendCommand(job.AgentID, cmd, func() {
+		h.jobs.Update(job.ID, func(j *protocol.CommandJob) {
+			now := time.Now()
+			j.State = protocol.JobSent
+			j.SentAt = &now
+		})
+	})
+
+	h.jobs.Update(job.ID, func(j *protocol.CommandJob) {
+		now := time.Now()
+		j.CompletedAt = &now
+		switch {
+		case errors.Is(err, errCommandTimeout):
+			j.State = protocol.JobTimedOut
+			j.Error = err.Error()
+		case err != nil:
+			j.State = protocol.JobFailed
+			j.Error = err.Error()
+		case resp.Success:
+			j.State = protocol.JobSucceeded
+			j.Response = resp
+		default:
+			j.State = protocol.JobFailed
+			j.Response = resp
+		}
+	})
+
+	done, _ := h.jobs.Get(job.ID)
+	return done
+}
+
+// RunCommand records a job for the command and waits for it to finish.
+// A job deferred for an offline agent is returned while still queued.
+func (h *Hub) RunCommand(
+	agentID string, cmd protocol.AgentCommand, requester Requester, queueTTL time.Duration,
+) protocol.CommandJob {
+	return redactJob(h.runJob(h.newJob(agentID, cmd, requester, queueTTL)))
+}
+
+// SubmitCommand records a job for the command and runs it in the background,
+// returning the queued job immediately
+func (h *Hub) SubmitCommand(
+	agentID string, cmd protocol.AgentCommand, requester Requester, queueTTL time.Duration,
+) protocol.CommandJob {
+	job := h.newJob(agentID, cmd, requester, queueTTL)
+	go h.runJob(job)
+	return redactJob(job)
+}
+
+// flushQueue delivers the agent's deferred jobs in order while it stays
+// connected. Only one flush runs per agent at a time.
+func (h *Hub) flushQueue(agentID string) {
+	h.mu.Lock()
+	if h.flushing[agentID] {
+		h.mu.Unlock()
+		return
+	}
+	h.flushing[agentID] = true
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.flushing, agentID)
+		h.mu.Unlock()
+	}()
+
+	for {
+		queued := h.jobs.Deferred(agentID)
+		if len(queued) == 0 {
+			return
+		}
+		for _, job := range queued {
+			if _, ok := h.GetAgent(agentID); !ok {
+				return
+			}
+
+			claimed, ok := h.jobs.Claim(job.ID, time.Now())
+			if !ok {
+				continue
+			}
+
+			log.Printf("[Hub] Delivering queued command %s to %s", job.ID, agentID)
+			h.deliverJob(claimed)
+		}
+	}
+}
+
+// expireLoop periodically expires deferred jobs whose TTL has elapsed
+func (h *Hub) expireLoop() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.jobs.ExpireDeferred(now)
+	}
+}
+
+// GetJob returns a command job by ID
+func (h *Hub) GetJob(id string) (protocol.CommandJob, bool) {
+	job, ok := h.jobs.Get(id)
+	return redactJob(job), ok
+}
+
+// ListJobs returns the command jobs matching the filter, newest first
+func (h *Hub) ListJobs(f JobFilter) []protocol.CommandJob {
+	jobs := h.jobs.List(f)
+	for i := range jobs {
+		jobs[i] = redactJob(jobs[i])
+	}
+	return jobs
+}
+
+// redactJob hides the environment of a service job's spec. The job store
+// keeps it whole, since deferred jobs are delivered from it.
+func redactJob(job protocol.CommandJob) protocol.CommandJob {
+	if job.Service != nil {
+		spec := job.Service.Redacted()
+		job.Service = &spec
+	}
+	return job
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// Settings the hub can offer, in order of preference
+var (
+	hubEncodings = []string{protocol.EncodingJSON, protocol.EncodingBinary}
+	hubTelemetry = []string{protocol.FeatureDelta, protocol.FeatureBackfill}
+)
+
+// legacyCapabilities are assumed for agents that predate negotiation, which
+// only stop processes and speak JSON
+var legacyCapabilities = protocol.Capabilities{
+	Actions:   []string{protocol.ActionStop},
+	Encodings: []string{protocol.EncodingJSON},
+}
+
+// negotiate checks that the hub can talk to a registering agent and picks
+// the settings for the connection. The error explains why an incompatible
+// agent is rejected.
+func negotiate(reg protocol.AgentRegistration) (protocol.RegisterAck, protocol.Capabilities, error) {
+	version := max(reg.ProtocolVersion, 1)
+	if version < protocol.MinProtocolVersion || version > protocol.ProtocolVersion {
+		return protocol.RegisterAck{}, protocol.Capabilities{}, fmt.Errorf(
+			"unsupported protocol version %d, middleware supports %d to %d",
+			version, protocol.MinProtocolVersion, protocol.ProtocolVersion,
+		)
+	}
+
+	caps := legacyCapabilities
+	if reg.Capabilities != nil {
+		caps = *reg.Capabilities
+	} else if version > 1 {
+		return protocol.RegisterAck{}, protocol.Capabilities{}, fmt.Errorf(
+			"protocol version %d requires capabilities", version,
+		)
+	}
+
+	ack := protocol.RegisterAck{ProtocolVersion: version}
+
+	// Use the agent's preferred encoding if both sides support it
+	switch {
+	case reg.Encoding != "" && slices.Contains(hubEncodings, reg.Encoding) && slices.Contains(caps.Encodings, reg.Encoding):
+		ack.Encoding = reg.Encoding
+	default:
+		for _, enc := range hubEncodings {
+			if slices.Contains(caps.Encodings, enc) {
+				ack.Encoding = enc
+				break
+			}
+		}
+	}
+	if ack.Encoding == "" {
+		return protocol.RegisterAck{}, protocol.Capabilities{}, fmt.Errorf(
+			"no common encoding, middleware supports %v", hubEncodings,
+		)
+	}
+
+	for _, feature := range hubTelemetry {
+		if slices.Contains(caps.Telemetry, feature) {
+			ack.Telemetry = append(ack.Telemetry, feature)
+		}
+	}
+	return ack, caps, nil
+}
+
+// supportsAction reports whether an agent can execute a command action
+func supportsAction(info protocol.AgentInfo, action string) bool {
+	return info.Capabilities == nil || slices.Contains(info.Capabilities.Actions, action)
+}
+
+// upgradeRecorder captures the upgrade response written to the hijacked
+// connection, which tells which WebSocket extensions were negotiated
+type upgradeRecorder struct {
+	http.ResponseWriter
+	response []byte
+}
+
+func (u *upgradeRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := u.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &recordingConn{Conn: conn, recorder: u}, brw, nil
+}
+
+// recordingConn copies the first write, the upgrade response, to its recorder
+type recordingConn struct {
+	net.Conn
+	recorder *upgradeRecorder
+	written  bool
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	if !c.written {
+		c.written = true
+		c.recorder.response = append(c.recorder.response, p...)
+	}
+	return c.Conn.Write(p)
+}
+
+// deflateNegotiated reports whether the recorded upgrade response accepted
+// the permessage-deflate extension
+func (u *upgradeRecorder) deflateNegotiated() bool {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(u.response)), nil)
+	if err != nil {
+		return false
+	}
+	for _, v := range resp.Header.Values("Sec-WebSocket-Extensions") {
+		for ext := range strings.SplitSeq(v, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,518 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+const (
+	// oidcLoginTTL is how long a user has to complete a login at the IdP
+	oidcLoginTTL = 10 * time.Minute
+	// maxPendingLogins bounds the logins in progress, as starting one needs
+	// no authentication
+	maxPendingLogins = 10000
+	// jwksRefreshInterval limits how often the JWKS is refetched when a token
+	// names an unknown key
+	jwksRefreshInterval = time.Minute
+)
+
+// OIDCProvider is the name external users from the OIDC provider are
+// recorded with in the user store
+const OIDCProvider = "oidc"
+
+// oidcStateCookie holds the state of a login in progress, binding it to the
+// browser that started it
+const oidcStateCookie = "oidc_state"
+
+var errNoRoleMapped = errors.New("none of your groups grants access")
+
+// OIDCConfig configures login through an OpenID Connect provider
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL; its discovery document is read
+	// from <Issuer>/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the middleware's callback, /api/oidc/callback, as
+	// registered with the provider
+	RedirectURL string
+	// Scopes are requested in addition to openid
+	Scopes []string
+	// UsernameClaim names the ID token claim used as the username of new
+	// users, falling back to email if it is verified and then sub. Users are
+	// then recognized by their issuer and sub, so the username doesn't change
+	// with the claim.
+	UsernameClaim string
+	// GroupsClaim names the ID token claim listing the user's groups
+	GroupsClaim string
+	// RoleMappings maps groups to roles; users get the highest role of
+	// their groups, or DefaultRole if none matches. An empty DefaultRole
+	// denies them.
+	RoleMappings map[string]string
+	DefaultRole  string
+}
+
+// ParseRoleMappings parses comma-separated "group=role" pairs
+func ParseRoleMappings(spec string) (map[string]string, error) {
+	mappings := make(map[string]string)
+	for pair := range strings.SplitSeq(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" {
+			return nil, fmt.Errorf("invalid role mapping %q, expected group=role", pair)
+		}
+		if _, ok := protocol.RolePermissions[role]; !ok {
+			return nil, fmt.Errorf("unknown role %q in mapping %q", role, pair)
+		}
+		mappings[group] = role
+	}
+	return mappings, nil
+}
+
+// roleRank orders roles by privilege
+var roleRank = map[string]int{
+	protocol.RoleViewer:   1,
+	protocol.RoleOperator: 2,
+	protocol.RoleAdmin:    3,
+}
+
+// oidcDiscovery is the part of the discovery document the middleware uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// pendingLogin is a login started at /api/oidc/login, keyed by its state
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	redirect string
+	expires  time.Time
+}
+
+// oidcClient runs the authorization code flow with PKCE against the
+// provider and verifies the ID tokens it returns
+type oidcClient struct {
+	cfg  OIDCConfig
+	http *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	pending     map[string]pendingLogin
+}
+
+func newOIDCClient(cfg OIDCConfig) *oidcClient {
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &oidcClient{
+		cfg:     cfg,
+		http:    &http.Client{Timeout: 10 * time.Second},
+		pending: make(map[string]pendingLogin),
+	}
+}
+
+// getJSON fetches a JSON document
+func (c *oidcClient) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// provider returns the discovery document, fetching it on first use
+func (c *oidcClient) provider(ctx context.Context) (*oidcDiscovery, error) {
+	c.mu.Lock()
+	d := c.discovery
+	c.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	d = &oidcDiscovery{}
+	if err := c.getJSON(ctx, c.cfg.Issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != c.cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q doesn't match %q", d.Issuer, c.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery: missing endpoints")
+	}
+
+	c.mu.Lock()
+	c.discovery = d
+	c.mu.Unlock()
+	return d, nil
+}
+
+// randomString returns n random bytes, base64url encoded
+func randomString(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// safeRedirect reports whether a post-login redirect is a path on this
+// site, which the tokens can be appended to as a fragment
+func safeRedirect(redirect string) bool {
+	return strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") &&
+		!strings.ContainsAny(redirect, "\\#")
+}
+
+// authCodeURL starts a login and returns the provider URL to send the user
+// to, along with the login's state. redirect is where the user ends up once
+// logged in.
+func (c *oidcClient) authCodeURL(ctx context.Context, redirect string) (string, string, error) {
+	d, err := c.provider(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, nonce, verifier := randomString(24), randomString(24), randomString(48)
+	challenge := sha256.Sum256([]byte(verifier))
+
+	c.mu.Lock()
+	now := time.Now()
+	if len(c.pending) >= maxPendingLogins {
+		for s, p := range c.pending {
+			if now.After(p.expires) {
+				delete(c.pending, s)
+			}
+		}
+	}
+	if len(c.pending) >= maxPendingLogins {
+		c.mu.Unlock()
+		return "", "", errors.New("too many logins in progress")
+	}
+	c.pending[state] = pendingLogin{
+		verifier: verifier,
+		nonce:    nonce,
+		redirect: redirect,
+		expires:  now.Add(oidcLoginTTL),
+	}
+	c.mu.Unlock()
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.cfg.ClientID},
+		"redirect_uri":          {c.cfg.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, c.cfg.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// stateCookie returns the cookie holding a login's state, which expires
+// after maxAge seconds; a negative maxAge deletes it
+func (c *oidcClient) stateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:  oidcStateCookie,
+		Value: state,
+		Path:  "/api/oidc/callback",
+		// Lax still sends it on the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+		Secure:   strings.HasPrefix(c.cfg.RedirectURL, "https://"),
+		HttpOnly: true,
+		MaxAge:   maxAge,
+	}
+}
+
+// oidcIdentity is what the middleware takes from a verified ID token
+type oidcIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Groups   []string
+	Redirect string
+}
+
+// exchange completes a login: it redeems the authorization code for an ID
+// token and verifies it
+func (c *oidcClient) exchange(ctx context.Context, state, code string) (oidcIdentity, error) {
+	c.mu.Lock()
+	login, ok := c.pending[state]
+	delete(c.pending, state)
+	c.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return oidcIdentity{}, errors.New("unknown or expired login, start again")
+	}
+
+	d, err := c.provider(ctx)
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.cfg.RedirectURL},
+		"code_verifier": {login.verifier},
+	}
+	if c.cfg.ClientSecret == "" {
+		form.Set("client_id", c.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return oidcIdentity{}, fmt.Errorf("OIDC token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return oidcIdentity{}, fmt.Errorf("OIDC token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return oidcIdentity{}, fmt.Errorf("OIDC token request failed: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+
+	claims, err := c.verify(ctx, tokens.IDToken, login.nonce)
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	id := oidcIdentity{Issuer: c.cfg.Issuer, Redirect: login.redirect}
+	id.Subject, _ = claims["sub"].(string)
+	for _, name := range []string{c.cfg.UsernameClaim, "email", "sub"} {
+		// Unverified addresses can be set to anything at some providers
+		if name == "email" && !emailVerified(claims) {
+			continue
+		}
+		if v, _ := claims[name].(string); v != "" {
+			id.Username = v
+			break
+		}
+	}
+	switch groups := claims[c.cfg.GroupsClaim].(type) {
+	case []any:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	case string:
+		id.Groups = strings.Fields(groups)
+	}
+	return id, nil
+}
+
+// verify checks an ID token's signature against the provider's JWKS, its
+// issuer, audience, expiry and nonce
+func (c *oidcClient) verify(ctx context.Context, idToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return c.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(c.cfg.Issuer),
+		jwt.WithAudience(c.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("invalid ID token: missing sub")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("invalid ID token: nonce mismatch")
+	}
+	// With several audiences, the token must have been issued to us
+	if azp, ok := claims["azp"].(string); ok && azp != c.cfg.ClientID {
+		return nil, errors.New("invalid ID token: issued to another client")
+	}
+	return claims, nil
+}
+
+// emailVerified reports whether the provider vouches for the email claim.
+// Some providers send email_verified as a string.
+func emailVerified(claims jwt.MapClaims) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// key returns the provider's signing key with the given ID, refetching the
+// JWKS when the key is unknown so provider key rotation is picked up
+func (c *oidcClient) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	stale := time.Since(c.keysFetched) >= jwksRefreshInterval
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	d, err := c.provider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := c.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if pub, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = pub
+		}
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.keysFetched = time.Now()
+	key, ok = keys[kid]
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// jsonWebKey is an RSA or EC public key from a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC point")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, slices.Concat([]byte{4}, x, y))
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// mapRole returns the highest role granted by the user's groups
+func (c *oidcClient) mapRole(groups []string) (string, error) {
+	role := c.cfg.DefaultRole
+	for _, g := range groups {
+		if r, ok := c.cfg.RoleMappings[g]; ok && roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+	if role == "" {
+		return "", errNoRoleMapped
+	}
+	return role, nil
+}
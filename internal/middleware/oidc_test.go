@@ -0,0 +1,494 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+const (
+	testClientID     = "monitor"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "https://monitor.example/api/oidc/callback"
+)
+
+// testIdP is an in-process OpenID provider. Its authorization endpoint is
+// driven directly by the tests through authorize, which logs the user in
+// without a form; the token endpoint checks the client, redirect URI and
+// PKCE verifier before issuing an ID token.
+type testIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu sync.Mutex
+	// keys are published in the JWKS; tokens are signed with signKID
+	keys        map[string]*ecdsa.PrivateKey
+	signKID     string
+	jwksFetches int
+	// discoveryIssuer overrides the issuer in the discovery document
+	discoveryIssuer string
+	codes           map[string]idpAuthRequest
+	// claims override the ID token's defaults; nil values remove them
+	claims jwt.MapClaims
+}
+
+// idpAuthRequest is an authorization request a code was issued for
+type idpAuthRequest struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	idp := &testIdP{
+		t:     t,
+		keys:  make(map[string]*ecdsa.PrivateKey),
+		codes: make(map[string]idpAuthRequest),
+	}
+	idp.rotate("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /jwks", idp.jwks)
+	mux.HandleFunc("POST /token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// rotate signs new tokens with a fresh key, published alongside the old ones
+func (idp *testIdP) rotate(kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		idp.t.Fatalf("generating key: %v", err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys[kid] = key
+	idp.signKID = kid
+}
+
+// retire stops publishing a key
+func (idp *testIdP) retire(kid string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	delete(idp.keys, kid)
+}
+
+func (idp *testIdP) setClaims(claims jwt.MapClaims) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+func (idp *testIdP) fetches() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.jwksFetches
+}
+
+func (idp *testIdP) discovery(w http.ResponseWriter, _ *http.Request) {
+	idp.mu.Lock()
+	issuer := idp.discoveryIssuer
+	idp.mu.Unlock()
+	if issuer == "" {
+		issuer = idp.server.URL
+	}
+	_ = json.NewEncoder(w).Encode(oidcDiscovery{
+		Issuer:                issuer,
+		AuthorizationEndpoint: idp.server.URL + "/authorize",
+		TokenEndpoint:         idp.server.URL + "/token",
+		JWKSURI:               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *testIdP) jwks(w http.ResponseWriter, _ *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.jwksFetches++
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	for kid, key := range idp.keys {
+		point, _ := key.PublicKey.Bytes()
+		set.Keys = append(set.Keys, jsonWebKey{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+			Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+		})
+	}
+	_ = json.NewEncoder(w).Encode(set)
+}
+
+// authorize plays the user logging in at the authorization URL and returns
+// the state and code the provider redirects back with
+func (idp *testIdP) authorize(authURL string) (state, code string) {
+	idp.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		idp.t.Fatalf("invalid authorization URL %q: %v", authURL, err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("response_type") != "code" || q.Get("client_id") != testClientID {
+		idp.t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		idp.t.Fatalf("authorization request without an S256 PKCE challenge: %s", authURL)
+	}
+
+	code = randomString(16)
+	idp.mu.Lock()
+	idp.codes[code] = idpAuthRequest{
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+	}
+	idp.mu.Unlock()
+	return q.Get("state"), code
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if id, secret, _ := r.BasicAuth(); id != testClientID || secret != testClientSecret {
+		fail("invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		fail("unsupported_grant_type")
+		return
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	req, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	if !ok || req.redirectURI != r.PostFormValue("redirect_uri") {
+		fail("invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != req.challenge {
+		fail("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                idp.server.URL,
+		"sub":                "user-1",
+		"aud":                testClientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              req.nonce,
+		"preferred_username": "alice",
+		"groups":             []string{"sre"},
+	}
+	for name, v := range idp.claims {
+		if v == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = v
+		}
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	tok.Header["kid"] = idp.signKID
+	signed, err := tok.SignedString(idp.keys[idp.signKID])
+	if err != nil {
+		idp.t.Errorf("signing ID token: %v", err)
+		fail("server_error")
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+func newOIDCTestHub(t *testing.T, idp *testIdP) *Hub {
+	t.Helper()
+	hub, err := NewHub(HubConfig{OIDC: &OIDCConfig{
+		Issuer:       idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		RoleMappings: map[string]string{"sre": protocol.RoleOperator},
+	}})
+	if err != nil {
+		t.Fatalf("NewHub: %v", err)
+	}
+	return hub
+}
+
+// startOIDCLogin calls the login handler and returns the authorization URL
+// and the cookies it set
+func startOIDCLogin(t *testing.T, hub *Hub) (string, []*http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	oidcLoginHandler(hub)(w, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got status %d, want %d: %s", w.Code, http.StatusFound, w.Body)
+	}
+	return w.Header().Get("Location"), w.Result().Cookies()
+}
+
+// oidcCallback calls the callback handler as the provider's redirect would
+func oidcCallback(hub *Hub, state, code string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	q := url.Values{"state": {state}, "code": {code}}
+	r := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?"+q.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	oidcCallbackHandler(hub)(w, r)
+	return w
+}
+
+// oidcLogin runs a whole login in one browser
+func oidcLogin(t *testing.T, hub *Hub, idp *testIdP) *httptest.ResponseRecorder {
+	t.Helper()
+	authURL, cookies := startOIDCLogin(t, hub)
+	state, code := idp.authorize(authURL)
+	return oidcCallback(hub, state, code, cookies)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	hub := newOIDCTestHub(t, idp)
+
+	authURL, cookies := startOIDCLogin(t, hub)
+	var stateCookie *http.Cookie
+	for _, c := range cookies {
+		if c.Name == oidcStateCookie {
+			stateCookie = c
+		}
+	}
+	if stateCookie == nil || !stateCookie.HttpOnly || !stateCookie.Secure {
+		t.Fatalf("login didn't set an HttpOnly, Secure state cookie: %v", cookies)
+	}
+
+	state, code := idp.authorize(authURL)
+	w := oidcCallback(hub, state, code, cookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback: got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp struct {
+		Data protocol.LoginResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Data.Token == "" {
+		t.Fatalf("callback returned no token: %s", w.Body)
+	}
+
+	user, ok := hub.users.Get("alice")
+	if !ok {
+		t.Fatal("user alice wasn't created")
+	}
+	if user.Role != protocol.RoleOperator || user.Provider != OIDCProvider ||
+		user.Issuer != idp.server.URL || user.Subject != "user-1" {
+		t.Errorf("unexpected user %+v", user)
+	}
+
+	// The code and state can't be used again
+	if w := oidcCallback(hub, state, code, cookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed callback: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.discoveryIssuer = "https://evil.example"
+	hub := newOIDCTestHub(t, idp)
+
+	w := httptest.NewRecorder()
+	oidcLoginHandler(hub)(w, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	idp := newTestIdP(t)
+	hub := newOIDCTestHub(t, idp)
+
+	// An attacker starts a login and gets the victim's browser to complete
+	// it, which has no cookie or the cookie of another login
+	authURL, _ := startOIDCLogin(t, hub)
+	state, code := idp.authorize(authURL)
+	if w := oidcCallback(hub, state, code, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("without cookie: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	authURL, _ = startOIDCLogin(t, hub)
+	state, code = idp.authorize(authURL)
+	_, victimCookies := startOIDCLogin(t, hub)
+	if w := oidcCallback(hub, state, code, victimCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("with another login's cookie: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if _, ok := hub.users.Get("alice"); ok {
+		t.Error("user was logged in without a matching state cookie")
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	idp := newTestIdP(t)
+	hub := newOIDCTestHub(t, idp)
+
+	// A code intercepted from the victim's login can't be redeemed in the
+	// attacker's own login, whose verifier doesn't match its challenge
+	victimURL, _ := startOIDCLogin(t, hub)
+	_, stolenCode := idp.authorize(victimURL)
+
+	attackerURL, attackerCookies := startOIDCLogin(t, hub)
+	state, _ := idp.authorize(attackerURL)
+	if w := oidcCallback(hub, state, stolenCode, attackerCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"wrong nonce", jwt.MapClaims{"nonce": "another"}},
+		{"missing nonce", jwt.MapClaims{"nonce": nil}},
+		{"wrong audience", jwt.MapClaims{"aud": "another-client"}},
+		{"issued to another client", jwt.MapClaims{"aud": []string{testClientID, "another-client"}, "azp": "another-client"}},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example"}},
+		{"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}},
+		{"missing expiry", jwt.MapClaims{"exp": nil}},
+		{"missing subject", jwt.MapClaims{"sub": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			hub := newOIDCTestHub(t, idp)
+			idp.setClaims(tt.claims)
+
+			if w := oidcLogin(t, hub, idp); w.Code != http.StatusUnauthorized {
+				t.Errorf("got status %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body)
+			}
+		})
+	}
+
+	t.Run("several audiences", func(t *testing.T) {
+		idp := newTestIdP(t)
+		hub := newOIDCTestHub(t, idp)
+		idp.setClaims(jwt.MapClaims{"aud": []string{testClientID, "another-client"}, "azp": testClientID})
+
+		if w := oidcLogin(t, hub, idp); w.Code != http.StatusOK {
+			t.Errorf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+	})
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	hub := newOIDCTestHub(t, idp)
+
+	if w := oidcLogin(t, hub, idp); w.Code != http.StatusOK {
+		t.Fatalf("first login: got status %d: %s", w.Code, w.Body)
+	}
+
+	// Right after a fetch, an unknown key doesn't trigger another one
+	idp.rotate("key-2")
+	idp.retire("key-1")
+	if w := oidcLogin(t, hub, idp); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown key within the refresh interval: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if n := idp.fetches(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+
+	hub.oidc.mu.Lock()
+	hub.oidc.keysFetched = time.Now().Add(-jwksRefreshInterval)
+	hub.oidc.mu.Unlock()
+	if w := oidcLogin(t, hub, idp); w.Code != http.StatusOK {
+		t.Errorf("rotated key: got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if n := idp.fetches(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+}
+
+func TestOIDCUsername(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   string
+	}{
+		{"username claim", jwt.MapClaims{}, "alice"},
+		{"verified email", jwt.MapClaims{"preferred_username": nil, "email": "a@example.com", "email_verified": true}, "a@example.com"},
+		{"verified email as string", jwt.MapClaims{"preferred_username": nil, "email": "a@example.com", "email_verified": "true"}, "a@example.com"},
+		{"unverified email", jwt.MapClaims{"preferred_username": nil, "email": "a@example.com", "email_verified": false}, "user-1"},
+		{"email without verification", jwt.MapClaims{"preferred_username": nil, "email": "a@example.com"}, "user-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			hub := newOIDCTestHub(t, idp)
+			idp.setClaims(tt.claims)
+
+			if w := oidcLogin(t, hub, idp); w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			if _, ok := hub.users.Get(tt.want); !ok {
+				t.Errorf("user %s wasn't created, users: %+v", tt.want, hub.users.List())
+			}
+		})
+	}
+}
+
+func TestOIDCUsersKeyedBySubject(t *testing.T) {
+	idp := newTestIdP(t)
+	hub := newOIDCTestHub(t, idp)
+
+	if w := oidcLogin(t, hub, idp); w.Code != http.StatusOK {
+		t.Fatalf("first login: got status %d: %s", w.Code, w.Body)
+	}
+
+	// Another identity claiming the same username doesn't get the account
+	idp.setClaims(jwt.MapClaims{"sub": "user-2"})
+	if w := oidcLogin(t, hub, idp); w.Code != http.StatusForbidden {
+		t.Errorf("other subject: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// The same identity keeps its account when its username claim changes
+	idp.setClaims(jwt.MapClaims{"preferred_username": "bob"})
+	if w := oidcLogin(t, hub, idp); w.Code != http.StatusOK {
+		t.Fatalf("renamed login: got status %d: %s", w.Code, w.Body)
+	}
+	if _, ok := hub.users.Get("bob"); ok {
+		t.Error("renaming the username claim created a new user")
+	}
+	if users := hub.users.List(); len(users) != 1 {
+		t.Errorf("got %d users, want 1", len(users))
+	}
+
+	// Local users can't be taken over either
+	if _, err := hub.users.Create(protocol.UserRequest{Username: "carol", Password: "password123", Role: protocol.RoleViewer}, "admin"); err != nil {
+		t.Fatalf("creating local user: %v", err)
+	}
+	idp.setClaims(jwt.MapClaims{"sub": "user-3", "preferred_username": "carol"})
+	if w := oidcLogin(t, hub, idp); w.Code != http.StatusForbidden {
+		t.Errorf("local username: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
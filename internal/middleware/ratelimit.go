@@ -0,0 +1,316 @@
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// Rate limit defaults
+const (
+	defaultLoginUserFailures = 5
+	defaultLoginIPFailures   = 20
+	defaultLoginBaseDelay    = time.Second
+	defaultLoginMaxDelay     = 15 * time.Minute
+	defaultAPIRate           = 20
+	defaultAPIBurst          = 60
+	defaultIPRate            = 50
+	defaultIPBurst           = 150
+	defaultAgentRate         = 50
+	defaultAgentBurst        = 500
+)
+
+// loginFailureWindow is how long failed logins are remembered once any
+// lockout has ended
+const loginFailureWindow = time.Hour
+
+// pruneInterval is how often idle limiter state is dropped
+const pruneInterval = time.Minute
+
+var errLoginLocked = errors.New("locked out after too many failed logins")
+
+// RateLimits configures request throttling. Zero values take the defaults;
+// a negative rate disables that limiter.
+type RateLimits struct {
+	// LoginUserFailures failed logins per username, and LoginIPFailures per
+	// client address, are allowed before each further failure locks the
+	// username or address out for a delay doubling from LoginBaseDelay up to
+	// LoginMaxDelay
+	LoginUserFailures int
+	LoginIPFailures   int
+	LoginBaseDelay    time.Duration
+	LoginMaxDelay     time.Duration
+
+	// APIRate is the sustained requests per second allowed to each user or
+	// API key on authenticated routes, with bursts of up to APIBurst
+	APIRate  float64
+	APIBurst int
+
+	// IPRate is the sustained requests per second allowed from each client
+	// address on API routes, checked before authentication so that bad
+	// tokens and login endpoints are throttled too, with bursts of up to
+	// IPBurst
+	IPRate  float64
+	IPBurst int
+
+	// AgentRate is the sustained messages per second read from each agent,
+	// with bursts of up to AgentBurst. Faster agents are slowed down, not
+	// disconnected.
+	AgentRate  float64
+	AgentBurst int
+}
+
+func (l *RateLimits) setDefaults() {
+	if l.LoginUserFailures <= 0 {
+		l.LoginUserFailures = defaultLoginUserFailures
+	}
+	if l.LoginIPFailures <= 0 {
+		l.LoginIPFailures = defaultLoginIPFailures
+	}
+	if l.LoginBaseDelay <= 0 {
+		l.LoginBaseDelay = defaultLoginBaseDelay
+	}
+	if l.LoginMaxDelay <= 0 {
+		l.LoginMaxDelay = defaultLoginMaxDelay
+	}
+	if l.APIRate == 0 {
+		l.APIRate = defaultAPIRate
+	}
+	if l.APIBurst <= 0 {
+		l.APIBurst = defaultAPIBurst
+	}
+	if l.IPRate == 0 {
+		l.IPRate = defaultIPRate
+	}
+	if l.IPBurst <= 0 {
+		l.IPBurst = defaultIPBurst
+	}
+	if l.AgentRate == 0 {
+		l.AgentRate = defaultAgentRate
+	}
+	if l.AgentBurst <= 0 {
+		l.AgentBurst = defaultAgentBurst
+	}
+}
+
+// bucket is a token bucket: it holds up to burst tokens, refilled at rate
+// per second, and each event takes one
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket and takes a token, returning how long until one is
+// available if it is empty
+func (b *bucket) take(now time.Time, rate float64, burst int) time.Duration {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// RateLimiter is a set of token buckets, one per key. A nil RateLimiter
+// allows everything.
+type RateLimiter struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate events per second per key,
+// in bursts of up to burst. A rate that isn't positive returns nil, which
+// disables limiting.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: rate, burst: max(burst, 1), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token for key, returning how long to wait before retrying if
+// none is left
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	wait := b.take(now, l.rate, l.burst)
+	return wait == 0, wait
+}
+
+// Wait blocks until key has a token, reserving it. It returns how long it
+// waited.
+func (l *RateLimiter) Wait(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.prune(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	wait := b.take(now, l.rate, l.burst)
+	if wait > 0 {
+		// Reserve the token that will be available after waiting
+		b.tokens--
+	}
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+	return wait
+}
+
+// prune drops the buckets that have refilled, which behave like new ones.
+// Callers must hold the lock.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// loginFailures is the failed login record of a username or address
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// LoginLimiter throttles password guessing. Failed logins are counted per
+// username and per client address; past a number of free failures, each
+// further one locks the username or address out for a delay that doubles
+// with every failure.
+type LoginLimiter struct {
+	limits RateLimits
+
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	lastPrune time.Time
+}
+
+// NewLoginLimiter returns a login limiter with the given limits
+func NewLoginLimiter(limits RateLimits) *LoginLimiter {
+	limits.setDefaults()
+	return &LoginLimiter{limits: limits, failures: make(map[string]*loginFailures)}
+}
+
+func userKey(username string) string { return "user:" + username }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+// Locked returns how long logins for username from ip are locked out, zero
+// if they aren't
+func (l *LoginLimiter) Locked(ip, username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range []string{ipKey(ip), userKey(username)} {
+		if f, ok := l.failures[key]; ok && f.lockedUntil.After(now) {
+			wait = max(wait, f.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Fail records a failed login for username from ip
+func (l *LoginLimiter) Fail(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+	l.fail(now, ipKey(ip), l.limits.LoginIPFailures)
+	l.fail(now, userKey(username), l.limits.LoginUserFailures)
+}
+
+func (l *LoginLimiter) fail(now time.Time, key string, free int) {
+	f, ok := l.failures[key]
+	if !ok || (now.After(f.lockedUntil) && now.Sub(f.last) > loginFailureWindow) {
+		f = &loginFailures{}
+		l.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if over := f.count - free; over > 0 {
+		delay := l.limits.LoginBaseDelay
+		for i := 1; i < over && delay < l.limits.LoginMaxDelay; i++ {
+			delay *= 2
+		}
+		f.lockedUntil = now.Add(min(delay, l.limits.LoginMaxDelay))
+	}
+}
+
+// Succeed clears the failures of a username after a successful login. The
+// address keeps its failures, so logging into one account doesn't reset
+// guessing at others.
+func (l *LoginLimiter) Succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, userKey(username))
+}
+
+// prune drops failures that are no longer remembered. Callers must hold the
+// lock.
+func (l *LoginLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, f := range l.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.last) > loginFailureWindow {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// RateLimitMiddleware throttles requests per client address, before they
+// are authenticated
+func RateLimitMiddleware(hub *Hub, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := hub.ipLimiter.Allow(hub.clientIP(r)); !ok {
+			writeTooManyRequests(w, wait, "Too many requests from your address, slow down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// writeTooManyRequests writes a 429 response telling the client when to
+// retry
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	writeJSON(w, http.StatusTooManyRequests, protocol.APIResponse{
+		Success: false,
+		Message: message,
+	})
+}
@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	start := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		tokens float64
+		after  time.Duration
+		rate   float64
+		burst  int
+		want   time.Duration
+		left   float64
+	}{
+		{"full", 3, 0, 1, 3, 0, 2},
+		{"last token", 1, 0, 1, 3, 0, 0},
+		{"empty", 0, 0, 2, 3, 500 * time.Millisecond, 0},
+		{"partly refilled", 0.5, 0, 1, 3, 500 * time.Millisecond, 0.5},
+		{"refilled", 0, 500 * time.Millisecond, 2, 3, 0, 0},
+		{"refill capped at burst", 0, time.Hour, 10, 3, 0, 2},
+		{"reserved", -1, 0, 4, 3, 500 * time.Millisecond, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bucket{tokens: tt.tokens, last: start}
+			if got := b.take(start.Add(tt.after), tt.rate, tt.burst); got != tt.want {
+				t.Errorf("wait = %s, want %s", got, tt.want)
+			}
+			if b.tokens != tt.left {
+				t.Errorf("%v tokens left, want %v", b.tokens, tt.left)
+			}
+		})
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(1, 3)
+	for i := range 3 {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("request past the burst: got %v, wait %s", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("another key shares the bucket")
+	}
+
+	if ok, _ := NewRateLimiter(1, 0).Allow("a"); !ok {
+		t.Error("burst below 1 refuses every request")
+	}
+
+	var disabled *RateLimiter
+	if NewRateLimiter(0, 10) != disabled || NewRateLimiter(-1, 10) != disabled {
+		t.Error("rates that aren't positive should disable the limiter")
+	}
+	for range 100 {
+		if ok, _ := disabled.Allow("a"); !ok {
+			t.Fatal("disabled limiter refused a request")
+		}
+	}
+}
+
+func TestRateLimiterWaitReserves(t *testing.T) {
+	l := NewRateLimiter(10, 1)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("first request refused")
+	}
+	if waited := l.Wait("a"); waited <= 0 {
+		t.Fatalf("Wait on an empty bucket didn't wait")
+	}
+	// The token that became available was taken by Wait
+	if ok, _ := l.Allow("a"); ok {
+		t.Error("token reserved by Wait was given out again")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := NewRateLimiter(1, 2)
+	start := time.Now()
+	l.buckets["idle"] = &bucket{tokens: 0, last: start.Add(-time.Hour)}
+	l.buckets["busy"] = &bucket{tokens: 0, last: start}
+	l.prune(start)
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("refilled bucket wasn't pruned")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("empty bucket was pruned")
+	}
+}
+
+func TestLoginLockoutDelay(t *testing.T) {
+	l := NewLoginLimiter(RateLimits{
+		LoginUserFailures: 2,
+		LoginBaseDelay:    time.Second,
+		LoginMaxDelay:     8 * time.Second,
+	})
+	start := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+	// Lockout after each failure, attempted once the previous one ended
+	want := []time.Duration{0, 0, 1, 2, 4, 8, 8, 8}
+	now := start
+	for i, w := range want {
+		l.fail(now, "user:alice", 2)
+		f := l.failures["user:alice"]
+		if got := max(f.lockedUntil.Sub(now), 0); got != w*time.Second {
+			t.Errorf("failure %d: locked for %s, want %s", i+1, got, w*time.Second)
+		}
+		now = now.Add(w*time.Second + time.Millisecond)
+	}
+
+	// Failures are remembered for a while after the lockout ends
+	now = now.Add(loginFailureWindow / 2)
+	l.fail(now, "user:alice", 2)
+	if got := l.failures["user:alice"].lockedUntil.Sub(now); got != 8*time.Second {
+		t.Errorf("failure within the window: locked for %s, want 8s", got)
+	}
+
+	// And forgotten after that
+	now = now.Add(8*time.Second + loginFailureWindow + time.Second)
+	l.fail(now, "user:alice", 2)
+	if f := l.failures["user:alice"]; f.count != 1 || f.lockedUntil.After(now) {
+		t.Errorf("failure after the window: got %+v, want a fresh count", f)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	l := NewLoginLimiter(RateLimits{
+		LoginUserFailures: 1,
+		LoginIPFailures:   2,
+		LoginBaseDelay:    time.Hour,
+	})
+
+	l.Fail("10.0.0.1", "alice")
+	if wait := l.Locked("10.0.0.1", "alice"); wait != 0 {
+		t.Fatalf("locked after a free failure: %s", wait)
+	}
+	l.Fail("10.0.0.1", "alice")
+	if wait := l.Locked("10.0.0.2", "alice"); wait <= 0 {
+		t.Error("username not locked from another address")
+	}
+	if wait := l.Locked("10.0.0.1", "bob"); wait != 0 {
+		t.Errorf("address locked before its own limit: %s", wait)
+	}
+
+	l.Fail("10.0.0.1", "bob")
+	if wait := l.Locked("10.0.0.1", "carol"); wait <= 0 {
+		t.Error("address not locked for other usernames")
+	}
+
+	l.Succeed("alice")
+	if wait := l.Locked("10.0.0.2", "alice"); wait != 0 {
+		t.Errorf("username still locked after a successful login: %s", wait)
+	}
+	if wait := l.Locked("10.0.0.1", "dave"); wait <= 0 {
+		t.Error("successful login cleared the address' failures")
+	}
+}
@@ -0,0 +1,480 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+const (
+	// reconcileInterval is how often desired states are compared to telemetry
+	reconcileInterval = 15 * time.Second
+	// remediationCooldown leaves time for telemetry to reflect a remediation
+	// before the same drift is acted on again
+	remediationCooldown = time.Minute
+	// maxRemediationAttempts is how many times the same drift is remediated
+	// before giving up, e.g. when a started process never matches its rule
+	maxRemediationAttempts = 3
+)
+
+var errDesiredStateNotFound = errors.New("desired state not found")
+
+// Reconciler compares desired states against agent telemetry, tracking drift
+// and optionally remediating it with stop/start commands
+type Reconciler struct {
+	hub  *Hub
+	path string
+
+	mu     sync.Mutex
+	states map[string]*desiredState
+	drift  map[string]*protocol.Drift // keyed by driftKey
+}
+
+// desiredState is a desired state along with the matchers of its process
+// rules, in the order of its rules
+type desiredState struct {
+	protocol.DesiredState
+	required  []func(string) bool
+	forbidden []func(string) bool
+}
+
+// remediation is a drift to correct, once the lock is released
+type remediation struct {
+	state protocol.DesiredState
+	drift *protocol.Drift
+}
+
+// NewReconciler loads the desired states from path
+func NewReconciler(hub *Hub, path string) (*Reconciler, error) {
+	r := &Reconciler{
+		hub:    hub,
+		path:   path,
+		states: make(map[string]*desiredState),
+		drift:  make(map[string]*protocol.Drift),
+	}
+	var saved map[string]protocol.DesiredState
+	if err := loadJSON(path, &saved); err != nil {
+		return nil, err
+	}
+	for id, st := range saved {
+		compiled, err := compileDesiredState(st)
+		if err != nil {
+			return nil, fmt.Errorf("desired state %s: %w", st.Name, err)
+		}
+		r.states[id] = compiled
+	}
+	return r, nil
+}
+
+// Run reconciles periodically until the process exits
+func (r *Reconciler) Run() {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.reconcile(now)
+	}
+}
+
+// reconcile recomputes the drift of every desired state and remediates it
+// where enabled. Commands are dispatched after releasing the lock.
+func (r *Reconciler) reconcile(now time.Time) {
+	r.mu.Lock()
+	states := make([]desiredState, 0, len(r.states))
+	for _, st := range r.states {
+		states = append(states, *st)
+	}
+	r.mu.Unlock()
+
+	found := make(map[string]*protocol.Drift)
+	for _, st := range states {
+		for _, d := range r.hub.stateDrift(st) {
+			found[driftKey(d)] = d
+		}
+	}
+
+	r.mu.Lock()
+	var pending []remediation
+	for key, d := range found {
+		d.Since = now
+		if prev, ok := r.drift[key]; ok {
+			d.Since = prev.Since
+			d.RemediatedAt = prev.RemediatedAt
+			d.RemediationAttempts = prev.RemediationAttempts
+			d.RemediationJobIDs = prev.RemediationJobIDs
+			d.RemediationError = prev.RemediationError
+		}
+
+		st, ok := r.states[d.StateID]
+		if !ok || !st.Remediate || d.RemediationError != "" {
+			continue
+		}
+		if d.RemediatedAt != nil && now.Sub(*d.RemediatedAt) < remediationCooldown {
+			continue
+		}
+		if d.RemediationAttempts >= maxRemediationAttempts {
+			d.RemediationError = fmt.Sprintf("remediation failed after %d attempts", d.RemediationAttempts)
+			log.Printf("[Reconciler] Giving up on %s %q on %s (%s) after %d attempts",
+				d.Kind, d.Pattern, d.AgentID, st.Name, d.RemediationAttempts)
+			continue
+		}
+		pending = append(pending, remediation{state: st.DesiredState, drift: d})
+	}
+	r.drift = found
+	r.mu.Unlock()
+
+	for _, rem := range pending {
+		jobIDs, err := r.remediate(rem.state, rem.drift)
+		r.mu.Lock()
+		switch {
+		case err != nil:
+			log.Printf("[Reconciler] Not remediating %s %q on %s (%s): %v",
+				rem.drift.Kind, rem.drift.Pattern, rem.drift.AgentID, rem.state.Name, err)
+			rem.drift.RemediationError = err.Error()
+		case len(jobIDs) > 0:
+			rem.drift.RemediatedAt = &now
+			rem.drift.RemediationAttempts++
+			rem.drift.RemediationJobIDs = append(slices.Clip(rem.drift.RemediationJobIDs), jobIDs...)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// remediate issues the commands that correct a drift and returns their job
+// IDs. It refuses to stop PID 1, the agent itself, or more than
+// MaxProcessTargets processes at once.
+func (r *Reconciler) remediate(st protocol.DesiredState, d *protocol.Drift) ([]string, error) {
+	requester := Requester{Name: st.Owner(), Via: "desired-state:" + st.ID}
+
+	var jobIDs []string
+	switch d.Kind {
+	case protocol.DriftMissing:
+		for _, req := range st.Required {
+			if req.Pattern != d.Pattern || req.Start == "" {
+				continue
+			}
+			log.Printf("[Reconciler] Starting %s on %s (%s)", req.Start, d.AgentID, st.Name)
+			for range d.Expected - d.Found {
+				job := r.hub.SubmitCommand(d.AgentID, protocol.AgentCommand{
+					Action: protocol.ActionStart,
+					Target: req.Start,
+					Args:   req.Args,
+				}, requester, 0)
+				jobIDs = append(jobIDs, job.ID)
+			}
+			return jobIDs, nil
+		}
+
+	case protocol.DriftForbidden:
+		var agentPID int32
+		if facts, ok := r.hub.GetFacts(d.AgentID); ok && facts != nil {
+			agentPID = facts.AgentPID
+		}
+		for _, pid := range d.PIDs {
+			if pid == 1 || pid == agentPID {
+				return nil, fmt.Errorf("%q matches protected PID %d", d.Pattern, pid)
+			}
+		}
+		if len(d.PIDs) > protocol.MaxProcessTargets {
+			return nil, fmt.Errorf("%q matches %d processes, more than %d to stop automatically",
+				d.Pattern, len(d.PIDs), protocol.MaxProcessTargets)
+		}
+
+		log.Printf("[Reconciler] Stopping forbidden %q on %s (%s)", d.Pattern, d.AgentID, st.Name)
+		for _, pid := range d.PIDs {
+			job := r.hub.SubmitCommand(d.AgentID, protocol.AgentCommand{
+				Action: protocol.ActionStop,
+				Target: strconv.Itoa(int(pid)),
+			}, requester, 0)
+			jobIDs = append(jobIDs, job.ID)
+		}
+	}
+	return jobIDs, nil
+}
+
+// stateDrift compares a desired state against the telemetry of every
+// connected agent it applies to
+func (h *Hub) stateDrift(st desiredState) []*protocol.Drift {
+	sel, err := ParseSelector(st.Selector)
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	if st.AgentID != "" {
+		ids = []string{st.AgentID}
+	}
+	agents, _ := h.SelectAgents(ids, sel)
+
+	var drift []*protocol.Drift
+	for _, agent := range agents {
+		h.mu.RLock()
+		hostname := agent.Info.Hostname
+		h.mu.RUnlock()
+
+		agent.processesMu.RLock()
+		procs := agent.processes
+		agent.processesMu.RUnlock()
+		if procs == nil {
+			// No telemetry yet
+			continue
+		}
+
+		newDrift := func(kind string, rule protocol.ProcessRule) *protocol.Drift {
+			return &protocol.Drift{
+				StateID:   st.ID,
+				StateName: st.Name,
+				AgentID:   agent.ID,
+				Hostname:  hostname,
+				Kind:      kind,
+				Pattern:   rule.Pattern,
+			}
+		}
+
+		for i, req := range st.Required {
+			pids := matchProcesses(procs, st.required[i], req.Cmdline)
+			if want := max(req.MinCount, 1); len(pids) < want {
+				d := newDrift(protocol.DriftMissing, req.ProcessRule)
+				d.Expected = want
+				d.Found = len(pids)
+				d.PIDs = pids
+				drift = append(drift, d)
+			}
+		}
+		for i, rule := range st.Forbidden {
+			if pids := matchProcesses(procs, st.forbidden[i], rule.Cmdline); len(pids) > 0 {
+				d := newDrift(protocol.DriftForbidden, rule)
+				d.Found = len(pids)
+				d.PIDs = pids
+				drift = append(drift, d)
+			}
+		}
+	}
+	return drift
+}
+
+// matchProcesses returns the PIDs of the processes whose name, or command
+// line if cmdline is set, matches
+func matchProcesses(procs []protocol.ProcessInfo, match func(string) bool, cmdline bool) []int32 {
+	var pids []int32
+	for _, p := range procs {
+		subject := p.Name
+		if cmdline {
+			subject = p.Cmdline
+		}
+		if match(subject) {
+			pids = append(pids, p.PID)
+		}
+	}
+	return pids
+}
+
+func driftKey(d *protocol.Drift) string {
+	return strings.Join([]string{d.StateID, d.AgentID, d.Kind, d.Pattern}, "|")
+}
+
+// Drift returns the current drift, optionally for a single agent
+func (r *Reconciler) Drift(agentID string) []protocol.Drift {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]protocol.Drift, 0, len(r.drift))
+	for _, d := range r.drift {
+		if agentID == "" || d.AgentID == agentID {
+			list = append(list, *d)
+		}
+	}
+	slices.SortFunc(list, func(a, b protocol.Drift) int {
+		return strings.Compare(driftKey(&a), driftKey(&b))
+	})
+	return list
+}
+
+// List returns every desired state sorted by name
+func (r *Reconciler) List() []protocol.DesiredState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]protocol.DesiredState, 0, len(r.states))
+	for _, st := range r.states {
+		list = append(list, st.DesiredState)
+	}
+	slices.SortFunc(list, func(a, b protocol.DesiredState) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+// Get returns a desired state by ID
+func (r *Reconciler) Get(id string) (protocol.DesiredState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, ok := r.states[id]
+	if !ok {
+		return protocol.DesiredState{}, false
+	}
+	return st.DesiredState, true
+}
+
+// Create validates and stores a new desired state
+func (r *Reconciler) Create(req protocol.DesiredStateRequest, user string) (protocol.DesiredState, error) {
+	now := time.Now()
+	st := protocol.DesiredState{
+		ID:        generateID(),
+		CreatedBy: user,
+		UpdatedBy: user,
+		CreatedAt: now,
+	}
+	if err := applyDesiredStateRequest(&st, req, now); err != nil {
+		return protocol.DesiredState{}, err
+	}
+	compiled, err := compileDesiredState(st)
+	if err != nil {
+		return protocol.DesiredState{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states[st.ID] = compiled
+	r.persist()
+	return st, nil
+}
+
+// Update replaces an existing desired state on behalf of user, who
+// remediates its drift from then on
+func (r *Reconciler) Update(id string, req protocol.DesiredStateRequest, user string) (protocol.DesiredState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.states[id]
+	if !ok {
+		return protocol.DesiredState{}, errDesiredStateNotFound
+	}
+
+	st := existing.DesiredState
+	if err := applyDesiredStateRequest(&st, req, time.Now()); err != nil {
+		return protocol.DesiredState{}, err
+	}
+	st.UpdatedBy = user
+	compiled, err := compileDesiredState(st)
+	if err != nil {
+		return protocol.DesiredState{}, err
+	}
+	r.states[id] = compiled
+	// Drift is recomputed against the new rules, with fresh remediation
+	// attempts
+	r.forgetDrift(id)
+	r.persist()
+	return st, nil
+}
+
+// Delete removes a desired state and its drift
+func (r *Reconciler) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.states[id]; !ok {
+		return errDesiredStateNotFound
+	}
+	delete(r.states, id)
+	r.forgetDrift(id)
+	r.persist()
+	return nil
+}
+
+// forgetDrift removes the drift of a desired state. Callers must hold the
+// lock.
+func (r *Reconciler) forgetDrift(id string) {
+	for key, d := range r.drift {
+		if d.StateID == id {
+			delete(r.drift, key)
+		}
+	}
+}
+
+// persist writes the desired states to disk. Callers must hold the lock.
+func (r *Reconciler) persist() {
+	states := make(map[string]protocol.DesiredState, len(r.states))
+	for id, st := range r.states {
+		states[id] = st.DesiredState
+	}
+	if err := saveJSON(r.path, states); err != nil {
+		log.Printf("[Reconciler] Failed to persist desired states: %v", err)
+	}
+}
+
+// applyDesiredStateRequest validates req and copies it onto st
+func applyDesiredStateRequest(st *protocol.DesiredState, req protocol.DesiredStateRequest, now time.Time) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return errors.New("name is required")
+	}
+	if (req.AgentID == "") == (req.Selector == "") {
+		return errors.New("exactly one of agent_id or selector is required")
+	}
+	if _, err := ParseSelector(req.Selector); err != nil {
+		return err
+	}
+	if len(req.Required) == 0 && len(req.Forbidden) == 0 {
+		return errors.New("at least one required or forbidden process is needed")
+	}
+
+	for _, p := range req.Required {
+		if err := validateRule(p.ProcessRule); err != nil {
+			return err
+		}
+		if p.MinCount < 0 {
+			return fmt.Errorf("invalid min_count for %q", p.Pattern)
+		}
+	}
+	for _, p := range req.Forbidden {
+		if err := validateRule(p); err != nil {
+			return err
+		}
+	}
+
+	st.Name = req.Name
+	st.AgentID = req.AgentID
+	st.Selector = req.Selector
+	st.Required = req.Required
+	st.Forbidden = req.Forbidden
+	st.Remediate = req.Remediate
+	st.UpdatedAt = now
+	return nil
+}
+
+// compileDesiredState builds the matchers of a desired state's process
+// rules, which checks their syntax
+func compileDesiredState(st protocol.DesiredState) (*desiredState, error) {
+	compiled := &desiredState{DesiredState: st}
+	for _, req := range st.Required {
+		match, err := processMatcher(req.Pattern, req.Match)
+		if err != nil {
+			return nil, err
+		}
+		compiled.required = append(compiled.required, match)
+	}
+	for _, rule := range st.Forbidden {
+		match, err := processMatcher(rule.Pattern, rule.Match)
+		if err != nil {
+			return nil, err
+		}
+		compiled.forbidden = append(compiled.forbidden, match)
+	}
+	return compiled, nil
+}
+
+func validateRule(rule protocol.ProcessRule) error {
+	if rule.Pattern == "" {
+		return errors.New("process pattern is required")
+	}
+	switch rule.Match {
+	case "", protocol.ProcessMatchExact, protocol.ProcessMatchGlob, protocol.ProcessMatchRegex:
+		return nil
+	}
+	return fmt.Errorf("unknown match %q for %q", rule.Match, rule.Pattern)
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// registrySaveDelay batches writes of the registry, which changes on every
+// agent connect and disconnect
+const registrySaveDelay = time.Second
+
+// AgentRegistry remembers every agent that has ever registered, so that an
+// agent keeps its ID across reconnects and can be targeted while offline
+type AgentRegistry struct {
+	mu     sync.RWMutex
+	agents map[string]protocol.AgentInfo
+	path   string
+	// saving is set while a write of the registry is scheduled
+	saving bool
+	// saveMu serializes writes of the registry
+	saveMu sync.Mutex
+}
+
+// NewAgentRegistry loads the known agents from path
+func NewAgentRegistry(path string) (*AgentRegistry, error) {
+	r := &AgentRegistry{
+		agents: make(map[string]protocol.AgentInfo),
+		path:   path,
+	}
+	if err := loadJSON(path, &r.agents); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get returns a known agent by ID
+func (r *AgentRegistry) Get(id string) (protocol.AgentInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	info, ok := r.agents[id]
+	return info, ok
+}
+
+// Put records or replaces an agent's info. It is saved to disk shortly
+// after, so Put doesn't block on I/O.
+func (r *AgentRegistry) Put(info protocol.AgentInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.agents[info.ID] = info
+	r.persist()
+}
+
+// List returns every known agent
+func (r *AgentRegistry) List() []protocol.AgentInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]protocol.AgentInfo, 0, len(r.agents))
+	for _, info := range r.agents {
+		list = append(list, info)
+	}
+	return list
+}
+
+// persist schedules a write of the registry. Callers must hold the lock.
+func (r *AgentRegistry) persist() {
+	if r.path == "" || r.saving {
+		return
+	}
+	r.saving = true
+	time.AfterFunc(registrySaveDelay, r.flush)
+}
+
+// flush writes the registry to disk. Agents are copied under the lock and
+// written outside it.
+func (r *AgentRegistry) flush() {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	r.saving = false
+	agents := maps.Clone(r.agents)
+	r.mu.Unlock()
+
+	if err := saveJSON(r.path, agents); err != nil {
+		log.Printf("[Registry] Failed to persist agents: %v", err)
+	}
+}
@@ -0,0 +1,366 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/cron"
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+const (
+	// schedulerTick is how often due schedules are checked
+	schedulerTick = time.Second
+	// missedRunDelay gives agents time to reconnect after a middleware
+	// restart before a missed run is caught up
+	missedRunDelay = 30 * time.Second
+	// maxScheduleRuns bounds the run history kept per schedule
+	maxScheduleRuns = 50
+)
+
+var errScheduleNotFound = errors.New("schedule not found")
+
+// scheduleState is the persisted form of the scheduler
+type scheduleState struct {
+	Schedules map[string]*protocol.Schedule     `json:"schedules"`
+	Runs      map[string][]protocol.ScheduleRun `json:"runs"`
+}
+
+// Scheduler runs bulk commands on cron expressions or at one-shot times
+type Scheduler struct {
+	hub  *Hub
+	path string
+
+	mu      sync.Mutex
+	state   scheduleState
+	running map[string]bool      // schedules with a run in progress
+	missed  map[string]time.Time // schedules catching up a missed run
+}
+
+// NewScheduler loads the schedules from path and applies each schedule's
+// missed-run policy to runs that fell due while the middleware was down
+func NewScheduler(hub *Hub, path string) (*Scheduler, error) {
+	s := &Scheduler{
+		hub:  hub,
+		path: path,
+		state: scheduleState{
+			Schedules: make(map[string]*protocol.Schedule),
+			Runs:      make(map[string][]protocol.ScheduleRun),
+		},
+		running: make(map[string]bool),
+		missed:  make(map[string]time.Time),
+	}
+	if err := loadJSON(path, &s.state); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for id, sched := range s.state.Schedules {
+		if !sched.Enabled || sched.NextRun == nil || !sched.NextRun.Before(now) {
+			continue
+		}
+
+		scheduledAt := *sched.NextRun
+		if sched.MissedPolicy == protocol.MissedRunOnce {
+			log.Printf("[Scheduler] Catching up missed run of %q in %s", sched.Name, missedRunDelay)
+			s.missed[id] = scheduledAt
+			next := now.Add(missedRunDelay)
+			sched.NextRun = &next
+			continue
+		}
+
+		log.Printf("[Scheduler] Skipping missed run of %q", sched.Name)
+		s.addRun(protocol.ScheduleRun{
+			ScheduleID:  id,
+			ScheduledAt: scheduledAt,
+			StartedAt:   now,
+			FinishedAt:  &now,
+			Missed:      true,
+			Status:      protocol.RunSkipped,
+			Message:     "middleware was down at the scheduled time",
+		})
+		sched.NextRun = nextRun(sched, now)
+	}
+	s.persist()
+	return s, nil
+}
+
+// Run checks for due schedules until the process exits
+func (s *Scheduler) Run() {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.tick(now)
+	}
+}
+
+// tick starts every schedule whose next run is due
+func (s *Scheduler) tick(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for id, sched := range s.state.Schedules {
+		if !sched.Enabled || sched.NextRun == nil || sched.NextRun.After(now) {
+			continue
+		}
+
+		scheduledAt, missed := s.missed[id]
+		if missed {
+			delete(s.missed, id)
+		} else {
+			scheduledAt = *sched.NextRun
+		}
+		sched.NextRun = nextRun(sched, now)
+		sched.LastRun = &now
+		changed = true
+
+		if s.running[id] {
+			s.addRun(protocol.ScheduleRun{
+				ScheduleID:  id,
+				ScheduledAt: scheduledAt,
+				StartedAt:   now,
+				FinishedAt:  &now,
+				Missed:      missed,
+				Status:      protocol.RunSkipped,
+				Message:     "previous run still in progress",
+			})
+			continue
+		}
+
+		s.running[id] = true
+		go s.execute(*sched, scheduledAt, missed)
+	}
+	if changed {
+		s.persist()
+	}
+}
+
+// execute runs the schedule's command and records the outcome
+func (s *Scheduler) execute(sched protocol.Schedule, scheduledAt time.Time, missed bool) {
+	run := protocol.ScheduleRun{
+		ScheduleID:  sched.ID,
+		ScheduledAt: scheduledAt,
+		StartedAt:   time.Now(),
+		Missed:      missed,
+	}
+	log.Printf("[Scheduler] Running %q (%s)", sched.Name, sched.ID)
+
+	result, err := s.hub.BulkCommand(sched.Command, Requester{Name: sched.Owner(), Via: "schedule:" + sched.ID}, false)
+	if err != nil {
+		run.Status = protocol.RunError
+		run.Message = err.Error()
+	} else {
+		run.Status = result.Status
+		run.Result = result
+	}
+	finished := time.Now()
+	run.FinishedAt = &finished
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, sched.ID)
+	s.addRun(run)
+	s.persist()
+}
+
+// List returns every schedule sorted by name
+func (s *Scheduler) List() []protocol.Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]protocol.Schedule, 0, len(s.state.Schedules))
+	for _, sched := range s.state.Schedules {
+		list = append(list, *sched)
+	}
+	slices.SortFunc(list, func(a, b protocol.Schedule) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+// Get returns a schedule by ID
+func (s *Scheduler) Get(id string) (protocol.Schedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sched, ok := s.state.Schedules[id]
+	if !ok {
+		return protocol.Schedule{}, false
+	}
+	return *sched, true
+}
+
+// Create validates and stores a new schedule
+func (s *Scheduler) Create(req protocol.ScheduleRequest, user string) (protocol.Schedule, error) {
+	now := time.Now()
+	sched := &protocol.Schedule{
+		ID:        generateID(),
+		CreatedBy: user,
+		UpdatedBy: user,
+		CreatedAt: now,
+	}
+	if err := applyScheduleRequest(sched, req, now); err != nil {
+		return protocol.Schedule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Schedules[sched.ID] = sched
+	s.persist()
+	return *sched, nil
+}
+
+// Update replaces the definition of an existing schedule on behalf of user,
+// who runs its commands from then on
+func (s *Scheduler) Update(id string, req protocol.ScheduleRequest, user string) (protocol.Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.state.Schedules[id]
+	if !ok {
+		return protocol.Schedule{}, errScheduleNotFound
+	}
+
+	sched := *existing
+	if err := applyScheduleRequest(&sched, req, time.Now()); err != nil {
+		return protocol.Schedule{}, err
+	}
+	sched.UpdatedBy = user
+	delete(s.missed, id)
+	s.state.Schedules[id] = &sched
+	s.persist()
+	return sched, nil
+}
+
+// Delete removes a schedule and its run history
+func (s *Scheduler) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.state.Schedules[id]; !ok {
+		return errScheduleNotFound
+	}
+	delete(s.state.Schedules, id)
+	delete(s.state.Runs, id)
+	delete(s.missed, id)
+	s.persist()
+	return nil
+}
+
+// Runs returns the run history of a schedule, newest first
+func (s *Scheduler) Runs(id string) ([]protocol.ScheduleRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.state.Schedules[id]; !ok {
+		return nil, errScheduleNotFound
+	}
+	runs := slices.Clone(s.state.Runs[id])
+	slices.Reverse(runs)
+	if runs == nil {
+		runs = []protocol.ScheduleRun{}
+	}
+	return runs, nil
+}
+
+// addRun appends to a schedule's run history. Callers must hold the lock.
+func (s *Scheduler) addRun(run protocol.ScheduleRun) {
+	runs := append(s.state.Runs[run.ScheduleID], run)
+	if len(runs) > maxScheduleRuns {
+		runs = runs[len(runs)-maxScheduleRuns:]
+	}
+	s.state.Runs[run.ScheduleID] = runs
+}
+
+// persist writes the schedules to disk. Callers must hold the lock.
+func (s *Scheduler) persist() {
+	if err := saveJSON(s.path, s.state); err != nil {
+		log.Printf("[Scheduler] Failed to persist schedules: %v", err)
+	}
+}
+
+// applyScheduleRequest validates req and copies it onto sched
+func applyScheduleRequest(sched *protocol.Schedule, req protocol.ScheduleRequest, now time.Time) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return errors.New("name is required")
+	}
+	if (req.Cron == "") == (req.RunAt == nil) {
+		return errors.New("exactly one of cron or run_at is required")
+	}
+	if req.Cron != "" {
+		if _, err := cron.Parse(req.Cron); err != nil {
+			return err
+		}
+	}
+	if req.RunAt != nil && !req.RunAt.After(now) {
+		return errors.New("run_at must be in the future")
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone: %s", req.Timezone)
+		}
+	}
+
+	switch req.MissedPolicy {
+	case "":
+		req.MissedPolicy = protocol.MissedSkip
+	case protocol.MissedSkip, protocol.MissedRunOnce:
+	default:
+		return fmt.Errorf("unknown missed_policy: %s", req.MissedPolicy)
+	}
+
+	if err := validateBulkRequest(req.Command); err != nil {
+		return err
+	}
+	if _, err := ParseSelector(req.Command.Selector); err != nil {
+		return err
+	}
+	if _, err := parseQueueTTL(req.Command.QueueTTL, req.Command.Action); err != nil {
+		return err
+	}
+
+	sched.Name = req.Name
+	sched.Cron = req.Cron
+	sched.RunAt = req.RunAt
+	sched.Timezone = req.Timezone
+	sched.Command = req.Command
+	sched.MissedPolicy = req.MissedPolicy
+	sched.Enabled = req.Enabled == nil || *req.Enabled
+	sched.UpdatedAt = now
+	sched.NextRun = nextRun(sched, now)
+	if sched.RunAt != nil {
+		sched.NextRun = sched.RunAt
+	}
+	return nil
+}
+
+// nextRun returns the schedule's first activation after t, or nil if it
+// will not run again
+func nextRun(sched *protocol.Schedule, t time.Time) *time.Time {
+	if sched.Cron == "" {
+		// One-shot schedules run once
+		return nil
+	}
+
+	expr, err := cron.Parse(sched.Cron)
+	if err != nil {
+		return nil
+	}
+	loc := time.Local
+	if sched.Timezone != "" {
+		if l, err := time.LoadLocation(sched.Timezone); err == nil {
+			loc = l
+		}
+	}
+
+	next := expr.Next(t.In(loc))
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
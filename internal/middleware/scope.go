@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// Scoped operators can only operate agents matching their scope. Commands
+// sent to a single agent are checked against it; selectors in bulk
+// commands, schedules and desired states are narrowed to it, and existing
+// schedules and desired states can only be changed if their selector is
+// already narrowed to it.
+
+// narrow restricts a selector expression to the principal's scope
+func (p Principal) narrow(expr string) string {
+	switch {
+	case p.Scope == "":
+		return expr
+	case strings.TrimSpace(expr) == "":
+		return p.Scope
+	}
+	return expr + "," + p.Scope
+}
+
+// selectorInScope reports whether a selector expression only matches agents
+// within the principal's scope
+func (p Principal) selectorInScope(expr string) bool {
+	if p.Scope == "" {
+		return true
+	}
+	sel, err := ParseSelector(expr)
+	if err != nil {
+		return false
+	}
+	scope, err := ParseSelector(p.Scope)
+	if err != nil {
+		return false
+	}
+	return sel.Includes(scope)
+}
+
+// agentInScope reports whether the principal may operate a known agent
+func (h *Hub) agentInScope(p Principal, agentID string) bool {
+	if p.Scope == "" {
+		return true
+	}
+	scope, err := ParseSelector(p.Scope)
+	if err != nil {
+		return false
+	}
+	info, ok := h.registry.Get(agentID)
+	return ok && scope.Matches(agentLabels(info))
+}
+
+// requireAgentScope writes a 403 response and returns false if the request's
+// principal can't operate the agent
+func requireAgentScope(w http.ResponseWriter, r *http.Request, hub *Hub, agentID string) bool {
+	if hub.agentInScope(PrincipalFromContext(r.Context()), agentID) {
+		return true
+	}
+	hub.auditDenied(r, agentID, "agent outside scope")
+	writeJSON(w, http.StatusForbidden, protocol.APIResponse{
+		Success: false,
+		Message: "Agent " + agentID + " is outside your scope",
+	})
+	return false
+}
+
+// writeOutOfScope writes the 403 response for a schedule or desired state
+// that targets agents outside the principal's scope
+func writeOutOfScope(w http.ResponseWriter, r *http.Request, hub *Hub, what string) {
+	hub.auditDenied(r, "", what+" outside scope")
+	writeJSON(w, http.StatusForbidden, protocol.APIResponse{
+		Success: false,
+		Message: "This " + what + " targets agents outside your scope",
+	})
+}
+
+// desiredStateInScope checks the target of a desired state request, narrowing
+// its selector to the principal's scope
+func desiredStateInScope(hub *Hub, p Principal, req *protocol.DesiredStateRequest) bool {
+	if req.AgentID != "" {
+		return hub.agentInScope(p, req.AgentID)
+	}
+	// An empty selector is invalid; leave it for the reconciler to reject
+	if req.Selector != "" {
+		req.Selector = p.narrow(req.Selector)
+	}
+	return true
+}
+
+// existingStateInScope reports whether the principal may change a desired
+// state
+func existingStateInScope(hub *Hub, p Principal, st protocol.DesiredState) bool {
+	if st.AgentID != "" {
+		return hub.agentInScope(p, st.AgentID)
+	}
+	return p.selectorInScope(st.Selector)
+}
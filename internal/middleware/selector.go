@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// selectorOp is the comparison performed by a single requirement
+type selectorOp int
+
+const (
+	opEquals selectorOp = iota
+	opNotEquals
+	opExists
+	opNotExists
+)
+
+// requirement is one comma-separated term of a label selector
+type requirement struct {
+	key   string
+	op    selectorOp
+	value string
+}
+
+// Selector matches agents by their labels. The syntax is a comma-separated
+// list of requirements, all of which must hold:
+//
+//	env=prod       label equals value ("==" is accepted too)
+//	env!=prod      label missing or different from value
+//	role           label present
+//	!role          label absent
+//
+// An empty selector matches every agent.
+type Selector struct {
+	reqs []requirement
+}
+
+// ParseSelector parses a label selector expression
+func ParseSelector(expr string) (Selector, error) {
+	var sel Selector
+	for term := range strings.SplitSeq(expr, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var req requirement
+		switch {
+		case strings.Contains(term, "!="):
+			key, value, _ := strings.Cut(term, "!=")
+			req = requirement{key: key, op: opNotEquals, value: value}
+		case strings.Contains(term, "="):
+			key, value, _ := strings.Cut(term, "=")
+			req = requirement{key: key, op: opEquals, value: strings.TrimPrefix(value, "=")}
+		case strings.HasPrefix(term, "!"):
+			req = requirement{key: term[1:], op: opNotExists}
+		default:
+			req = requirement{key: term, op: opExists}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if req.key == "" {
+			return Selector{}, fmt.Errorf("invalid selector term %q", term)
+		}
+		sel.reqs = append(sel.reqs, req)
+	}
+	return sel, nil
+}
+
+// Empty reports whether the selector has no requirements
+func (s Selector) Empty() bool {
+	return len(s.reqs) == 0
+}
+
+// Matches reports whether the given labels satisfy every requirement
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s.reqs {
+		value, ok := labels[req.key]
+		switch req.op {
+		case opEquals:
+			if !ok || value != req.value {
+				return false
+			}
+		case opNotEquals:
+			if ok && value == req.value {
+				return false
+			}
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Includes reports whether s has every requirement of other, so that any
+// labels s matches are matched by other too
+func (s Selector) Includes(other Selector) bool {
+	for _, req := range other.reqs {
+		if !slices.Contains(s.reqs, req) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// Default token lifetimes, used when HubConfig leaves them unset
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// minJWTSecretLength is the shortest accepted HMAC secret, in bytes
+const minJWTSecretLength = 32
+
+var (
+	errInvalidRefresh = errors.New("invalid or expired refresh token")
+	errSessionRevoked = errors.New("session revoked")
+	errRefreshReused  = fmt.Errorf("%w: refresh token reused", errSessionRevoked)
+)
+
+// JWTKey is an HMAC key access tokens are signed or verified with, named by
+// the kid header of the tokens
+type JWTKey struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseJWTKeys parses a list of "kid=secret" pairs separated by commas or
+// newlines. The first key signs new tokens; the others are only accepted
+// for verification, so a key can be rotated out once its tokens expire.
+func ParseJWTKeys(spec string) ([]JWTKey, error) {
+	var keys []JWTKey
+	seen := make(map[string]bool)
+	for field := range strings.FieldsFuncSeq(spec, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	}) {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		id, secret, ok := strings.Cut(field, "=")
+		id = strings.TrimSpace(id)
+		switch {
+		case !ok || id == "":
+			return nil, fmt.Errorf("invalid JWT key %q, expected kid=secret", field)
+		case len(secret) < minJWTSecretLength:
+			return nil, fmt.Errorf("JWT key %s is shorter than %d bytes", id, minJWTSecretLength)
+		case seen[id]:
+			return nil, fmt.Errorf("duplicate JWT key ID %s", id)
+		}
+		seen[id] = true
+		keys = append(keys, JWTKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// randomJWTKey generates a key for deployments that don't configure one.
+// Sessions don't survive a restart with it.
+func randomJWTKey() JWTKey {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return JWTKey{ID: "ephemeral", Secret: secret}
+}
+
+// session is a login. Its refresh token is rotated on every use; presenting
+// the previous one again means it leaked, and revokes the session.
+type session struct {
+	ID          string     `json:"id"`
+	Username    string     `json:"username"`
+	Hash        string     `json:"hash"`
+	PrevHash    string     `json:"prev_hash,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RefreshedAt time.Time  `json:"refreshed_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// SessionStore keeps the sessions behind refresh tokens, and the revocation
+// list AuthMiddleware checks access tokens against. Sessions are forgotten
+// once their refresh token expires.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	path     string
+}
+
+// NewSessionStore loads the sessions from path
+func NewSessionStore(path string) (*SessionStore, error) {
+	s := &SessionStore{sessions: make(map[string]*session), path: path}
+	var saved []*session
+	if err := loadJSON(path, &saved); err != nil {
+		return nil, err
+	}
+	for _, sess := range saved {
+		s.sessions[sess.ID] = sess
+	}
+	return s, nil
+}
+
+// Create starts a session and returns it with its refresh token
+func (s *SessionStore) Create(username string, ttl time.Duration) (session, string) {
+	now := time.Now()
+	sess := &session{
+		ID:          generateID(),
+		Username:    username,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	var refresh string
+	refresh, sess.Hash = newSecret(sess.ID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sess.ID] = sess
+	s.prune(now)
+	s.persist()
+	return *sess, refresh
+}
+
+// Refresh exchanges a refresh token for a new one, extending the session.
+// When the session is revoked, it is returned along with the error so the
+// attempt can be attributed.
+func (s *SessionStore) Refresh(refresh string, ttl time.Duration) (session, string, error) {
+	id, hash, ok := splitSecret(refresh)
+	if !ok {
+		return session{}, "", errInvalidRefresh
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sess, ok := s.sessions[id]
+	switch {
+	case !ok || now.After(sess.ExpiresAt):
+		return session{}, "", errInvalidRefresh
+	case sess.RevokedAt != nil:
+		return *sess, "", errSessionRevoked
+	case sess.PrevHash != "" && hashesEqual(sess.PrevHash, hash):
+		log.Printf("[Auth] Refresh token of session %s (%s) reused, revoking it", sess.ID, sess.Username)
+		sess.RevokedAt = &now
+		s.persist()
+		return *sess, "", errRefreshReused
+	case !hashesEqual(sess.Hash, hash):
+		return session{}, "", errInvalidRefresh
+	}
+
+	var next string
+	sess.PrevHash = sess.Hash
+	next, sess.Hash = newSecret(sess.ID)
+	sess.RefreshedAt = now
+	sess.ExpiresAt = now.Add(ttl)
+	s.persist()
+	return *sess, next, nil
+}
+
+// Revoke ends a session; its access tokens are rejected from then on
+func (s *SessionStore) Revoke(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[id]; ok && sess.RevokedAt == nil {
+		now := time.Now()
+		sess.RevokedAt = &now
+		s.persist()
+	}
+}
+
+// RevokeUser ends every session of a user
+func (s *SessionStore) RevokeUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, sess := range s.sessions {
+		if sess.Username == username && sess.RevokedAt == nil {
+			sess.RevokedAt = &now
+		}
+	}
+	s.persist()
+}
+
+// Active reports whether a session exists and hasn't been revoked
+func (s *SessionStore) Active(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	return ok && sess.RevokedAt == nil && time.Now().Before(sess.ExpiresAt)
+}
+
+// prune forgets expired sessions. Callers must hold the lock.
+func (s *SessionStore) prune(now time.Time) {
+	for id, sess := range s.sessions {
+		if now.After(sess.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// persist writes the store to disk. Callers must hold the lock.
+func (s *SessionStore) persist() {
+	list := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		list = append(list, sess)
+	}
+	if err := saveJSON(s.path, list); err != nil {
+		log.Printf("[Auth] Failed to persist sessions: %v", err)
+	}
+}
+
+// issueTokens signs an access token for a user's session and returns it
+// along with the refresh token
+func (h *Hub) issueTokens(user protocol.User, sess session, refresh string) (protocol.LoginResponse, error) {
+	now := time.Now()
+	expires := now.Add(h.cfg.AccessTokenTTL)
+	claims := tokenClaims{
+		Username:    user.Username,
+		Role:        user.Role,
+		Permissions: protocol.RolePermissions[user.Role],
+		Scope:       user.Scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sess.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	key := h.cfg.JWTKeys[0]
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.Secret)
+	if err != nil {
+		return protocol.LoginResponse{}, err
+	}
+	return protocol.LoginResponse{
+		Token:            signed,
+		ExpiresAt:        expires,
+		RefreshToken:     refresh,
+		RefreshExpiresAt: sess.ExpiresAt,
+	}, nil
+}
+
+// jwtKey finds the verification key named by a token's kid header
+func (h *Hub) jwtKey(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method")
+	}
+	kid, _ := token.Header["kid"].(string)
+	for _, key := range h.cfg.JWTKeys {
+		if key.ID == kid {
+			return key.Secret, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// maxTelemetryHistory bounds the samples kept per agent
+const maxTelemetryHistory = 1800
+
+// TelemetryHistory keeps a bounded, in-memory history of summarized
+// telemetry per agent. It outlives connections so samples backfilled after a
+// reconnect land next to the ones received before the disconnect.
+type TelemetryHistory struct {
+	mu      sync.RWMutex
+	samples map[string][]protocol.TelemetrySample // oldest first
+}
+
+// NewTelemetryHistory creates an empty history
+func NewTelemetryHistory() *TelemetryHistory {
+	return &TelemetryHistory{samples: make(map[string][]protocol.TelemetrySample)}
+}
+
+// Add records a telemetry sample for the agent, keeping the history ordered
+// by sample time
+func (t *TelemetryHistory) Add(agentID string, telemetry protocol.AgentTelemetry, backfilled bool) {
+	now := time.Now()
+	sample := protocol.TelemetrySample{
+		Timestamp:    telemetry.Timestamp,
+		ReceivedAt:   now,
+		Backfilled:   backfilled,
+		ProcessCount: len(telemetry.Processes),
+	}
+	if sample.Timestamp.IsZero() {
+		sample.Timestamp = now
+	}
+	for _, p := range telemetry.Processes {
+		sample.CPU += p.CPU
+		sample.Memory += float64(p.Memory)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := t.samples[agentID]
+	i, _ := slices.BinarySearchFunc(history, sample.Timestamp, func(s protocol.TelemetrySample, ts time.Time) int {
+		return s.Timestamp.Compare(ts)
+	})
+	history = slices.Insert(history, i, sample)
+	if over := len(history) - maxTelemetryHistory; over > 0 {
+		history = slices.Delete(history, 0, over)
+	}
+	t.samples[agentID] = history
+}
+
+// List returns the agent's samples taken at or after since, oldest first
+func (t *TelemetryHistory) List(agentID string, since time.Time) []protocol.TelemetrySample {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	history := t.samples[agentID]
+	i, _ := slices.BinarySearchFunc(history, since, func(s protocol.TelemetrySample, ts time.Time) int {
+		return s.Timestamp.Compare(ts)
+	})
+	return slices.Clone(history[i:])
+}
+
+// GetTelemetryHistory returns the telemetry history of a known agent
+func (h *Hub) GetTelemetryHistory(agentID string, since time.Time) ([]protocol.TelemetrySample, bool) {
+	if _, ok := h.registry.Get(agentID); !ok {
+		return nil, false
+	}
+	return h.history.List(agentID, since), true
+}
+
+// applyDelta updates the agent's process list from a telemetry delta and
+// returns the resulting sample. If the delta doesn't follow the baseline,
+// it is dropped and the agent is asked for a full snapshot.
+func (h *Hub) applyDelta(agent *AgentConnection, delta protocol.TelemetryDelta) (protocol.AgentTelemetry, bool) {
+	agent.processesMu.Lock()
+	if agent.seq == 0 || delta.Seq != agent.seq+1 {
+		have, requested := agent.seq, agent.resyncing
+		agent.resyncing = true
+		agent.processesMu.Unlock()
+
+		if !requested {
+			log.Printf("[Hub] Telemetry gap from %s (have %d, got %d), requesting resync", agent.ID, have, delta.Seq)
+			if err := agent.writeJSON(protocol.WSMessage{Type: "resync"}); err != nil {
+				log.Printf("[Hub] Failed to request resync from %s: %v", agent.ID, err)
+			}
+		}
+		return protocol.AgentTelemetry{}, false
+	}
+
+	telemetry := protocol.AgentTelemetry{
+		Timestamp: delta.Timestamp,
+		Seq:       delta.Seq,
+		Processes: protocol.ApplyDelta(agent.processes, delta),
+		Services:  delta.Services,
+	}
+	agent.processes = telemetry.Processes
+	agent.services = telemetry.Services
+	agent.seq = delta.Seq
+	agent.processesMu.Unlock()
+	return telemetry, true
+}
@@ -0,0 +1,397 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+// UsersFile is the name of the user store in the data directory
+const UsersFile = "users.json"
+
+// Password length limits; bcrypt only uses the first 72 bytes
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+var (
+	errInvalidLogin  = errors.New("invalid credentials")
+	errUserNotFound  = errors.New("user not found")
+	errUserExists    = errors.New("user already exists")
+	errLastAdmin     = errors.New("at least one enabled admin must remain")
+	errWrongPassword = errors.New("current password is incorrect")
+	errExternalUser  = errors.New("the password of this user is managed by its identity provider")
+	errUsersNotSaved = errors.New("users couldn't be saved")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]{0,63}$`)
+
+// dummyHash is compared against when a login names an unknown user, so the
+// response takes as long as for a known one
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// userRecord is what is persisted: the public fields plus the bcrypt hash
+type userRecord struct {
+	protocol.User
+	Hash string `json:"hash"`
+	// LegacyAdmin is the admin flag of stores that predate roles
+	LegacyAdmin bool `json:"admin,omitempty"`
+}
+
+// UserStore holds the middleware's accounts, persisted as a JSON file
+type UserStore struct {
+	mu    sync.Mutex
+	users map[string]*userRecord
+	path  string
+}
+
+// NewUserStore loads the users from path
+func NewUserStore(path string) (*UserStore, error) {
+	s := &UserStore{users: make(map[string]*userRecord), path: path}
+	var saved []*userRecord
+	if err := loadJSON(path, &saved); err != nil {
+		return nil, err
+	}
+	for _, u := range saved {
+		if u.Role == "" {
+			u.Role = protocol.RoleViewer
+			if u.LegacyAdmin {
+				u.Role = protocol.RoleAdmin
+			}
+			u.LegacyAdmin = false
+		}
+		s.users[u.Username] = u
+	}
+	return s, nil
+}
+
+func validatePassword(password string) error {
+	switch {
+	case len(password) < minPasswordLength:
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	case len(password) > maxPasswordLength:
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	}
+	return nil
+}
+
+// validateRole checks a role and the scope given to it
+func validateRole(role, scope string) error {
+	if _, ok := protocol.RolePermissions[role]; !ok {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	if scope == "" {
+		return nil
+	}
+	if role != protocol.RoleOperator {
+		return errors.New("only operators can be scoped")
+	}
+	_, err := ParseSelector(scope)
+	return err
+}
+
+func hashPassword(password string) (string, error) {
+	if err := validatePassword(password); err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Create adds a user
+func (s *UserStore) Create(req protocol.UserRequest, createdBy string) (protocol.User, error) {
+	req.Username = strings.TrimSpace(req.Username)
+	if !usernamePattern.MatchString(req.Username) {
+		return protocol.User{}, fmt.Errorf("invalid username %q", req.Username)
+	}
+	if req.Role == "" {
+		req.Role = protocol.RoleViewer
+	}
+	if err := validateRole(req.Role, req.Scope); err != nil {
+		return protocol.User{}, err
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return protocol.User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[req.Username]; ok {
+		return protocol.User{}, errUserExists
+	}
+	now := time.Now()
+	u := &userRecord{
+		User: protocol.User{
+			Username:          req.Username,
+			Role:              req.Role,
+			Scope:             req.Scope,
+			CreatedBy:         createdBy,
+			CreatedAt:         now,
+			PasswordChangedAt: now,
+		},
+		Hash: hash,
+	}
+	s.users[u.Username] = u
+	if err := s.persist(); err != nil {
+		delete(s.users, u.Username)
+		return protocol.User{}, err
+	}
+	return u.User, nil
+}
+
+// List returns every user, sorted by username
+func (s *UserStore) List() []protocol.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]protocol.User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u.User)
+	}
+	slices.SortFunc(list, func(a, b protocol.User) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return list
+}
+
+// Get returns a user
+func (s *UserStore) Get(username string) (protocol.User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return protocol.User{}, false
+	}
+	return u.User, true
+}
+
+// Empty reports whether no user has been created yet
+func (s *UserStore) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users) == 0
+}
+
+// Update changes a user's role, scope, disabled flag or password. Changing
+// the role away from operator drops the scope.
+func (s *UserStore) Update(username string, update protocol.UserUpdate) (protocol.User, error) {
+	var hash string
+	if update.Password != nil {
+		var err error
+		if hash, err = hashPassword(*update.Password); err != nil {
+			return protocol.User{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return protocol.User{}, errUserNotFound
+	}
+	if hash != "" && u.Provider != "" {
+		return protocol.User{}, errExternalUser
+	}
+	role, scope := u.Role, u.Scope
+	if update.Role != nil && *update.Role != role {
+		role, scope = *update.Role, ""
+	}
+	if update.Scope != nil {
+		scope = *update.Scope
+	}
+	if err := validateRole(role, scope); err != nil {
+		return protocol.User{}, err
+	}
+	demoted := role != protocol.RoleAdmin || (update.Disabled != nil && *update.Disabled)
+	if demoted && s.isLastAdmin(u) {
+		return protocol.User{}, errLastAdmin
+	}
+
+	prev := *u
+	u.Role, u.Scope = role, scope
+	if update.Disabled != nil {
+		u.Disabled = *update.Disabled
+	}
+	if hash != "" {
+		u.Hash = hash
+		u.PasswordChangedAt = time.Now()
+	}
+	if err := s.persist(); err != nil {
+		*u = prev
+		return protocol.User{}, err
+	}
+	return u.User, nil
+}
+
+// Delete removes a user
+func (s *UserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	if s.isLastAdmin(u) {
+		return errLastAdmin
+	}
+	delete(s.users, username)
+	if err := s.persist(); err != nil {
+		s.users[username] = u
+		return err
+	}
+	return nil
+}
+
+// isLastAdmin reports whether u is the only enabled admin. Callers must hold
+// the lock.
+func (s *UserStore) isLastAdmin(u *userRecord) bool {
+	if u.Role != protocol.RoleAdmin || u.Disabled {
+		return false
+	}
+	for _, other := range s.users {
+		if other != u && other.Role == protocol.RoleAdmin && !other.Disabled {
+			return false
+		}
+	}
+	return true
+}
+
+// Authenticate checks a username and password and records the login.
+// Unknown users, wrong passwords and disabled accounts all fail the same way.
+func (s *UserStore) Authenticate(username, password string) (protocol.User, error) {
+	s.mu.Lock()
+	u, ok := s.users[username]
+	hash := dummyHash
+	if ok && u.Hash != "" {
+		hash = []byte(u.Hash)
+	}
+	s.mu.Unlock()
+
+	// Compare outside the lock; bcrypt is deliberately slow
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok || err != nil || u.Disabled || u.Provider != "" {
+		return protocol.User{}, errInvalidLogin
+	}
+	now := time.Now()
+	u.LastLoginAt = &now
+	// Failing to record the login time doesn't fail the login
+	_ = s.persist()
+	return u.User, nil
+}
+
+// ChangePassword sets a user's password after checking the current one
+func (s *UserStore) ChangePassword(username, current, next string) error {
+	s.mu.Lock()
+	u, ok := s.users[username]
+	var hash []byte
+	if ok {
+		hash = []byte(u.Hash)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errUserNotFound
+	}
+	if u.Provider != "" {
+		return errExternalUser
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(current)) != nil {
+		return errWrongPassword
+	}
+
+	_, err := s.Update(username, protocol.UserUpdate{Password: &next})
+	return err
+}
+
+// LoginExternal records the login of a user authenticated by an identity
+// provider, creating the user on first login. Users are matched by the
+// issuer and subject the provider identifies them with, which don't change;
+// username only names the user when it is created, and can't be one that is
+// already taken. The role comes from the provider and replaces the stored
+// one; a scope set by an admin is kept while the user stays an operator.
+// Disabled users are refused.
+func (s *UserStore) LoginExternal(provider, issuer, subject, username, role string) (protocol.User, error) {
+	if issuer == "" || subject == "" {
+		return protocol.User{}, errors.New("missing issuer or subject")
+	}
+	if err := validateRole(role, ""); err != nil {
+		return protocol.User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var u *userRecord
+	for _, rec := range s.users {
+		if rec.Provider == provider && rec.Issuer == issuer && rec.Subject == subject {
+			u = rec
+			break
+		}
+	}
+	if u == nil {
+		if !usernamePattern.MatchString(username) {
+			return protocol.User{}, fmt.Errorf("invalid username %q", username)
+		}
+		if existing, ok := s.users[username]; ok {
+			if existing.Provider == "" {
+				return protocol.User{}, fmt.Errorf("%w: %s is a local user", errUserExists, username)
+			}
+			return protocol.User{}, fmt.Errorf("%w: %s belongs to another %s identity", errUserExists, username, existing.Provider)
+		}
+		u = &userRecord{User: protocol.User{
+			Username:          username,
+			Role:              role,
+			Provider:          provider,
+			Issuer:            issuer,
+			Subject:           subject,
+			CreatedBy:         provider,
+			CreatedAt:         now,
+			PasswordChangedAt: now,
+		}}
+		s.users[username] = u
+	}
+	if u.Disabled {
+		return protocol.User{}, errInvalidLogin
+	}
+	if role != u.Role {
+		if role != protocol.RoleAdmin && s.isLastAdmin(u) {
+			return protocol.User{}, errLastAdmin
+		}
+		u.Role, u.Scope = role, ""
+	}
+	u.LastLoginAt = &now
+	// The user can log in even if this couldn't be saved
+	_ = s.persist()
+	return u.User, nil
+}
+
+// persist writes the store to disk. Callers must hold the lock.
+func (s *UserStore) persist() error {
+	list := make([]*userRecord, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	if err := saveJSON(s.path, list); err != nil {
+		log.Printf("[Users] Failed to persist users: %v", err)
+		return fmt.Errorf("%w: %v", errUsersNotSaved, err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Package pki is a minimal certificate authority for mutual TLS between the
+// middleware and its agents. Agent certificates carry the agent ID as their
+// common name.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File names inside a CA directory. Agent certificates are kept in their
+// own subdirectory, so that agent IDs can't clash with the CA's files.
+const (
+	CACertFile = "ca.crt"
+	CAKeyFile  = "ca.key"
+	AgentsDir  = "agents"
+)
+
+// CA is a certificate authority loaded from disk
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Init creates a new CA in dir. It refuses to overwrite an existing one.
+func Init(dir, name string, validity time.Duration) error {
+	certPath := filepath.Join(dir, CACertFile)
+	if _, err := os.Stat(certPath); err == nil {
+		return fmt.Errorf("a CA already exists in %s", dir)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template(name, validity)
+	if err != nil {
+		return err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return writePair(dir, "ca", der, key)
+}
+
+// Load reads the CA in dir
+func Load(dir string) (*CA, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, CACertFile))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("invalid CA certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid CA key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key type")
+	}
+	return &CA{Cert: cert, Key: signer}, nil
+}
+
+// IssueServer issues a certificate for the middleware, valid for the given
+// host names and IP addresses, and writes it to dir as <name>.crt/.key
+func (ca *CA) IssueServer(dir, name string, hosts []string, validity time.Duration) error {
+	tmpl, err := template(name, validity)
+	if err != nil {
+		return err
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return ca.issue(dir, name, tmpl)
+}
+
+// AgentCertPath returns the path of an agent's certificate in a CA
+// directory; its key is next to it, with a .key extension
+func AgentCertPath(dir, agentID string) string {
+	return filepath.Join(dir, AgentsDir, agentID+".crt")
+}
+
+// IssueAgent issues a client certificate whose common name is the agent ID
+// and writes it to the agents subdirectory of dir as <agentID>.crt/.key. It
+// refuses to replace an existing certificate unless replace is set.
+func (ca *CA) IssueAgent(dir, agentID string, validity time.Duration, replace bool) error {
+	certPath := AgentCertPath(dir, agentID)
+	if _, err := os.Stat(certPath); err == nil && !replace {
+		return fmt.Errorf("a certificate for agent %s already exists in %s", agentID, certPath)
+	}
+	agentsDir := filepath.Dir(certPath)
+	if err := os.MkdirAll(agentsDir, 0o700); err != nil {
+		return err
+	}
+
+	tmpl, err := template(agentID, validity)
+	if err != nil {
+		return err
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.issue(agentsDir, agentID, tmpl)
+}
+
+func (ca *CA) issue(dir, name string, tmpl *x509.Certificate) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return err
+	}
+	return writePair(dir, name, der, key)
+}
+
+func template(name string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// writePair writes a certificate and its private key as PEM files
+func writePair(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600)
+}
+
+// CertPool reads a PEM bundle of CA certificates
+func CertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/Patopm/remote-monitor/internal/protocol"
 
@@ -23,24 +25,38 @@ func ListProcesses() ([]protocol.ProcessInfo, error) {
 		name, _ := p.Name()
 		cpu, _ := p.CPUPercent()
 		mem, _ := p.MemoryPercent()
+		cmdline, _ := p.Cmdline()
 
 		list = append(list, protocol.ProcessInfo{
-			PID:    p.Pid,
-			Name:   name,
-			CPU:    cpu,
-			Memory: mem,
+			PID:     p.Pid,
+			Name:    name,
+			Cmdline: cmdline,
+			CPU:     cpu,
+			Memory:  mem,
 		})
 	}
 	return list, nil
 }
 
-func StopProcess(pidStr string) error {
+// signals maps the accepted signal names to their values
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+func findProcess(pidStr string) (*os.Process, error) {
 	pid, err := strconv.ParseInt(pidStr, 10, 32)
 	if err != nil {
-		return fmt.Errorf("PID inválido: %v", err)
+		return nil, fmt.Errorf("PID inválido: %v", err)
 	}
+	return os.FindProcess(int(pid))
+}
 
-	p, err := os.FindProcess(int(pid))
+func StopProcess(pidStr string) error {
+	p, err := findProcess(pidStr)
 	if err != nil {
 		return err
 	}
@@ -48,18 +64,45 @@ func StopProcess(pidStr string) error {
 	return p.Kill()
 }
 
-func StartProcess(path string) error {
-	cmd := exec.Command(path)
-	err := cmd.Start()
+// SignalProcess sends a named signal (e.g. "HUP" or "SIGHUP") to a process
+func SignalProcess(pidStr, name string) error {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return fmt.Errorf("señal desconocida: %s", name)
+	}
+
+	p, err := findProcess(pidStr)
 	if err != nil {
 		return err
 	}
 
+	return p.Signal(sig)
+}
+
+// startCommand launches path with args and extra "KEY=value" environment
+// entries on top of the agent's own environment
+func startCommand(path string, args, env []string) (*exec.Cmd, error) {
+	cmd := exec.Command(path, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func StartProcess(path string, args ...string) (int, error) {
+	cmd, err := startCommand(path, args, nil)
+	if err != nil {
+		return 0, err
+	}
+
 	go func() {
 		err := cmd.Wait()
 		if err != nil {
 			fmt.Printf("El proceso %s terminó con error: %v\n", path, err)
 		}
 	}()
-	return nil
+	return cmd.Process.Pid, nil
 }
@@ -0,0 +1,342 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Patopm/remote-monitor/internal/protocol"
+)
+
+const (
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = time.Minute
+	// stableAfter is how long a process must run for its restart backoff
+	// and crash-loop counter to reset
+	stableAfter = 30 * time.Second
+	// stopTimeout is how long a stopping service gets to exit after SIGTERM
+	stopTimeout = 10 * time.Second
+)
+
+// Supervisor keeps declared services running, restarting them according to
+// their restart policy. Service definitions are persisted so supervision
+// resumes when the agent restarts.
+type Supervisor struct {
+	mu       sync.Mutex
+	services map[string]*service
+	// stopping holds deleted services until their process has exited, so a
+	// service put again under the same name doesn't overlap with them
+	stopping map[string]*service
+	path     string
+}
+
+// service is a single supervised process
+type service struct {
+	spec       protocol.ServiceSpec
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu     sync.Mutex
+	status protocol.ServiceStatus
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewSupervisor loads the service definitions from path and starts them
+func NewSupervisor(path string) (*Supervisor, error) {
+	s := &Supervisor{
+		services: make(map[string]*service),
+		stopping: make(map[string]*service),
+		path:     path,
+	}
+
+	var specs []protocol.ServiceSpec
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &specs); err != nil {
+			return nil, fmt.Errorf("invalid services file %s: %w", path, err)
+		}
+	}
+
+	for _, spec := range specs {
+		svc, err := newService(spec)
+		if err != nil {
+			log.Printf("[Supervisor] Skipping service %q: %v", spec.Name, err)
+			continue
+		}
+		s.services[spec.Name] = svc
+		go svc.run()
+	}
+	return s, nil
+}
+
+// Put creates or replaces a service. The definition is saved before it
+// returns; the previous process, if any, is then stopped and the new one
+// started in the background.
+func (s *Supervisor) Put(spec protocol.ServiceSpec) error {
+	svc, err := newService(spec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	prev, replaced := s.services[spec.Name]
+	s.services[spec.Name] = svc
+	if err := s.persist(); err != nil {
+		if replaced {
+			s.services[spec.Name] = prev
+		} else {
+			delete(s.services, spec.Name)
+		}
+		s.mu.Unlock()
+		return err
+	}
+	if !replaced {
+		prev = s.stopping[spec.Name]
+	}
+	s.mu.Unlock()
+
+	go func() {
+		if prev != nil {
+			prev.shutdown()
+		}
+		svc.run()
+	}()
+	return nil
+}
+
+// Delete forgets a service and stops its process in the background
+func (s *Supervisor) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	svc, ok := s.services[name]
+	if !ok {
+		return fmt.Errorf("unknown service: %s", name)
+	}
+	delete(s.services, name)
+	if err := s.persist(); err != nil {
+		s.services[name] = svc
+		return err
+	}
+	s.stopping[name] = svc
+
+	go func() {
+		svc.shutdown()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.stopping[name] == svc {
+			delete(s.stopping, name)
+		}
+	}()
+	return nil
+}
+
+// Status returns the state of every service, sorted by name
+func (s *Supervisor) Status() []protocol.ServiceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]protocol.ServiceStatus, 0, len(s.services))
+	for _, svc := range s.services {
+		svc.mu.Lock()
+		list = append(list, svc.status)
+		svc.mu.Unlock()
+	}
+	slices.SortFunc(list, func(a, b protocol.ServiceStatus) int {
+		return strings.Compare(a.Spec.Name, b.Spec.Name)
+	})
+	return list
+}
+
+// persist writes the service definitions to disk. Callers must hold the lock.
+func (s *Supervisor) persist() error {
+	specs := make([]protocol.ServiceSpec, 0, len(s.services))
+	for _, svc := range s.services {
+		specs = append(specs, svc.spec)
+	}
+	slices.SortFunc(specs, func(a, b protocol.ServiceSpec) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	data, err := json.MarshalIndent(specs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func newService(spec protocol.ServiceSpec) (*service, error) {
+	if spec.Name == "" || spec.Command == "" {
+		return nil, errors.New("name and command are required")
+	}
+	switch spec.RestartPolicy {
+	case "":
+		spec.RestartPolicy = protocol.RestartAlways
+	case protocol.RestartAlways, protocol.RestartOnFailure:
+	default:
+		return nil, fmt.Errorf("unknown restart policy: %s", spec.RestartPolicy)
+	}
+
+	svc := &service{
+		spec:       spec,
+		backoff:    defaultBackoff,
+		maxBackoff: defaultMaxBackoff,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if spec.Backoff != "" {
+		d, err := time.ParseDuration(spec.Backoff)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid backoff: %s", spec.Backoff)
+		}
+		svc.backoff = d
+	}
+	if spec.MaxBackoff != "" {
+		d, err := time.ParseDuration(spec.MaxBackoff)
+		if err != nil || d < svc.backoff {
+			return nil, fmt.Errorf("invalid max_backoff: %s", spec.MaxBackoff)
+		}
+		svc.maxBackoff = d
+	}
+	svc.status = protocol.ServiceStatus{Spec: spec.Redacted(), State: protocol.ServiceBackoff}
+	return svc, nil
+}
+
+// shutdown stops the supervision loop and waits for the process to exit. It
+// can be called more than once.
+func (svc *service) shutdown() {
+	svc.stopOnce.Do(func() { close(svc.stop) })
+	<-svc.done
+}
+
+// run is the supervision loop: start, wait, then restart with backoff
+func (svc *service) run() {
+	defer close(svc.done)
+
+	backoff := svc.backoff
+	failures := 0
+
+	for {
+		startedAt := time.Now()
+		cmd, err := startCommand(svc.spec.Command, svc.spec.Args, svc.spec.Env)
+		exitCode := -1
+
+		if err != nil {
+			svc.update(func(st *protocol.ServiceStatus) {
+				st.LastError = err.Error()
+				st.PID = 0
+			})
+		} else {
+			log.Printf("[Supervisor] Service %q started (PID %d)", svc.spec.Name, cmd.Process.Pid)
+			svc.update(func(st *protocol.ServiceStatus) {
+				st.State = protocol.ServiceRunning
+				st.PID = cmd.Process.Pid
+				st.StartedAt = &startedAt
+				st.NextStart = nil
+			})
+
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+
+			select {
+			case err = <-exited:
+			case <-svc.stop:
+				terminate(cmd, exited)
+				svc.update(func(st *protocol.ServiceStatus) {
+					st.State = protocol.ServiceStopped
+					st.PID = 0
+				})
+				return
+			}
+
+			exitCode = cmd.ProcessState.ExitCode()
+			now := time.Now()
+			svc.update(func(st *protocol.ServiceStatus) {
+				st.PID = 0
+				st.LastExit = &now
+				st.ExitCode = exitCode
+				st.LastError = ""
+				if err != nil {
+					st.LastError = err.Error()
+				}
+			})
+			log.Printf("[Supervisor] Service %q exited with code %d", svc.spec.Name, exitCode)
+
+			if exitCode == 0 && svc.spec.RestartPolicy == protocol.RestartOnFailure {
+				svc.update(func(st *protocol.ServiceStatus) { st.State = protocol.ServiceExited })
+				<-svc.stop
+				return
+			}
+		}
+
+		if time.Since(startedAt) >= stableAfter {
+			backoff = svc.backoff
+			failures = 0
+		}
+		failures++
+
+		if svc.spec.MaxRestarts > 0 && failures > svc.spec.MaxRestarts {
+			log.Printf("[Supervisor] Service %q is crash-looping, giving up", svc.spec.Name)
+			svc.update(func(st *protocol.ServiceStatus) { st.State = protocol.ServiceCrashLoop })
+			<-svc.stop
+			return
+		}
+
+		next := time.Now().Add(backoff)
+		svc.update(func(st *protocol.ServiceStatus) {
+			st.State = protocol.ServiceBackoff
+			st.NextStart = &next
+		})
+
+		select {
+		case <-time.After(backoff):
+		case <-svc.stop:
+			svc.update(func(st *protocol.ServiceStatus) {
+				st.State = protocol.ServiceStopped
+				st.NextStart = nil
+			})
+			return
+		}
+		backoff = min(backoff*2, svc.maxBackoff)
+
+		svc.update(func(st *protocol.ServiceStatus) { st.Restarts++ })
+	}
+}
+
+func (svc *service) update(fn func(*protocol.ServiceStatus)) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	fn(&svc.status)
+}
+
+// terminate asks the process to exit and kills it after stopTimeout
+func terminate(cmd *exec.Cmd, exited <-chan error) {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		_ = cmd.Process.Kill()
+	}
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"time"
+)
+
+// TelemetryDelta describes how the process list changed since the sample
+// numbered Seq-1. The receiver must hold that sample as its baseline to
+// apply it; otherwise it asks for a full snapshot with a "resync" message.
+type TelemetryDelta struct {
+	Seq       uint64          `json:"seq"`
+	Timestamp time.Time       `json:"timestamp"`
+	Added     []ProcessInfo   `json:"added,omitempty"`
+	Changed   []ProcessInfo   `json:"changed,omitempty"`
+	Removed   []int32         `json:"removed,omitempty"`
+	Services  []ServiceStatus `json:"services,omitempty"`
+}
+
+// Minimum change, in percentage points, for a process's CPU or memory usage
+// to be reported in a delta. Smaller fluctuations, which gopsutil reports on
+// nearly every sample, are left out.
+const (
+	CPUDeltaThreshold    = 0.5
+	MemoryDeltaThreshold = 0.1
+)
+
+// DiffProcesses computes the process changes from base to current. A process
+// counts as changed if its name or command line differ, or if its CPU or
+// memory usage moved by at least the thresholds.
+func DiffProcesses(base, current []ProcessInfo) (added, changed []ProcessInfo, removed []int32) {
+	prev := make(map[int32]ProcessInfo, len(base))
+	for _, p := range base {
+		prev[p.PID] = p
+	}
+	for _, p := range current {
+		old, ok := prev[p.PID]
+		switch {
+		case !ok:
+			added = append(added, p)
+		case processChanged(old, p):
+			changed = append(changed, p)
+		}
+		delete(prev, p.PID)
+	}
+	for pid := range prev {
+		removed = append(removed, pid)
+	}
+	slices.Sort(removed)
+	return added, changed, removed
+}
+
+func processChanged(old, p ProcessInfo) bool {
+	return old.Name != p.Name || old.Cmdline != p.Cmdline ||
+		math.Abs(p.CPU-old.CPU) >= CPUDeltaThreshold ||
+		math.Abs(float64(p.Memory-old.Memory)) >= MemoryDeltaThreshold
+}
+
+// ApplyDelta returns the process list that results from applying the
+// delta's changes to base, sorted by PID
+func ApplyDelta(base []ProcessInfo, d TelemetryDelta) []ProcessInfo {
+	procs := make(map[int32]ProcessInfo, len(base)+len(d.Added))
+	for _, p := range base {
+		procs[p.PID] = p
+	}
+	for _, pid := range d.Removed {
+		delete(procs, pid)
+	}
+	for _, p := range d.Added {
+		procs[p.PID] = p
+	}
+	for _, p := range d.Changed {
+		procs[p.PID] = p
+	}
+
+	list := make([]ProcessInfo, 0, len(procs))
+	for _, p := range procs {
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b ProcessInfo) int {
+		return cmp.Compare(a.PID, b.PID)
+	})
+	return list
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// ValidateLabels checks that label keys and values can be used in selectors
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if k == "" || strings.ContainsAny(k, ",=! \t") {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if strings.ContainsAny(v, ",=! \t") {
+			return fmt.Errorf("invalid value for label %q: %q", k, v)
+		}
+	}
+	return nil
+}
+
+// ParseLabels parses a comma-separated list of key=value pairs such as
+// "env=prod,role=db"
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for pair := range strings.SplitSeq(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", pair)
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	if err := ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// MergeLabels returns the agent's labels overridden by the custom ones
+func MergeLabels(agent, custom map[string]string) map[string]string {
+	if len(agent) == 0 && len(custom) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(agent)+len(custom))
+	maps.Copy(merged, agent)
+	maps.Copy(merged, custom)
+	return merged
+}
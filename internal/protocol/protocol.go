@@ -3,15 +3,17 @@ package protocol
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
 )
 
 // ProcessInfo represents the data of a running process
 type ProcessInfo struct {
-	PID    int32   `json:"pid"`
-	Name   string  `json:"name"`
-	CPU    float64 `json:"cpu"`
-	Memory float32 `json:"memory"`
+	PID     int32   `json:"pid"`
+	Name    string  `json:"name"`
+	Cmdline string  `json:"cmdline,omitempty"`
+	CPU     float64 `json:"cpu"`
+	Memory  float32 `json:"memory"`
 }
 
 // --- WebSocket Messages (Agent <-> Middleware) ---
@@ -24,21 +26,237 @@ type WSMessage struct {
 
 // AgentRegistration is sent by the agent upon connecting
 type AgentRegistration struct {
-	Hostname  string `json:"hostname"`
-	OS        string `json:"os"`
-	SecretKey string `json:"secret_key"`
+	Hostname  string            `json:"hostname"`
+	OS        string            `json:"os"`
+	SecretKey string            `json:"secret_key,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Facts     *HostFacts        `json:"facts,omitempty"`
+	// An agent authenticates with its credential, or with an enrollment
+	// token it exchanges for one. SecretKey is the legacy shared secret.
+	Credential      string `json:"credential,omitempty"`
+	EnrollmentToken string `json:"enrollment_token,omitempty"`
+	// AgentID is the ID assigned on a previous connection, sent by agents on
+	// the shared secret to keep it. Credentials and certificates carry the
+	// agent's ID instead.
+	AgentID string `json:"agent_id,omitempty"`
+	// Encoding is the telemetry encoding the agent prefers, JSON if empty
+	Encoding string `json:"encoding,omitempty"`
+	// ProtocolVersion is zero for agents that predate version negotiation
+	ProtocolVersion int           `json:"protocol_version,omitempty"`
+	Capabilities    *Capabilities `json:"capabilities,omitempty"`
+}
+
+// Protocol versions. Version 1 agents predate negotiation: they send no
+// version or capabilities and get no register_ack. Version 2 adds both.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Telemetry features an agent can support
+const (
+	FeatureDelta    = "delta"
+	FeatureBackfill = "backfill"
+)
+
+// Capabilities lists what an agent supports, sent on registration
+type Capabilities struct {
+	Actions   []string `json:"actions"`
+	Encodings []string `json:"encodings"`
+	Telemetry []string `json:"telemetry,omitempty"`
+}
+
+// How an agent authenticated
+const (
+	AuthCertificate  = "certificate"
+	AuthCredential   = "credential"
+	AuthSharedSecret = "shared_secret"
+)
+
+// Registration rejection codes
+const (
+	RejectInvalidPayload = "invalid_payload"
+	RejectUnauthorized   = "unauthorized"
+	RejectInvalidLabels  = "invalid_labels"
+	RejectIncompatible   = "incompatible"
+	RejectRevoked        = "revoked"
+	RejectDuplicate      = "already_connected"
+)
+
+// RegisterReject is the hub's reply to a registration it refuses, sent just
+// before closing the connection
+type RegisterReject struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+	// Permanent rejections, for bad or revoked credentials, won't go away
+	// by retrying: the agent's credentials must change first
+	Permanent bool `json:"permanent"`
+}
+
+// RegisterAck is the hub's reply to a successful registration, with the
+// settings negotiated for the connection
+type RegisterAck struct {
+	AgentID         string   `json:"agent_id"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Encoding        string   `json:"encoding"`
+	Telemetry       []string `json:"telemetry,omitempty"`
+	// Credential is issued once, when the agent enrolls. The agent must
+	// persist it and authenticate with it from then on.
+	Credential string `json:"credential,omitempty"`
+}
+
+// HostFacts is the hardware and software inventory of an agent's host, sent
+// on registration and in a "facts" message whenever it changes
+type HostFacts struct {
+	AgentVersion    string          `json:"agent_version"`
+	HostID          string          `json:"host_id,omitempty"`
+	Kernel          string          `json:"kernel,omitempty"`
+	Arch            string          `json:"arch,omitempty"`
+	Platform        string          `json:"platform,omitempty"`
+	PlatformFamily  string          `json:"platform_family,omitempty"`
+	PlatformVersion string          `json:"platform_version,omitempty"`
+	CPUModel        string          `json:"cpu_model,omitempty"`
+	CPUCount        int             `json:"cpu_count"`
+	MemoryTotal     uint64          `json:"memory_total"`
+	Disks           []DiskFact      `json:"disks,omitempty"`
+	Interfaces      []InterfaceFact `json:"interfaces,omitempty"`
+	BootTime        time.Time       `json:"boot_time"`
+	Virtualization  string          `json:"virtualization,omitempty"`
+	// AgentPID is the agent's own process, which remediation never stops
+	AgentPID int32 `json:"agent_pid,omitempty"`
+}
+
+// DiskFact describes a mounted filesystem
+type DiskFact struct {
+	Device     string `json:"device"`
+	Mountpoint string `json:"mountpoint"`
+	FSType     string `json:"fstype"`
+	Total      uint64 `json:"total"`
+}
+
+// InterfaceFact describes a network interface and its addresses
+type InterfaceFact struct {
+	Name  string   `json:"name"`
+	MAC   string   `json:"mac,omitempty"`
+	Addrs []string `json:"addrs,omitempty"`
 }
 
 // AgentTelemetry contains cached process data sent periodically
 type AgentTelemetry struct {
-	Processes []ProcessInfo `json:"processes"`
+	// Timestamp is when the sample was taken on the agent
+	Timestamp time.Time `json:"timestamp,omitzero"`
+	// Seq numbers live samples so later deltas can be applied on top of
+	// this one. Zero means the sample can't be used as a delta baseline.
+	Seq       uint64          `json:"seq,omitempty"`
+	Processes []ProcessInfo   `json:"processes"`
+	Services  []ServiceStatus `json:"services,omitempty"`
+}
+
+// TelemetryBatch carries samples the agent buffered while disconnected,
+// oldest first
+type TelemetryBatch struct {
+	Samples []AgentTelemetry `json:"samples"`
+	// Dropped is the number of samples discarded because the buffer was full
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// TelemetrySample is a summarized point in an agent's telemetry history
+type TelemetrySample struct {
+	Timestamp  time.Time `json:"timestamp"`
+	ReceivedAt time.Time `json:"received_at"`
+	// Backfilled samples were taken while the agent was disconnected
+	Backfilled   bool    `json:"backfilled"`
+	ProcessCount int     `json:"process_count"`
+	CPU          float64 `json:"cpu"`
+	Memory       float64 `json:"memory"`
+}
+
+// Service restart policies
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+)
+
+// ServiceSpec declares a process the agent keeps running. Backoff and
+// MaxBackoff are durations such as "1s"; MaxRestarts bounds consecutive
+// quick restarts before the service is declared crash-looping (0 = no limit).
+type ServiceSpec struct {
+	Name          string   `json:"name"`
+	Command       string   `json:"command"`
+	Args          []string `json:"args,omitempty"`
+	Env           []string `json:"env,omitempty"`
+	RestartPolicy string   `json:"restart_policy"`
+	Backoff       string   `json:"backoff,omitempty"`
+	MaxBackoff    string   `json:"max_backoff,omitempty"`
+	MaxRestarts   int      `json:"max_restarts,omitempty"`
+}
+
+// RedactedValue stands in for the values of a service's environment variables
+// wherever its spec is reported back
+const RedactedValue = "<redacted>"
+
+// Redacted returns a copy of the spec with the values of its environment
+// variables hidden, for reporting it back in telemetry and through the API
+func (s ServiceSpec) Redacted() ServiceSpec {
+	if len(s.Env) == 0 {
+		return s
+	}
+	env := make([]string, len(s.Env))
+	for i, kv := range s.Env {
+		name, _, _ := strings.Cut(kv, "=")
+		env[i] = name + "=" + RedactedValue
+	}
+	s.Env = env
+	return s
+}
+
+// Service states reported by the agent
+const (
+	ServiceRunning   = "running"
+	ServiceBackoff   = "backoff"
+	ServiceExited    = "exited"
+	ServiceCrashLoop = "crash-loop"
+	ServiceStopped   = "stopped"
+)
+
+// ServiceStatus is the supervision state of a service on an agent
+type ServiceStatus struct {
+	Spec      ServiceSpec `json:"spec"`
+	State     string      `json:"state"`
+	PID       int         `json:"pid,omitempty"`
+	Restarts  int         `json:"restarts"`
+	StartedAt *time.Time  `json:"started_at,omitempty"`
+	LastExit  *time.Time  `json:"last_exit,omitempty"`
+	ExitCode  int         `json:"exit_code,omitempty"`
+	LastError string      `json:"last_error,omitempty"`
+	NextStart *time.Time  `json:"next_start,omitempty"`
 }
 
+// Command actions understood by the agent
+const (
+	ActionStop   = "STOP"
+	ActionSignal = "SIGNAL"
+	ActionStart  = "START"
+
+	// Service supervision; the target is the service name
+	ActionServicePut    = "SERVICE_PUT"
+	ActionServiceDelete = "SERVICE_DELETE"
+)
+
 // AgentCommand is sent from middleware to agent
 type AgentCommand struct {
-	CommandID string `json:"command_id"`
-	Action    string `json:"action"`
-	Target    string `json:"target"`
+	CommandID string   `json:"command_id"`
+	Action    string   `json:"action"`
+	Target    string   `json:"target"`
+	Signal    string   `json:"signal,omitempty"`
+	Args      []string `json:"args,omitempty"`
+
+	Service *ServiceSpec `json:"service,omitempty"`
+
+	// Set by the middleware when it signs the command, see SignCommand
+	AgentID   string    `json:"agent_id,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Signature []byte    `json:"signature,omitempty"`
 }
 
 // AgentCommandResponse is the agent's reply to a command
@@ -50,13 +268,46 @@ type AgentCommandResponse struct {
 
 // --- REST API Types (Frontend <-> Middleware) ---
 
-// AgentInfo represents a connected agent exposed via the API
+// AgentInfo represents a connected agent exposed via the API.
+// Labels is the effective label set: the agent's own labels overridden by
+// the ones edited on the middleware.
 type AgentInfo struct {
-	ID          string    `json:"id"`
-	Hostname    string    `json:"hostname"`
-	OS          string    `json:"os"`
-	ConnectedAt time.Time `json:"connected_at"`
-	LastSeen    time.Time `json:"last_seen"`
+	ID           string            `json:"id"`
+	Hostname     string            `json:"hostname"`
+	OS           string            `json:"os"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	AgentLabels  map[string]string `json:"agent_labels,omitempty"`
+	CustomLabels map[string]string `json:"custom_labels,omitempty"`
+	AgentVersion string            `json:"agent_version,omitempty"`
+	Facts        *HostFacts        `json:"facts,omitempty"`
+	Encoding     string            `json:"encoding,omitempty"`
+	Compression  bool              `json:"compression"`
+	Auth         string            `json:"auth,omitempty"`
+	// ProtocolVersion and Capabilities are as negotiated on registration
+	ProtocolVersion int               `json:"protocol_version,omitempty"`
+	Capabilities    *Capabilities     `json:"capabilities,omitempty"`
+	ConnectedAt     time.Time         `json:"connected_at"`
+	LastSeen        time.Time         `json:"last_seen"`
+	Health          *ConnectionHealth `json:"health,omitempty"`
+}
+
+// Connection health statuses
+const (
+	HealthHealthy = "healthy"
+	HealthStale   = "stale"
+)
+
+// ConnectionHealth describes the heartbeat state of an agent's connection
+type ConnectionHealth struct {
+	Status           string     `json:"status"`
+	RTTMillis        float64    `json:"rtt_ms"`
+	MissedHeartbeats int        `json:"missed_heartbeats"`
+	LastPong         *time.Time `json:"last_pong,omitempty"`
+}
+
+// LabelsRequest is the JSON body to replace an agent's middleware-side labels
+type LabelsRequest struct {
+	Labels map[string]string `json:"labels"`
 }
 
 // KillRequest is the JSON body for the kill endpoint
@@ -64,6 +315,262 @@ type KillRequest struct {
 	PID string `json:"pid"`
 }
 
+// Process query match modes
+const (
+	ProcessMatchExact = "exact"
+	ProcessMatchGlob  = "glob"
+	ProcessMatchRegex = "regex"
+)
+
+// MaxProcessTargets is the most PIDs a process query can stop or signal
+// without Confirm being set
+const MaxProcessTargets = 10
+
+// BulkCommandRequest is the JSON body for the bulk command endpoint.
+// Agents are selected by explicit IDs, a label selector (e.g. "os=linux")
+// and/or a process query; every given criterion must match. The process
+// query matches names exactly unless ProcessMatch is "glob" or "regex".
+// Without a target, STOP and SIGNAL go to every matching PID, and more than
+// MaxProcessTargets of them must be confirmed. With QueueTTL set, known
+// agents that are offline get the command queued until they reconnect or
+// the TTL elapses; this is refused for STOP and SIGNAL, whose PIDs may have
+// been reused by then.
+type BulkCommandRequest struct {
+	AgentIDs     []string `json:"agent_ids,omitempty"`
+	Selector     string   `json:"selector,omitempty"`
+	Process      string   `json:"process,omitempty"`
+	ProcessMatch string   `json:"process_match,omitempty"`
+	Confirm      bool     `json:"confirm,omitempty"`
+	Action       string   `json:"action"`
+	Target       string   `json:"target,omitempty"`
+	Signal       string   `json:"signal,omitempty"`
+	Args         []string `json:"args,omitempty"`
+	MaxParallel  int      `json:"max_parallel,omitempty"`
+	QueueTTL     string   `json:"queue_ttl,omitempty"`
+}
+
+// BulkCommandResult is the outcome of a single command within a bulk request
+type BulkCommandResult struct {
+	JobID    string `json:"job_id,omitempty"`
+	AgentID  string `json:"agent_id"`
+	Hostname string `json:"hostname"`
+	Target   string `json:"target"`
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+}
+
+// Aggregate statuses of a bulk command
+const (
+	BulkStatusSucceeded = "succeeded"
+	BulkStatusPartial   = "partial"
+	BulkStatusFailed    = "failed"
+	BulkStatusQueued    = "queued"
+)
+
+// BulkCommandResponse aggregates the per-agent results of a bulk command
+type BulkCommandResponse struct {
+	Status    string              `json:"status"`
+	Total     int                 `json:"total"`
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Results   []BulkCommandResult `json:"results"`
+}
+
+// Command job states
+const (
+	JobQueued    = "queued"
+	JobSent      = "sent"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobTimedOut  = "timed-out"
+	JobExpired   = "expired"
+)
+
+// CommandJob is the record of a command dispatched to an agent
+type CommandJob struct {
+	ID        string       `json:"id"`
+	AgentID   string       `json:"agent_id"`
+	Hostname  string       `json:"hostname,omitempty"`
+	Action    string       `json:"action"`
+	Target    string       `json:"target"`
+	Signal    string       `json:"signal,omitempty"`
+	Args      []string     `json:"args,omitempty"`
+	Service   *ServiceSpec `json:"service,omitempty"`
+	State     string       `json:"state"`
+	Requester string       `json:"requester"`
+	// Via is the schedule or desired state that issued the command on the
+	// requester's behalf, e.g. "schedule:<id>"
+	Via      string `json:"via,omitempty"`
+	SourceIP string `json:"source_ip,omitempty"`
+	// ProcessName is the name of the target process when the command was
+	// requested, for commands targeting a PID
+	ProcessName string                `json:"process_name,omitempty"`
+	CreatedAt   time.Time             `json:"created_at"`
+	ExpiresAt   *time.Time            `json:"expires_at,omitempty"`
+	SentAt      *time.Time            `json:"sent_at,omitempty"`
+	CompletedAt *time.Time            `json:"completed_at,omitempty"`
+	Response    *AgentCommandResponse `json:"response,omitempty"`
+	Error       string                `json:"error,omitempty"`
+}
+
+// Done reports whether the job has reached a terminal state
+func (j CommandJob) Done() bool {
+	switch j.State {
+	case JobSucceeded, JobFailed, JobTimedOut, JobExpired:
+		return true
+	}
+	return false
+}
+
+// Deferred reports whether the job is waiting for an offline agent to reconnect
+func (j CommandJob) Deferred() bool {
+	return j.State == JobQueued && j.ExpiresAt != nil
+}
+
+// Missed-run policies for schedules whose run time passed while the
+// middleware was down
+const (
+	MissedSkip    = "skip"
+	MissedRunOnce = "run_once"
+)
+
+// Schedule is a command run against agents on a cron expression or once at
+// a given time
+type Schedule struct {
+	ID           string             `json:"id"`
+	Name         string             `json:"name"`
+	Cron         string             `json:"cron,omitempty"`
+	RunAt        *time.Time         `json:"run_at,omitempty"`
+	Timezone     string             `json:"timezone,omitempty"`
+	Command      BulkCommandRequest `json:"command"`
+	MissedPolicy string             `json:"missed_policy"`
+	Enabled      bool               `json:"enabled"`
+	CreatedBy    string             `json:"created_by"`
+	UpdatedBy    string             `json:"updated_by,omitempty"`
+	CreatedAt    time.Time          `json:"created_at"`
+	UpdatedAt    time.Time          `json:"updated_at"`
+	NextRun      *time.Time         `json:"next_run,omitempty"`
+	LastRun      *time.Time         `json:"last_run,omitempty"`
+}
+
+// Owner is the user the schedule's commands run on behalf of: whoever last
+// changed it
+func (s Schedule) Owner() string {
+	if s.UpdatedBy != "" {
+		return s.UpdatedBy
+	}
+	return s.CreatedBy
+}
+
+// ScheduleRequest is the JSON body to create or replace a schedule.
+// Exactly one of Cron or RunAt must be set.
+type ScheduleRequest struct {
+	Name         string             `json:"name"`
+	Cron         string             `json:"cron,omitempty"`
+	RunAt        *time.Time         `json:"run_at,omitempty"`
+	Timezone     string             `json:"timezone,omitempty"`
+	Command      BulkCommandRequest `json:"command"`
+	MissedPolicy string             `json:"missed_policy,omitempty"`
+	Enabled      *bool              `json:"enabled,omitempty"`
+}
+
+// Schedule run statuses besides the bulk command statuses
+const (
+	RunSkipped = "skipped"
+	RunError   = "error"
+)
+
+// ScheduleRun records one execution (or skipped execution) of a schedule
+type ScheduleRun struct {
+	ScheduleID  string               `json:"schedule_id"`
+	ScheduledAt time.Time            `json:"scheduled_at"`
+	StartedAt   time.Time            `json:"started_at"`
+	FinishedAt  *time.Time           `json:"finished_at,omitempty"`
+	Missed      bool                 `json:"missed,omitempty"`
+	Status      string               `json:"status"`
+	Message     string               `json:"message,omitempty"`
+	Result      *BulkCommandResponse `json:"result,omitempty"`
+}
+
+// ProcessRule matches processes by name, or by full command line if Cmdline
+// is set. Patterns match exactly unless Match is "glob" or "regex".
+type ProcessRule struct {
+	Pattern string `json:"pattern"`
+	Match   string `json:"match,omitempty"`
+	Cmdline bool   `json:"cmdline,omitempty"`
+}
+
+// RequiredProcess must be running with at least MinCount instances (default
+// 1). If Start is set, remediation launches Start with Args.
+type RequiredProcess struct {
+	ProcessRule
+	MinCount int      `json:"min_count,omitempty"`
+	Start    string   `json:"start,omitempty"`
+	Args     []string `json:"args,omitempty"`
+}
+
+// DesiredState declares the processes that must and must not run on an
+// agent, or on every agent matching a label selector
+type DesiredState struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	AgentID   string            `json:"agent_id,omitempty"`
+	Selector  string            `json:"selector,omitempty"`
+	Required  []RequiredProcess `json:"required,omitempty"`
+	Forbidden []ProcessRule     `json:"forbidden,omitempty"`
+	Remediate bool              `json:"remediate"`
+	CreatedBy string            `json:"created_by"`
+	UpdatedBy string            `json:"updated_by,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// Owner is the user remediations of the desired state run on behalf of:
+// whoever last changed it
+func (st DesiredState) Owner() string {
+	if st.UpdatedBy != "" {
+		return st.UpdatedBy
+	}
+	return st.CreatedBy
+}
+
+// DesiredStateRequest is the JSON body to create or replace a desired state.
+// Exactly one of AgentID or Selector must be set.
+type DesiredStateRequest struct {
+	Name      string            `json:"name"`
+	AgentID   string            `json:"agent_id,omitempty"`
+	Selector  string            `json:"selector,omitempty"`
+	Required  []RequiredProcess `json:"required,omitempty"`
+	Forbidden []ProcessRule     `json:"forbidden,omitempty"`
+	Remediate bool              `json:"remediate"`
+}
+
+// Kinds of drift from a desired state
+const (
+	DriftMissing   = "missing"
+	DriftForbidden = "forbidden"
+)
+
+// Drift is a difference between an agent's processes and a desired state.
+// RemediationError is set once remediation has given up on the drift, or
+// refused to act on it automatically.
+type Drift struct {
+	StateID             string     `json:"state_id"`
+	StateName           string     `json:"state_name"`
+	AgentID             string     `json:"agent_id"`
+	Hostname            string     `json:"hostname"`
+	Kind                string     `json:"kind"`
+	Pattern             string     `json:"pattern"`
+	Expected            int        `json:"expected"`
+	Found               int        `json:"found"`
+	PIDs                []int32    `json:"pids,omitempty"`
+	Since               time.Time  `json:"since"`
+	RemediatedAt        *time.Time `json:"remediated_at,omitempty"`
+	RemediationAttempts int        `json:"remediation_attempts,omitempty"`
+	RemediationJobIDs   []string   `json:"remediation_job_ids,omitempty"`
+	RemediationError    string     `json:"remediation_error,omitempty"`
+}
+
 // APIResponse is a generic API response envelope
 type APIResponse struct {
 	Success bool   `json:"success"`
@@ -77,7 +584,230 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
-// LoginResponse contains the JWT token
+// LoginResponse contains a short-lived JWT access token and the refresh
+// token that obtains new ones
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// RefreshRequest is the JSON body for the token refresh endpoint
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// --- Users ---
+
+// User roles
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Permissions granted by roles and carried in access tokens
+const (
+	// PermRead lists agents, processes, jobs, schedules and desired states
+	PermRead = "agents:read"
+	// PermOperate runs commands on agents and manages the schedules and
+	// desired states that do so
+	PermOperate = "agents:operate"
+	// PermManageAgents edits agent labels, enrollment tokens and credentials
+	PermManageAgents = "agents:manage"
+	// PermManageUsers manages users
+	PermManageUsers = "users:manage"
+	// PermReadAudit reads and exports the audit log
+	PermReadAudit = "audit:read"
+)
+
+// RolePermissions lists the permissions of each role
+var RolePermissions = map[string][]string{
+	RoleViewer:   {PermRead},
+	RoleOperator: {PermRead, PermOperate},
+	RoleAdmin:    {PermRead, PermOperate, PermManageAgents, PermManageUsers, PermReadAudit},
+}
+
+// User is a middleware account. The password hash is never exposed.
+// Operators may have a Scope, a label selector limiting the agents they can
+// operate; they can still see every agent.
+type User struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Scope    string `json:"scope,omitempty"`
+	Disabled bool   `json:"disabled"`
+	// Provider is set for users signed in through an external identity
+	// provider, whose password isn't managed by the middleware. Issuer and
+	// Subject identify the user at the provider.
+	Provider          string     `json:"provider,omitempty"`
+	Issuer            string     `json:"issuer,omitempty"`
+	Subject           string     `json:"subject,omitempty"`
+	CreatedBy         string     `json:"created_by,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	PasswordChangedAt time.Time  `json:"password_changed_at"`
+	LastLoginAt       *time.Time `json:"last_login_at,omitempty"`
+}
+
+// Account is the authenticated user along with their permissions
+type Account struct {
+	User
+	Permissions []string `json:"permissions"`
+}
+
+// UserRequest is the JSON body for creating a user. Role defaults to viewer.
+type UserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// UserUpdate is the JSON body for updating a user; unset fields are left
+// unchanged. Setting Password resets it without knowing the current one.
+type UserUpdate struct {
+	Role     *string `json:"role,omitempty"`
+	Scope    *string `json:"scope,omitempty"`
+	Disabled *bool   `json:"disabled,omitempty"`
+	Password *string `json:"password,omitempty"`
+}
+
+// APIKeyHeader is the request header API keys are sent in
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyRequest is the JSON body for creating an API key. The key acts with
+// the permissions of Role, narrowed to Permissions if given; Scope limits
+// the agents an operator key can operate.
+type APIKeyRequest struct {
+	Name        string   `json:"name"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions,omitempty"`
+	Scope       string   `json:"scope,omitempty"`
+	// TTL is a Go duration after which the key expires; empty never expires
+	TTL string `json:"ttl,omitempty"`
+}
+
+// APIKey is a named credential for automation clients. The key itself is
+// only returned when it is created.
+type APIKey struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Key         string     `json:"key,omitempty"`
+	Role        string     `json:"role"`
+	Permissions []string   `json:"permissions"`
+	Scope       string     `json:"scope,omitempty"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+}
+
+// PasswordChangeRequest is the JSON body for changing one's own password
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// --- Enrollment ---
+
+// EnrollmentTokenRequest is the JSON body for minting an enrollment token
+type EnrollmentTokenRequest struct {
+	Description string `json:"description,omitempty"`
+	// MaxUses is how many agents can enroll with the token, 1 if unset
+	MaxUses int `json:"max_uses,omitempty"`
+	// TTL is a Go duration after which the token expires, e.g. "24h"
+	TTL string `json:"ttl,omitempty"`
+}
+
+// EnrollmentToken lets agents obtain their credential. The token itself is
+// only returned when minted.
+type EnrollmentToken struct {
+	ID          string     `json:"id"`
+	Description string     `json:"description,omitempty"`
+	Token       string     `json:"token,omitempty"`
+	MaxUses     int        `json:"max_uses"`
+	Uses        int        `json:"uses"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// AgentCredential is the long-lived credential of a single enrolled agent
+type AgentCredential struct {
+	ID         string     `json:"id"`
+	AgentID    string     `json:"agent_id"`
+	Hostname   string     `json:"hostname"`
+	TokenID    string     `json:"token_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy  string     `json:"revoked_by,omitempty"`
+}
+
+// --- Audit ---
+
+// Audit actions. Commands are recorded as "command." followed by the
+// lowercased command action, e.g. "command.stop".
+const (
+	AuditLogin          = "auth.login"
+	AuditOIDCLogin      = "auth.oidc_login"
+	AuditRefresh        = "auth.refresh"
+	AuditLogout         = "auth.logout"
+	AuditRejected       = "auth.rejected"
+	AuditDenied         = "auth.denied"
+	AuditPasswordChange = "auth.password_change"
+	AuditAgentAuth      = "auth.agent"
+	AuditUserCreate     = "user.create"
+	AuditUserUpdate     = "user.update"
+	AuditUserDelete     = "user.delete"
+	AuditAPIKeyCreate   = "apikey.create"
+	AuditAPIKeyDelete   = "apikey.delete"
+	AuditTokenCreate    = "enrollment_token.create"
+	AuditTokenDelete    = "enrollment_token.delete"
+	AuditCredRevoke     = "credential.revoke"
+	AuditCommandPrefix  = "command."
+	// AuditSkipped counts the failed authentications from an address that
+	// weren't recorded individually
+	AuditSkipped = "audit.skipped"
+)
+
+// Audit results
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+	// AuditResultDenied is recorded for authenticated requests refused for
+	// lack of permission or scope
+	AuditResultDenied = "denied"
+)
+
+// AuditEntry is a record of the audit log. Entries form a hash chain: Hash
+// is the SHA-256 of the entry's JSON encoding with Hash empty, and PrevHash
+// is the Hash of the previous entry, so altering or removing an entry breaks
+// the chain from there on.
+type AuditEntry struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	User        string    `json:"user,omitempty"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	Action      string    `json:"action"`
+	AgentID     string    `json:"agent_id,omitempty"`
+	PID         int32     `json:"pid,omitempty"`
+	ProcessName string    `json:"process_name,omitempty"`
+	// Target is what the action applied to besides an agent or process,
+	// e.g. a user, a key or a service
+	Target   string `json:"target,omitempty"`
+	Result   string `json:"result"`
+	Detail   string `json:"detail,omitempty"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// AuditVerification is the result of checking the audit log's hash chain
+type AuditVerification struct {
+	Entries uint64 `json:"entries"`
+	Valid   bool   `json:"valid"`
+	// BrokenAt is the sequence number of the first entry that doesn't
+	// match the chain, set when Valid is false
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+	Error    string `json:"error,omitempty"`
 }
@@ -0,0 +1,427 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Telemetry encodings, selected by the agent on registration. JSON is the
+// default; with the binary encoding, telemetry messages travel as binary
+// WebSocket frames in the protobuf wire format described below, while every
+// other message stays JSON.
+//
+//	message Envelope       { string type = 1; bytes body = 2; }
+//	message ProcessInfo    { int32 pid = 1; string name = 2; string cmdline = 3;
+//	                         double cpu = 4; float memory = 5; }
+//	message AgentTelemetry { int64 timestamp_ns = 1; uint64 seq = 2;
+//	                         repeated ProcessInfo processes = 3;
+//	                         bytes services_json = 4; }
+//	message TelemetryDelta { uint64 seq = 1; int64 timestamp_ns = 2;
+//	                         repeated ProcessInfo added = 3;
+//	                         repeated ProcessInfo changed = 4;
+//	                         repeated int32 removed = 5 [packed = true];
+//	                         bytes services_json = 6; }
+//	message TelemetryBatch { repeated AgentTelemetry samples = 1; int32 dropped = 2; }
+//
+// Services are rare and deeply nested, so they are carried as embedded JSON.
+const (
+	EncodingJSON   = "json"
+	EncodingBinary = "binary"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated binary message")
+
+// IsBinaryType reports whether a message type is sent as a binary frame
+// under the binary encoding
+func IsBinaryType(msgType string) bool {
+	switch msgType {
+	case "telemetry", "telemetry_delta", "telemetry_batch":
+		return true
+	}
+	return false
+}
+
+// EncodeBinary encodes a telemetry message as a binary frame
+func EncodeBinary(msgType string, v any) ([]byte, error) {
+	var body []byte
+	var err error
+	switch m := v.(type) {
+	case AgentTelemetry:
+		body, err = appendTelemetry(nil, m)
+	case TelemetryDelta:
+		body, err = appendDelta(nil, m)
+	case TelemetryBatch:
+		for _, sample := range m.Samples {
+			if body, err = appendMessage(body, 1, func(b []byte) ([]byte, error) {
+				return appendTelemetry(b, sample)
+			}); err != nil {
+				return nil, err
+			}
+		}
+		body = appendVarint(body, 2, uint64(m.Dropped))
+	default:
+		return nil, fmt.Errorf("no binary encoding for %T", v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	frame := appendString(nil, 1, msgType)
+	frame = appendBytes(frame, 2, body)
+	return frame, nil
+}
+
+// DecodeEnvelope splits a binary frame into its message type and body
+func DecodeEnvelope(frame []byte) (msgType string, body []byte, err error) {
+	err = readFields(frame, func(num, typ int, r *wireReader) error {
+		switch num {
+		case 1:
+			b, err := r.bytes()
+			msgType = string(b)
+			return err
+		case 2:
+			body, err = r.bytes()
+			return err
+		}
+		return r.skip(typ)
+	})
+	if err == nil && msgType == "" {
+		err = errors.New("binary message without type")
+	}
+	return msgType, body, err
+}
+
+// DecodeBinary decodes the body of a binary frame into v, which must point
+// to the telemetry type matching the frame's message type
+func DecodeBinary(body []byte, v any) error {
+	switch m := v.(type) {
+	case *AgentTelemetry:
+		return decodeTelemetry(body, m)
+	case *TelemetryDelta:
+		return decodeDelta(body, m)
+	case *TelemetryBatch:
+		return readFields(body, func(num, typ int, r *wireReader) error {
+			switch num {
+			case 1:
+				b, err := r.bytes()
+				if err != nil {
+					return err
+				}
+				var sample AgentTelemetry
+				if err := decodeTelemetry(b, &sample); err != nil {
+					return err
+				}
+				m.Samples = append(m.Samples, sample)
+				return nil
+			case 2:
+				n, err := r.varint()
+				m.Dropped = int(int32(n))
+				return err
+			}
+			return r.skip(typ)
+		})
+	}
+	return fmt.Errorf("no binary encoding for %T", v)
+}
+
+// --- Messages ---
+
+func appendProcess(b []byte, p ProcessInfo) []byte {
+	b = appendVarint(b, 1, uint64(int64(p.PID)))
+	b = appendString(b, 2, p.Name)
+	b = appendString(b, 3, p.Cmdline)
+	if p.CPU != 0 {
+		b = binary.AppendUvarint(b, 4<<3|wireFixed64)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(p.CPU))
+	}
+	if p.Memory != 0 {
+		b = binary.AppendUvarint(b, 5<<3|wireFixed32)
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(p.Memory))
+	}
+	return b
+}
+
+func decodeProcess(body []byte) (ProcessInfo, error) {
+	var p ProcessInfo
+	err := readFields(body, func(num, typ int, r *wireReader) error {
+		switch num {
+		case 1:
+			n, err := r.varint()
+			p.PID = int32(n)
+			return err
+		case 2:
+			b, err := r.bytes()
+			p.Name = string(b)
+			return err
+		case 3:
+			b, err := r.bytes()
+			p.Cmdline = string(b)
+			return err
+		case 4:
+			n, err := r.fixed64()
+			p.CPU = math.Float64frombits(n)
+			return err
+		case 5:
+			n, err := r.fixed32()
+			p.Memory = math.Float32frombits(n)
+			return err
+		}
+		return r.skip(typ)
+	})
+	return p, err
+}
+
+func appendProcesses(b []byte, num int, procs []ProcessInfo) []byte {
+	for _, p := range procs {
+		b, _ = appendMessage(b, num, func(b []byte) ([]byte, error) {
+			return appendProcess(b, p), nil
+		})
+	}
+	return b
+}
+
+func appendServices(b []byte, num int, services []ServiceStatus) ([]byte, error) {
+	if len(services) == 0 {
+		return b, nil
+	}
+	data, err := json.Marshal(services)
+	if err != nil {
+		return nil, err
+	}
+	return appendBytes(b, num, data), nil
+}
+
+func appendTelemetry(b []byte, t AgentTelemetry) ([]byte, error) {
+	if !t.Timestamp.IsZero() {
+		b = appendVarint(b, 1, uint64(t.Timestamp.UnixNano()))
+	}
+	b = appendVarint(b, 2, t.Seq)
+	b = appendProcesses(b, 3, t.Processes)
+	return appendServices(b, 4, t.Services)
+}
+
+func decodeTelemetry(body []byte, t *AgentTelemetry) error {
+	return readFields(body, func(num, typ int, r *wireReader) error {
+		switch num {
+		case 1:
+			n, err := r.varint()
+			t.Timestamp = time.Unix(0, int64(n)).UTC()
+			return err
+		case 2:
+			n, err := r.varint()
+			t.Seq = n
+			return err
+		case 3:
+			return r.process(&t.Processes)
+		case 4:
+			return r.services(&t.Services)
+		}
+		return r.skip(typ)
+	})
+}
+
+func appendDelta(b []byte, d TelemetryDelta) ([]byte, error) {
+	b = appendVarint(b, 1, d.Seq)
+	if !d.Timestamp.IsZero() {
+		b = appendVarint(b, 2, uint64(d.Timestamp.UnixNano()))
+	}
+	b = appendProcesses(b, 3, d.Added)
+	b = appendProcesses(b, 4, d.Changed)
+	if len(d.Removed) > 0 {
+		var packed []byte
+		for _, pid := range d.Removed {
+			packed = binary.AppendUvarint(packed, uint64(int64(pid)))
+		}
+		b = appendBytes(b, 5, packed)
+	}
+	return appendServices(b, 6, d.Services)
+}
+
+func decodeDelta(body []byte, d *TelemetryDelta) error {
+	return readFields(body, func(num, typ int, r *wireReader) error {
+		switch num {
+		case 1:
+			n, err := r.varint()
+			d.Seq = n
+			return err
+		case 2:
+			n, err := r.varint()
+			d.Timestamp = time.Unix(0, int64(n)).UTC()
+			return err
+		case 3:
+			return r.process(&d.Added)
+		case 4:
+			return r.process(&d.Changed)
+		case 5:
+			if typ == wireVarint {
+				n, err := r.varint()
+				d.Removed = append(d.Removed, int32(n))
+				return err
+			}
+			packed, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			pr := wireReader{b: packed}
+			for len(pr.b) > 0 {
+				n, err := pr.varint()
+				if err != nil {
+					return err
+				}
+				d.Removed = append(d.Removed, int32(n))
+			}
+			return nil
+		case 6:
+			return r.services(&d.Services)
+		}
+		return r.skip(typ)
+	})
+}
+
+// --- Wire format ---
+
+func appendVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytes(b []byte, num int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendMessage appends the embedded message written by fn as field num
+func appendMessage(b []byte, num int, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	msg, err := fn(nil)
+	if err != nil {
+		return nil, err
+	}
+	return appendBytes(b, num, msg), nil
+}
+
+// wireReader consumes protobuf-encoded fields
+type wireReader struct {
+	b []byte
+}
+
+// readFields calls fn for every field in body. fn must consume the field's
+// value, or skip it.
+func readFields(body []byte, fn func(num, typ int, r *wireReader) error) error {
+	r := &wireReader{b: body}
+	for len(r.b) > 0 {
+		tag, err := r.varint()
+		if err != nil {
+			return err
+		}
+		if err := fn(int(tag>>3), int(tag&7), r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *wireReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *wireReader) fixed64() (uint64, error) {
+	if len(r.b) < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v, nil
+}
+
+func (r *wireReader) fixed32() (uint32, error) {
+	if len(r.b) < 4 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v, nil
+}
+
+func (r *wireReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.b)) < n {
+		return nil, errTruncated
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// process decodes an embedded ProcessInfo and appends it to procs
+func (r *wireReader) process(procs *[]ProcessInfo) error {
+	b, err := r.bytes()
+	if err != nil {
+		return err
+	}
+	p, err := decodeProcess(b)
+	if err != nil {
+		return err
+	}
+	*procs = append(*procs, p)
+	return nil
+}
+
+// services decodes embedded JSON service statuses
+func (r *wireReader) services(services *[]ServiceStatus) error {
+	b, err := r.bytes()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, services)
+}
+
+// skip discards a field of the given wire type
+func (r *wireReader) skip(typ int) error {
+	var err error
+	switch typ {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireFixed32:
+		_, err = r.fixed32()
+	case wireBytes:
+		_, err = r.bytes()
+	default:
+		err = fmt.Errorf("unsupported wire type %d", typ)
+	}
+	return err
+}
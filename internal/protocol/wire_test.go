@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	testTime  = time.Date(2026, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	testProcs = []ProcessInfo{
+		{PID: 1, Name: "systemd", Cmdline: "/sbin/init splash", CPU: 0.25, Memory: 0.5},
+		{PID: 4242, Name: "kworker/0:1"},
+		{PID: 70000, Name: "nginx: wörker", Cmdline: "nginx: worker process", CPU: 312.5, Memory: 12.75},
+		{PID: -1, Name: "negative"},
+	}
+	testServices = []ServiceStatus{{
+		Spec:      ServiceSpec{Name: "web", Command: "/usr/bin/web", Args: []string{"-port", "80"}, RestartPolicy: RestartAlways},
+		State:     ServiceRunning,
+		PID:       123,
+		Restarts:  2,
+		StartedAt: &testTime,
+	}}
+)
+
+// newOf returns a pointer to a new zero value of v's type, to decode into
+func newOf(v any) any {
+	return reflect.New(reflect.TypeOf(v)).Interface()
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgType string
+		msg     any
+	}{
+		{"empty telemetry", "telemetry", AgentTelemetry{}},
+		{"telemetry", "telemetry", AgentTelemetry{
+			Timestamp: testTime,
+			Seq:       1 << 40,
+			Processes: testProcs,
+			Services:  testServices,
+		}},
+		{"empty delta", "telemetry_delta", TelemetryDelta{Seq: 7}},
+		{"delta", "telemetry_delta", TelemetryDelta{
+			Seq:       8,
+			Timestamp: testTime,
+			Added:     testProcs[:2],
+			Changed:   testProcs[2:],
+			Removed:   []int32{3, 300, 1 << 30, -2},
+			Services:  testServices,
+		}},
+		{"empty batch", "telemetry_batch", TelemetryBatch{}},
+		{"batch", "telemetry_batch", TelemetryBatch{
+			Samples: []AgentTelemetry{
+				{Timestamp: testTime, Processes: testProcs},
+				{Timestamp: testTime.Add(time.Second), Services: testServices},
+			},
+			Dropped: 12,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !IsBinaryType(tt.msgType) {
+				t.Fatalf("%s isn't a binary type", tt.msgType)
+			}
+			frame, err := EncodeBinary(tt.msgType, tt.msg)
+			if err != nil {
+				t.Fatalf("EncodeBinary: %v", err)
+			}
+			msgType, body, err := DecodeEnvelope(frame)
+			if err != nil {
+				t.Fatalf("DecodeEnvelope: %v", err)
+			}
+			if msgType != tt.msgType {
+				t.Errorf("got type %q, want %q", msgType, tt.msgType)
+			}
+
+			got := newOf(tt.msg)
+			if err := DecodeBinary(body, got); err != nil {
+				t.Fatalf("DecodeBinary: %v", err)
+			}
+			if got := reflect.ValueOf(got).Elem().Interface(); !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("round trip mismatch\n got: %+v\nwant: %+v", got, tt.msg)
+			}
+
+			// Fields from newer versions are skipped
+			extended := binary.AppendUvarint(body, 15<<3|wireBytes)
+			extended = binary.AppendUvarint(extended, 3)
+			extended = append(extended, "new"...)
+			extended = appendVarint(extended, 16, 99)
+			got = newOf(tt.msg)
+			if err := DecodeBinary(extended, got); err != nil {
+				t.Fatalf("DecodeBinary with unknown fields: %v", err)
+			}
+			if got := reflect.ValueOf(got).Elem().Interface(); !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("unknown fields changed the message\n got: %+v\nwant: %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	tests := []struct {
+		msgType string
+		msg     any
+	}{
+		{"telemetry", AgentTelemetry{Timestamp: testTime, Seq: 3, Processes: testProcs, Services: testServices}},
+		{"telemetry_delta", TelemetryDelta{Seq: 4, Added: testProcs, Removed: []int32{1, 2, 3}, Services: testServices}},
+		{"telemetry_batch", TelemetryBatch{Samples: []AgentTelemetry{{Processes: testProcs}}, Dropped: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msgType, func(t *testing.T) {
+			frame, err := EncodeBinary(tt.msgType, tt.msg)
+			if err != nil {
+				t.Fatalf("EncodeBinary: %v", err)
+			}
+			// Cut anywhere past the type, the frame's body is incomplete
+			header := len(appendString(nil, 1, tt.msgType))
+			for n := header + 1; n < len(frame); n++ {
+				if _, _, err := DecodeEnvelope(frame[:n]); err == nil {
+					t.Errorf("envelope truncated to %d of %d bytes decoded without error", n, len(frame))
+				}
+			}
+			for n := range header {
+				if _, _, err := DecodeEnvelope(frame[:n]); err == nil {
+					t.Errorf("envelope truncated to %d bytes, within the type, decoded without error", n)
+				}
+			}
+
+			// Bodies cut on a field boundary are valid, shorter messages;
+			// cut anywhere else they must fail rather than panic or
+			// decode garbage
+			_, body, _ := DecodeEnvelope(frame)
+			boundaries := fieldBoundaries(t, body)
+			for n := range len(body) {
+				err := DecodeBinary(body[:n], newOf(tt.msg))
+				if boundaries[n] && err != nil {
+					t.Errorf("body cut at field boundary %d: %v", n, err)
+				}
+				if !boundaries[n] && err == nil {
+					t.Errorf("body truncated to %d of %d bytes decoded without error", n, len(body))
+				}
+			}
+		})
+	}
+}
+
+// fieldBoundaries returns the offsets in a message body at which a field
+// starts, and so where a cut leaves a valid message
+func fieldBoundaries(t *testing.T, body []byte) map[int]bool {
+	t.Helper()
+	boundaries := map[int]bool{0: true}
+	err := readFields(body, func(_, typ int, r *wireReader) error {
+		if err := r.skip(typ); err != nil {
+			return err
+		}
+		boundaries[len(body)-len(r.b)] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading fields: %v", err)
+	}
+	return boundaries
+}
+
+func TestBinaryErrors(t *testing.T) {
+	if _, err := EncodeBinary("heartbeat", struct{}{}); err == nil {
+		t.Error("EncodeBinary accepted a message without a binary encoding")
+	}
+	if err := DecodeBinary(nil, &struct{}{}); err == nil {
+		t.Error("DecodeBinary accepted a message without a binary encoding")
+	}
+	if _, _, err := DecodeEnvelope(appendBytes(nil, 2, nil)); err == nil {
+		t.Error("DecodeEnvelope accepted a frame without type")
+	}
+	if _, _, err := DecodeEnvelope([]byte{1<<3 | 3}); err == nil {
+		t.Error("DecodeEnvelope accepted an unsupported wire type")
+	}
+}